@@ -0,0 +1,309 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminJob is the JSON representation of a job in the admin API.
+type adminJob struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Spec        string     `json:"spec,omitempty"`
+	At          *time.Time `json:"at,omitempty"`
+	DependsOn   string     `json:"depends_on,omitempty"`
+	Timezone    string     `json:"timezone,omitempty"`
+	Destination string     `json:"destination"`
+	Paused      bool       `json:"paused"`
+	Next        *time.Time `json:"next,omitempty"`
+	Prev        *time.Time `json:"prev,omitempty"`
+}
+
+// adminHandler is an http.Handler serving the JSON admin API for the
+// jobs in a registry.
+//
+//	GET    /jobs                list jobs
+//	GET    /jobs/NAME           get a job
+//	DELETE /jobs/NAME           remove a job (?topics=true deletes its topics)
+//	POST   /jobs/NAME/pause     pause a job
+//	POST   /jobs/NAME/resume    resume a job
+//	POST   /jobs/NAME/run       run a job immediately
+//	GET    /jobs/NAME/history   get a job's execution history (?limit=N)
+//	GET    /clock               get the virtual clock time
+//	POST   /clock/advance?to=T  advance the virtual clock to T
+type adminHandler struct {
+	reg *registry
+}
+
+func (h adminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(req.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	if parts[0] == "clock" {
+		h.serveClock(w, req, parts)
+		return
+	}
+	if parts[0] != "jobs" || len(parts) > 3 {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	if len(parts) == 3 && parts[2] == "history" {
+		h.serveHistory(w, req, parts[1])
+		return
+	}
+	if len(parts) == 2 && req.Method == http.MethodDelete {
+		h.serveDelete(w, req, parts[1])
+		return
+	}
+	switch len(parts) {
+	case 1:
+		if !allow(w, req, http.MethodGet) {
+			return
+		}
+		jobs := []adminJob{}
+		for _, s := range h.reg.list() {
+			jobs = append(jobs, toAdminJob(s))
+		}
+		writeJSON(w, http.StatusOK, jobs)
+		return
+	case 2:
+		if !allow(w, req, http.MethodGet) {
+			return
+		}
+	case 3:
+		if !allow(w, req, http.MethodPost) {
+			return
+		}
+		var err error
+		switch name := parts[1]; parts[2] {
+		case "pause":
+			err = h.reg.setPaused(name, true)
+		case "resume":
+			err = h.reg.setPaused(name, false)
+		case "run":
+			err = h.reg.run(name)
+		default:
+			writeError(w, http.StatusNotFound, errors.New("not found"))
+			return
+		}
+		if err != nil {
+			writeRegistryError(w, err)
+			return
+		}
+	}
+	s, err := h.reg.status(parts[1])
+	if err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toAdminJob(s))
+}
+
+// adminDeleted is the JSON representation of the result of deleting a
+// job through the admin API.
+type adminDeleted struct {
+	Name          string   `json:"name"`
+	Deleted       bool     `json:"deleted"`
+	DeletedTopics []string `json:"deleted_topics,omitempty"`
+}
+
+// serveDelete removes the named job from the registry, deleting its
+// topics if requested.
+func (h adminHandler) serveDelete(w http.ResponseWriter, req *http.Request, name string) {
+	var topics bool
+	if s := req.URL.Query().Get("topics"); s != "" {
+		var err error
+		topics, err = strconv.ParseBool(s)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	s, err := h.reg.status(name)
+	if err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+	err = h.reg.remove(name)
+	if err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+	slog.Info("removed job", "job", name)
+	var deleted []string
+	if topics {
+		deleted, err = h.reg.deleteTopics(req.Context(), s.job)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, adminDeleted{Name: name, Deleted: true, DeletedTopics: deleted})
+}
+
+// serveHistory serves the execution history of the named job.
+func (h adminHandler) serveHistory(w http.ResponseWriter, req *http.Request, name string) {
+	if !allow(w, req, http.MethodGet) {
+		return
+	}
+	if h.reg.env.history == nil {
+		writeError(w, http.StatusNotFound, errors.New("history not enabled"))
+		return
+	}
+	_, err := h.reg.status(name)
+	if err != nil {
+		writeRegistryError(w, err)
+		return
+	}
+	var limit int
+	if s := req.URL.Query().Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	execs, err := h.reg.env.history.executions(name, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if execs == nil {
+		execs = []execution{}
+	}
+	writeJSON(w, http.StatusOK, execs)
+}
+
+// adminClock is the JSON representation of the virtual clock in the
+// admin API.
+type adminClock struct {
+	Now   time.Time `json:"now"`
+	Speed float64   `json:"speed"`
+}
+
+// serveClock serves the virtual clock endpoints of the admin API.
+func (h adminHandler) serveClock(w http.ResponseWriter, req *http.Request, parts []string) {
+	if clock == nil {
+		writeError(w, http.StatusNotFound, errors.New("virtual clock not enabled"))
+		return
+	}
+	switch {
+	case len(parts) == 1:
+		if !allow(w, req, http.MethodGet) {
+			return
+		}
+	case len(parts) == 2 && parts[1] == "advance":
+		if !allow(w, req, http.MethodPost) {
+			return
+		}
+		t, err := time.Parse(time.RFC3339Nano, req.URL.Query().Get("to"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		err = h.reg.advance(t)
+		if err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	writeJSON(w, http.StatusOK, adminClock{Now: clock.Now(), Speed: clock.Speed()})
+}
+
+// serveAdmin serves the admin API for reg on the given network address.
+// For unix networks, any stale socket file at addr is removed first.
+func serveAdmin(network, addr string, reg *registry) (*http.Server, net.Addr, error) {
+	if network == "unix" {
+		err := os.Remove(addr)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, nil, err
+		}
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	srv := &http.Server{Handler: adminHandler{reg: reg}}
+	go func() {
+		err := srv.Serve(l)
+		if err != nil && err != http.ErrServerClosed {
+			slog.Error("admin API server failed", "err", err)
+		}
+	}()
+	return srv, l.Addr(), nil
+}
+
+// toAdminJob returns the admin API representation of s.
+func toAdminJob(s jobStatus) adminJob {
+	j := adminJob{
+		Name:        s.job.Name,
+		Description: s.job.Description,
+		DependsOn:   s.job.DependsOn,
+		Timezone:    s.job.Timezone,
+		Destination: s.job.Target.Destination,
+		Paused:      s.paused,
+	}
+	if j.DependsOn == "" {
+		j.Spec = s.job.Frequency
+	}
+	if !s.job.At.IsZero() {
+		at := s.job.At
+		j.At = &at
+	}
+	if !s.next.IsZero() {
+		j.Next = &s.next
+	}
+	if !s.prev.IsZero() {
+		j.Prev = &s.prev
+	}
+	return j
+}
+
+// allow returns whether the request's method is method, writing a 405
+// response if it is not.
+func allow(w http.ResponseWriter, req *http.Request, method string) bool {
+	if req.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	return false
+}
+
+// writeRegistryError writes a response for an error returned by a
+// registry.
+func writeRegistryError(w http.ResponseWriter, err error) {
+	code := http.StatusConflict
+	if errors.Is(err, errJobNotFound) {
+		code = http.StatusNotFound
+	}
+	writeError(w, code, err)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.Error("failed to write admin response", "err", err)
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"cloud.google.com/go/pubsub/pstest"
+)
+
+// startBuiltinPubsub starts an in-process Pub/Sub server listening on
+// port, or on a free port if port is zero, and directs the Pub/Sub
+// clients to it by setting PUBSUB_EMULATOR_HOST.
+func startBuiltinPubsub(port int) (*pstest.Server, error) {
+	if port != 0 {
+		// pstest panics if it cannot listen,
+		// so check that the port is free.
+		l, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+		if err != nil {
+			return nil, err
+		}
+		l.Close()
+	}
+	srv := pstest.NewServerWithPort(port)
+	err := os.Setenv("PUBSUB_EMULATOR_HOST", srv.Addr)
+	if err != nil {
+		srv.Close()
+		return nil, err
+	}
+	return srv, nil
+}
@@ -0,0 +1,11 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "github.com/kortschak/scheduler/schedule"
+
+// clock is the scheduler's virtual clock. It is nil when jobs are
+// scheduled in real time.
+var clock *schedule.Clock
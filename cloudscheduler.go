@@ -0,0 +1,338 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	schedulerpb "google.golang.org/genproto/googleapis/cloud/scheduler/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// cloudScheduler is an implementation of the Cloud Scheduler v1 gRPC
+// API backed by a registry. Jobs are identified by their job ID; the
+// project and location of job names are retained, but not otherwise
+// used.
+type cloudScheduler struct {
+	schedulerpb.UnimplementedCloudSchedulerServer
+
+	reg *registry
+
+	// parent is the parent resource name
+	// for jobs not created through the API.
+	parent string
+
+	mu      sync.Mutex
+	parents map[string]string // parents maps job IDs to their parent.
+}
+
+// newCloudScheduler returns a new cloudScheduler for the jobs in reg
+// using parent as the resource name parent of jobs not created through
+// the API.
+func newCloudScheduler(reg *registry, parent string) *cloudScheduler {
+	return &cloudScheduler{reg: reg, parent: parent, parents: make(map[string]string)}
+}
+
+func (s *cloudScheduler) ListJobs(_ context.Context, req *schedulerpb.ListJobsRequest) (*schedulerpb.ListJobsResponse, error) {
+	var resp schedulerpb.ListJobsResponse
+	for _, js := range s.reg.list() {
+		resp.Jobs = append(resp.Jobs, s.toProto(js))
+	}
+	return &resp, nil
+}
+
+func (s *cloudScheduler) GetJob(_ context.Context, req *schedulerpb.GetJobRequest) (*schedulerpb.Job, error) {
+	_, id, err := splitJobName(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return s.job(id)
+}
+
+func (s *cloudScheduler) CreateJob(ctx context.Context, req *schedulerpb.CreateJobRequest) (*schedulerpb.Job, error) {
+	if req.Job == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing job")
+	}
+	parent, id, err := splitJobName(req.Job.Name)
+	if err != nil {
+		return nil, err
+	}
+	if parent != req.Parent {
+		return nil, status.Errorf(codes.InvalidArgument, "job %q is not in %q", req.Job.Name, req.Parent)
+	}
+	j, err := fromProto(id, req.Job)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	err = s.reg.add(ctx, j, req.Job.State == schedulerpb.Job_PAUSED)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	s.mu.Lock()
+	s.parents[id] = parent
+	s.mu.Unlock()
+	return s.job(id)
+}
+
+func (s *cloudScheduler) DeleteJob(_ context.Context, req *schedulerpb.DeleteJobRequest) (*emptypb.Empty, error) {
+	_, id, err := splitJobName(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	err = s.reg.remove(id)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	s.mu.Lock()
+	delete(s.parents, id)
+	s.mu.Unlock()
+	return &emptypb.Empty{}, nil
+}
+
+func (s *cloudScheduler) PauseJob(_ context.Context, req *schedulerpb.PauseJobRequest) (*schedulerpb.Job, error) {
+	return s.setPaused(req.Name, true)
+}
+
+func (s *cloudScheduler) ResumeJob(_ context.Context, req *schedulerpb.ResumeJobRequest) (*schedulerpb.Job, error) {
+	return s.setPaused(req.Name, false)
+}
+
+// setPaused sets the paused state of the named job. As with Cloud
+// Scheduler, only enabled jobs may be paused and only paused jobs may
+// be resumed.
+func (s *cloudScheduler) setPaused(name string, paused bool) (*schedulerpb.Job, error) {
+	_, id, err := splitJobName(name)
+	if err != nil {
+		return nil, err
+	}
+	js, err := s.reg.status(id)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	if js.paused == paused {
+		state := "enabled"
+		if paused {
+			state = "paused"
+		}
+		return nil, status.Errorf(codes.FailedPrecondition, "job %q is already %s", id, state)
+	}
+	err = s.reg.setPaused(id, paused)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return s.job(id)
+}
+
+func (s *cloudScheduler) RunJob(_ context.Context, req *schedulerpb.RunJobRequest) (*schedulerpb.Job, error) {
+	_, id, err := splitJobName(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	err = s.reg.run(id)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return s.job(id)
+}
+
+// job returns the proto representation of the job with the given ID.
+func (s *cloudScheduler) job(id string) (*schedulerpb.Job, error) {
+	js, err := s.reg.status(id)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return s.toProto(js), nil
+}
+
+// toProto returns the proto representation of a job's status.
+func (s *cloudScheduler) toProto(js jobStatus) *schedulerpb.Job {
+	j := js.job
+	s.mu.Lock()
+	parent, ok := s.parents[j.Name]
+	s.mu.Unlock()
+	if !ok {
+		parent = s.parent
+	}
+	pj := &schedulerpb.Job{
+		Name:        parent + "/jobs/" + j.Name,
+		Description: j.Description,
+		Schedule:    j.Frequency,
+		TimeZone:    j.Timezone,
+		State:       schedulerpb.Job_ENABLED,
+	}
+	if js.paused {
+		pj.State = schedulerpb.Job_PAUSED
+	}
+	if !js.next.IsZero() {
+		pj.ScheduleTime = timestamppb.New(js.next)
+	}
+	if !js.prev.IsZero() {
+		pj.LastAttemptTime = timestamppb.New(js.prev)
+	}
+	if j.AttemptDeadline != 0 {
+		pj.AttemptDeadline = durationpb.New(j.AttemptDeadline)
+	}
+	if r := j.RetryConfig; r != nil {
+		pj.RetryConfig = &schedulerpb.RetryConfig{
+			RetryCount:         int32(r.RetryCount),
+			MaxRetryDuration:   durationpb.New(r.MaxRetryDuration),
+			MinBackoffDuration: durationpb.New(r.MinBackoffDuration),
+			MaxBackoffDuration: durationpb.New(r.MaxBackoffDuration),
+		}
+		if r.MaxDoublings != nil {
+			pj.RetryConfig.MaxDoublings = int32(*r.MaxDoublings)
+		}
+	}
+	t := j.Target
+	method := schedulerpb.HttpMethod(schedulerpb.HttpMethod_value[strings.ToUpper(t.HTTPMethod)])
+	switch t.destination() {
+	case pubsubDestination:
+		project := j.Project
+		if project == "" {
+			project = strings.TrimPrefix(parent, "projects/")
+			project = strings.SplitN(project, "/", 2)[0]
+		}
+		data := []byte(j.Payload)
+		if j.PayloadBase64 != "" || j.PayloadHex != "" {
+			// Validated when the job was added.
+			data, _ = j.binaryPayload()
+		}
+		pj.Target = &schedulerpb.Job_PubsubTarget{PubsubTarget: &schedulerpb.PubsubTarget{
+			TopicName:  "projects/" + project + "/topics/" + t.Topic,
+			Data:       data,
+			Attributes: j.Attributes,
+		}}
+	case httpDestination:
+		pj.Target = &schedulerpb.Job_HttpTarget{HttpTarget: &schedulerpb.HttpTarget{
+			Uri:        t.URI,
+			HttpMethod: method,
+			Headers:    t.Headers,
+			Body:       []byte(t.Body),
+		}}
+	case appEngineDestination:
+		pj.Target = &schedulerpb.Job_AppEngineHttpTarget{AppEngineHttpTarget: &schedulerpb.AppEngineHttpTarget{
+			HttpMethod: method,
+			AppEngineRouting: &schedulerpb.AppEngineRouting{
+				Service:  t.AppEngineRouting.Service,
+				Version:  t.AppEngineRouting.Version,
+				Instance: t.AppEngineRouting.Instance,
+			},
+			RelativeUri: t.RelativeURI,
+			Headers:     t.Headers,
+			Body:        []byte(t.Body),
+		}}
+	}
+	return pj
+}
+
+// fromProto returns the job with the given ID described by pj.
+func fromProto(id string, pj *schedulerpb.Job) (job, error) {
+	j := job{
+		Name:        id,
+		Description: pj.Description,
+		Frequency:   pj.Schedule,
+		Timezone:    pj.TimeZone,
+	}
+	if pj.AttemptDeadline != nil {
+		j.AttemptDeadline = pj.AttemptDeadline.AsDuration()
+	}
+	if r := pj.RetryConfig; r != nil {
+		j.RetryConfig = &retryConfig{
+			RetryCount:         int(r.RetryCount),
+			MaxRetryDuration:   r.MaxRetryDuration.AsDuration(),
+			MinBackoffDuration: r.MinBackoffDuration.AsDuration(),
+			MaxBackoffDuration: r.MaxBackoffDuration.AsDuration(),
+		}
+		if r.MaxDoublings != 0 {
+			n := int(r.MaxDoublings)
+			j.RetryConfig.MaxDoublings = &n
+		}
+	}
+	switch t := pj.Target.(type) {
+	case *schedulerpb.Job_PubsubTarget:
+		name := t.PubsubTarget.TopicName
+		if i := strings.LastIndex(name, "/topics/"); i >= 0 {
+			j.Project = strings.TrimPrefix(name[:i], "projects/")
+			name = name[i+len("/topics/"):]
+		}
+		j.Target = target{Destination: "Pub/Sub", Topic: name}
+		j.Payload = string(t.PubsubTarget.Data)
+		j.Attributes = t.PubsubTarget.Attributes
+	case *schedulerpb.Job_HttpTarget:
+		j.Target = target{
+			Destination: "HTTP",
+			URI:         t.HttpTarget.Uri,
+			HTTPMethod:  httpMethodName(t.HttpTarget.HttpMethod),
+			Headers:     t.HttpTarget.Headers,
+			Body:        string(t.HttpTarget.Body),
+		}
+	case *schedulerpb.Job_AppEngineHttpTarget:
+		j.Target = target{
+			Destination: "App Engine HTTP",
+			RelativeURI: t.AppEngineHttpTarget.RelativeUri,
+			HTTPMethod:  httpMethodName(t.AppEngineHttpTarget.HttpMethod),
+			Headers:     t.AppEngineHttpTarget.Headers,
+			Body:        string(t.AppEngineHttpTarget.Body),
+		}
+		if r := t.AppEngineHttpTarget.AppEngineRouting; r != nil {
+			j.Target.AppEngineRouting = appEngineRouting{
+				Service:  r.Service,
+				Version:  r.Version,
+				Instance: r.Instance,
+			}
+		}
+	default:
+		return job{}, errors.New("missing target")
+	}
+	return j, nil
+}
+
+// httpMethodName returns the name of m, or the empty string if m is
+// unspecified.
+func httpMethodName(m schedulerpb.HttpMethod) string {
+	if m == schedulerpb.HttpMethod_HTTP_METHOD_UNSPECIFIED {
+		return ""
+	}
+	return m.String()
+}
+
+// splitJobName splits a job resource name of the form
+// projects/PROJECT_ID/locations/LOCATION_ID/jobs/JOB_ID into its parent
+// and job ID.
+func splitJobName(name string) (parent, id string, err error) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 6 || parts[0] != "projects" || parts[2] != "locations" || parts[4] != "jobs" || parts[5] == "" {
+		return "", "", status.Errorf(codes.InvalidArgument, "invalid job name: %q", name)
+	}
+	return strings.Join(parts[:4], "/"), parts[5], nil
+}
+
+// statusError returns a gRPC status error corresponding to a registry
+// error.
+func statusError(err error) error {
+	switch {
+	case errors.Is(err, errJobExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, errJobNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	default:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+}
+
+// parentName returns the parent resource name for jobs in the given
+// project and location.
+func parentName(project, location string) string {
+	return "projects/" + project + "/locations/" + location
+}
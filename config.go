@@ -0,0 +1,907 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/kortschak/scheduler/internal/cli"
+	"github.com/kortschak/scheduler/schedule"
+	"github.com/robfig/cron/v3"
+)
+
+// load returns the config in the files named by path, or if path is
+// empty, the merged config from the config files in dir. Files are
+// decoded in the given format, or if format is empty, the format
+// indicated by their extension.
+func load(path, dir, format string) (config, error) {
+	if path == "" {
+		return loadConfigDir(dir, format)
+	}
+	paths, err := configPaths(path)
+	if err != nil {
+		return config{}, err
+	}
+	if len(paths) == 1 && paths[0] == path {
+		return loadConfig(path, format)
+	}
+	return loadConfigFiles(paths, format)
+}
+
+// configPaths returns the paths of the config files named by path. If
+// path is a directory, the config files in the directory are returned,
+// and if it is a glob pattern, the files matching the pattern are
+// returned in lexical order. The standard input, "-", and URLs name a
+// single config.
+func configPaths(path string) ([]string, error) {
+	if path == "-" || cli.IsRemote(path) {
+		return []string{path}, nil
+	}
+	fi, err := os.Stat(path)
+	switch {
+	case err == nil && fi.IsDir():
+		paths, err := cli.ConfigFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("no config files in %s", path)
+		}
+		return paths, nil
+	case err == nil, !strings.ContainsAny(path, `*?[\`):
+		return []string{path}, err
+	}
+	paths, err := filepath.Glob(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no config files match %s", path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// loadConfig returns the config in the file at path, merged with the
+// configs it includes.
+func loadConfig(path, format string) (config, error) {
+	return loadConfigFile(path, format, nil)
+}
+
+// loadConfigFile returns the config in the file at path, merged with the
+// configs it includes. Included configs are merged as for loadConfigDir,
+// and the config's defaults are then applied to all its jobs. The
+// including parameter holds the absolute paths of the files that include
+// path, and is used to detect include cycles.
+func loadConfigFile(path, format string, including []string) (config, error) {
+	abs := path
+	if path != "-" && !cli.IsRemote(path) {
+		var err error
+		abs, err = filepath.Abs(path)
+		if err != nil {
+			return config{}, err
+		}
+	}
+	for _, p := range including {
+		if p == abs {
+			return config{}, fmt.Errorf("%s: include cycle", path)
+		}
+	}
+	var cfg config
+	err := cli.LoadConfig(path, format, &cfg)
+	if err != nil {
+		return config{}, err
+	}
+	if cfg.Seconds {
+		for i := range cfg.Jobs {
+			cfg.Jobs[i].Seconds = true
+		}
+	}
+	cfg.files = []string{path}
+	names := make(map[string]string)
+	for _, j := range cfg.Jobs {
+		names[j.Name] = path
+	}
+	for _, pattern := range cfg.Include {
+		paths, err := includePaths(path, pattern)
+		if err != nil {
+			return config{}, err
+		}
+		for _, p := range paths {
+			inc, err := loadConfigFile(p, format, append(including, abs))
+			if err != nil {
+				return config{}, err
+			}
+			err = mergeConfig(&cfg, inc, p, names)
+			if err != nil {
+				return config{}, err
+			}
+		}
+	}
+	for i := range cfg.Jobs {
+		cfg.Defaults.apply(&cfg.Jobs[i])
+	}
+	err = checkTimezones(cfg)
+	if err != nil {
+		return config{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// checkTimezones returns an error if the timezone of cfg or of any of
+// its jobs is not in the time zone database.
+func checkTimezones(cfg config) error {
+	_, err := cfg.location()
+	if err != nil {
+		return fmt.Errorf("invalid timezone: %w", err)
+	}
+	for _, j := range cfg.Jobs {
+		_, err = j.location(nil)
+		if err != nil {
+			return fmt.Errorf("%s: invalid timezone: %w", j.Name, err)
+		}
+	}
+	return nil
+}
+
+// includePaths returns the paths of the configs included by the config
+// at path with the given pattern. Relative patterns in local configs are
+// relative to the directory of path, and may be glob patterns. Relative
+// patterns in remote configs are resolved against the config's URL.
+func includePaths(path, pattern string) ([]string, error) {
+	switch {
+	case cli.IsRemote(pattern):
+		return []string{pattern}, nil
+	case cli.IsRemote(path):
+		base, err := url.Parse(path)
+		if err != nil {
+			return nil, err
+		}
+		ref, err := url.Parse(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid include %q: %w", path, pattern, err)
+		}
+		return []string{base.ResolveReference(ref).String()}, nil
+	}
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(path), pattern)
+	}
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid include %q: %w", path, pattern, err)
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%s: no files match include %q", path, pattern)
+	}
+	return paths, nil
+}
+
+// loadConfigDir returns the merged config from all the .yaml, .json
+// and .toml files in dir. Files are merged in lexical order of their
+// names.
+func loadConfigDir(dir, format string) (config, error) {
+	paths, err := cli.ConfigFiles(dir)
+	if err != nil {
+		return config{}, err
+	}
+	if len(paths) == 0 {
+		return config{}, fmt.Errorf("no config files in %s", dir)
+	}
+	return loadConfigFiles(paths, format)
+}
+
+// loadConfigFiles returns the merged config from the files at paths,
+// merged in order.
+func loadConfigFiles(paths []string, format string) (config, error) {
+	var merged config
+	names := make(map[string]string)
+	for _, p := range paths {
+		cfg, err := loadConfig(p, format)
+		if err != nil {
+			return config{}, err
+		}
+		err = mergeConfig(&merged, cfg, p, names)
+		if err != nil {
+			return config{}, err
+		}
+	}
+	return merged, nil
+}
+
+// mergeConfig merges cfg, loaded from the file at path, into dst. Project,
+// timezone and the pubsub endpoint and credentials file may be specified
+// in either config, but must agree if specified in both. Attributes are
+// merged, but must agree for keys specified in both. Job names must be
+// unique; names maps the names of the jobs already merged to the files
+// they were defined in.
+func mergeConfig(dst *config, cfg config, path string, names map[string]string) error {
+	var err error
+	dst.Project, err = mergeField("project", dst.Project, cfg.Project, path)
+	if err != nil {
+		return err
+	}
+	dst.Timezone, err = mergeField("timezone", dst.Timezone, cfg.Timezone, path)
+	if err != nil {
+		return err
+	}
+	for k, v := range cfg.Attributes {
+		if prev, ok := dst.Attributes[k]; ok && prev != v {
+			return fmt.Errorf("%s: conflicting attribute %q value %q (previously %q)", path, k, v, prev)
+		}
+		if dst.Attributes == nil {
+			dst.Attributes = make(map[string]string)
+		}
+		dst.Attributes[k] = v
+	}
+	dst.AppEngine = append(dst.AppEngine, cfg.AppEngine...)
+	dst.PubSub.Endpoint, err = mergeField("pubsub endpoint", dst.PubSub.Endpoint, cfg.PubSub.Endpoint, path)
+	if err != nil {
+		return err
+	}
+	dst.PubSub.CredentialsFile, err = mergeField("pubsub credentials file", dst.PubSub.CredentialsFile, cfg.PubSub.CredentialsFile, path)
+	if err != nil {
+		return err
+	}
+	dst.PubSub.Insecure = dst.PubSub.Insecure || cfg.PubSub.Insecure
+	for _, j := range cfg.Jobs {
+		if prev, ok := names[j.Name]; ok {
+			return fmt.Errorf("%s: duplicate job name %q (first defined in %s)", path, j.Name, prev)
+		}
+		names[j.Name] = path
+		dst.Jobs = append(dst.Jobs, j)
+	}
+	dst.files = append(dst.files, cfg.files...)
+	return nil
+}
+
+// mergeField returns the merged value of a top-level config field from
+// the current merged value and the value in the file at path.
+func mergeField(name, merged, val, path string) (string, error) {
+	if val == "" {
+		return merged, nil
+	}
+	if merged != "" && merged != val {
+		return "", fmt.Errorf("%s: conflicting %s %q (previously %q)", path, name, val, merged)
+	}
+	return val, nil
+}
+
+// See https://cloud.google.com/scheduler/docs/quickstart#create_a_job
+type config struct {
+	Project string
+	Jobs    []job
+
+	// Include holds the paths of configs to merge
+	// into this one. Relative paths are relative to
+	// the directory of the including file. Paths may
+	// be glob patterns.
+	Include []string
+
+	// Defaults holds values for the jobs of this
+	// config and its includes that do not set them.
+	Defaults jobDefaults
+
+	// Timezone is the location used for jobs that do
+	// not specify a timezone. Local if empty.
+	Timezone string
+
+	// Attributes are attached to every published message.
+	// Attributes set for a specific job, including those
+	// set by scheduler, override these on collision.
+	Attributes map[string]string
+
+	// Seconds specifies that the frequencies of all
+	// the jobs in the file have a seconds field.
+	Seconds bool
+
+	// AppEngine maps App Engine services and
+	// versions to locally running dev servers.
+	AppEngine []appEngineHost
+
+	// PubSub specifies how to connect to Pub/Sub when
+	// PUBSUB_EMULATOR_HOST is not set.
+	PubSub cli.Connection
+
+	// files holds the paths of the files
+	// the config was loaded from.
+	files []string
+}
+
+// jobDefaults holds default values of job fields.
+type jobDefaults struct {
+	Timezone    string
+	Destination string
+	RetryConfig *retryConfig
+}
+
+// apply sets the fields of j that are not set to their default values.
+func (d jobDefaults) apply(j *job) {
+	if j.Timezone == "" {
+		j.Timezone = d.Timezone
+	}
+	if j.RetryConfig == nil && d.RetryConfig != nil {
+		r := *d.RetryConfig
+		j.RetryConfig = &r
+	}
+	if j.Target.Destination == "" {
+		j.Target.Destination = d.Destination
+	}
+	for i := range j.Target.fanout {
+		if j.Target.fanout[i].Destination == "" {
+			j.Target.fanout[i].Destination = d.Destination
+		}
+	}
+}
+
+// location returns the location used for jobs that do not specify a
+// timezone.
+func (c config) location() (*time.Location, error) {
+	if c.Timezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(c.Timezone)
+}
+
+type job struct {
+	Name        string
+	Description string
+	Frequency   string
+	Timezone    string // Local if empty.
+
+	// Project is the project of the job's Pub/Sub
+	// topics. The top-level project is used if empty.
+	Project string
+
+	// At is the time of a one-shot job. Jobs with an At
+	// time fire once and are then removed. At and
+	// Frequency are mutually exclusive.
+	At      time.Time
+	Target  target
+	Payload string
+
+	// PayloadFile is the path to a file holding the
+	// payload and PayloadExec is a command and its
+	// arguments whose standard output is the payload.
+	// Both are read each time the job fires.
+	PayloadFile string
+	PayloadExec []string
+
+	// PayloadBase64 and PayloadHex hold a binary
+	// payload in base64 or hexadecimal encoding.
+	// Only one of the payload fields may be set.
+	PayloadBase64 string
+	PayloadHex    string
+
+	// PayloadSchema is the path to a JSON Schema that
+	// the job's payloads must match. Static payloads
+	// are checked when the job is added and others
+	// each time the job fires.
+	PayloadSchema string
+
+	// Attributes are attached to messages published
+	// by the job, overriding top-level attributes.
+	Attributes map[string]string
+
+	// OrderingKey is the ordering key of messages
+	// published by the job. If it is not empty,
+	// message ordering is enabled for the job's
+	// topics.
+	OrderingKey string
+
+	// Proto specifies that the payload is a JSON protobuf
+	// message to be published in binary wire format.
+	Proto *protoPayload
+
+	// MaxConcurrent is the maximum number of overlapping
+	// invocations of the job. Invocations beyond the limit
+	// are skipped. Unlimited if zero.
+	MaxConcurrent int
+
+	// ConcurrencyPolicy is the handling of invocations
+	// while a previous invocation is still running; skip,
+	// delay or allow. Invocations may overlap if empty.
+	// It may not be combined with MaxConcurrent.
+	ConcurrencyPolicy string
+
+	// DeliveryDelay is the delay after publication before
+	// consumers should process the message. If non-zero,
+	// it is attached to messages as a not-before attribute
+	// holding the RFC3339 time of the earliest processing.
+	// Messages are still published immediately.
+	DeliveryDelay time.Duration
+
+	// DependsOn is the name of a job that this job depends
+	// on. If it is not empty, the job is not scheduled by
+	// its frequency, but is run each time the dependency
+	// successfully publishes, after DependencyDelay. This
+	// is best-effort chaining, not a workflow engine; a
+	// dependent run is not retried and is lost if the
+	// scheduler exits during the delay.
+	DependsOn       string
+	DependencyDelay time.Duration
+
+	// GateFile is the path to a file that must exist for
+	// the job to publish. Firings when the file does not
+	// exist are skipped. If ConsumeGateFile is true, the
+	// file is deleted after each successful publish.
+	GateFile        string
+	ConsumeGateFile bool
+
+	// AttemptDeadline is the deadline for each attempt
+	// to execute the job. If zero, HTTP and App Engine
+	// HTTP attempts have a three minute deadline and
+	// Pub/Sub attempts have no deadline.
+	AttemptDeadline time.Duration
+
+	// Seconds specifies that the job's frequency is a
+	// six field cron spec with a leading seconds field.
+	Seconds bool
+
+	// Paused specifies that the job is registered, but
+	// not run by its schedule until it is resumed.
+	Paused bool
+
+	// Enabled specifies whether the job is scheduled.
+	// Disabled jobs are kept in the config but are not
+	// run. Jobs are enabled if Enabled is not set.
+	Enabled *bool
+
+	// Labels are arbitrary key-value pairs used to
+	// select jobs with -only and -skip.
+	Labels map[string]string
+
+	// StartTime and EndTime bound the window in which
+	// the job runs. Runs outside the window are skipped.
+	// The window is unbounded on either side if zero.
+	StartTime time.Time
+	EndTime   time.Time
+
+	// Jitter is the maximum random delay added to
+	// each scheduled firing of the job. It should be
+	// less than the interval between firings.
+	// JitterDistribution is the distribution of the
+	// delays, "uniform", "normal" or "exponential".
+	// Delays are uniform if it is empty.
+	Jitter             time.Duration
+	JitterDistribution string
+
+	// RunAtStart specifies that the job is also run
+	// when the scheduler starts, without waiting for
+	// its first scheduled time.
+	RunAtStart bool
+
+	// CatchUpLimit is the maximum number of runs missed
+	// while the scheduler was not running that are run
+	// at start. Missed runs are determined from the
+	// state file. No runs are caught up if zero.
+	CatchUpLimit int
+
+	// MaxRuns is the maximum number of successful
+	// executions of the job. The job is disabled once
+	// it reaches the limit. Unlimited if zero.
+	MaxRuns int
+
+	// RetryConfig specifies how failed executions
+	// are retried. Failures are not retried if nil.
+	RetryConfig *retryConfig
+}
+
+// checkDependencies returns an error if any job depends on a job that
+// does not exist or if the job dependencies contain a cycle.
+func checkDependencies(jobs []job) error {
+	deps := make(map[string]string)
+	for _, j := range jobs {
+		deps[j.Name] = j.DependsOn
+	}
+	for _, j := range jobs {
+		seen := map[string]bool{j.Name: true}
+		path := []string{j.Name}
+		for name := j.DependsOn; name != ""; name = deps[name] {
+			if _, ok := deps[name]; !ok {
+				return fmt.Errorf("%q depends on unknown job %q", path[len(path)-1], name)
+			}
+			path = append(path, name)
+			if seen[name] {
+				return fmt.Errorf("dependency cycle: %s", strings.Join(path, " -> "))
+			}
+			seen[name] = true
+		}
+	}
+	return nil
+}
+
+// enabled returns whether the job is enabled.
+func (j job) enabled() bool {
+	return j.Enabled == nil || *j.Enabled
+}
+
+// location returns the job's location, or def if the job does not
+// specify a timezone.
+func (j job) location(def *time.Location) (*time.Location, error) {
+	if j.Timezone == "" {
+		return def, nil
+	}
+	return time.LoadLocation(j.Timezone)
+}
+
+// binaryPayload returns the job's decoded base64 or hex payload.
+func (j job) binaryPayload() ([]byte, error) {
+	if j.Proto != nil {
+		return nil, errors.New("proto cannot be used with a binary payload")
+	}
+	if j.PayloadHex != "" {
+		b, err := hex.DecodeString(j.PayloadHex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex payload: %w", err)
+		}
+		return b, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(j.PayloadBase64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 payload: %w", err)
+	}
+	return b, nil
+}
+
+// inWindow returns whether t is within the job's run window.
+func (j job) inWindow(t time.Time) bool {
+	return (j.StartTime.IsZero() || !t.Before(j.StartTime)) &&
+		(j.EndTime.IsZero() || t.Before(j.EndTime))
+}
+
+// schedule returns the job's cron schedule.
+func (j job) schedule() (cron.Schedule, error) {
+	if !j.At.IsZero() {
+		if j.Frequency != "" {
+			return nil, errors.New("at and frequency are mutually exclusive")
+		}
+		return schedule.Once{At: j.At}, nil
+	}
+	cronspec := j.Frequency
+	if j.Timezone != "" {
+		cronspec = fmt.Sprintf("CRON_TZ=%s %s", j.Timezone, j.Frequency)
+	}
+	return schedule.Parse(cronspec, j.Seconds)
+}
+
+type target struct {
+	Destination string // Pub/Sub, HTTP or App Engine HTTP.
+
+	// Topic is the topic for Pub/Sub targets.
+	Topic string
+
+	// Topics is a set of weighted topics. If it is not
+	// empty, each firing publishes to a single topic
+	// chosen at random with probability proportional to
+	// its weight, and Topic is ignored.
+	Topics []weightedTopic
+
+	// FlowControl bounds the messages buffered by the
+	// publisher for the target's topics. Library defaults
+	// are used if nil.
+	FlowControl *flowControl
+
+	// Schema is the Pub/Sub schema attached to the
+	// target's topics when they are created. No schema
+	// is attached if nil.
+	Schema *topicSchema
+
+	// URI, HTTPMethod, Headers, Query and Body
+	// configure the request for HTTP targets.
+	// App Engine HTTP targets use RelativeURI
+	// and AppEngineRouting in place of URI.
+	// Query parameters are added to the URI's
+	// query, and their values and Body may be
+	// templates rendered at each firing.
+	URI              string
+	RelativeURI      string // "/" if empty.
+	AppEngineRouting appEngineRouting
+	HTTPMethod       string // POST if empty.
+	Headers          map[string]string
+	Query            map[string]string
+	Body             string
+
+	// fanout holds the remaining targets when
+	// the target is given as a list. Each firing
+	// of the job executes all the targets.
+	fanout []target
+}
+
+// UnmarshalYAML unmarshals a target or a non-empty list of targets. When
+// a list is given, the first element is the target and the remainder
+// are held as its fan-out targets.
+func (t *target) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain target
+	var raw interface{}
+	err := unmarshal(&raw)
+	if err != nil {
+		return err
+	}
+	if _, ok := raw.([]interface{}); !ok {
+		return unmarshal((*plain)(t))
+	}
+	var list []plain
+	err = unmarshal(&list)
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		return errors.New("empty target list")
+	}
+	*t = target(list[0])
+	for _, f := range list[1:] {
+		t.fanout = append(t.fanout, target(f))
+	}
+	return nil
+}
+
+// targets returns the target and its fan-out targets.
+func (t target) targets() []target {
+	primary := t
+	primary.fanout = nil
+	return append([]target{primary}, t.fanout...)
+}
+
+// appEngineRouting is the App Engine routing for App Engine HTTP targets.
+type appEngineRouting struct {
+	Service  string // "default" if empty.
+	Version  string
+	Instance string
+}
+
+// appEngineHost is the address of a local dev server serving an App
+// Engine service. An empty Version matches any version of the service.
+type appEngineHost struct {
+	Service string // "default" if empty.
+	Version string
+	Host    string // host:port
+}
+
+// appEngineURI returns the URI of the dev server in hosts serving the
+// routing r at the relative URI rel.
+func appEngineURI(hosts []appEngineHost, r appEngineRouting, rel string) (string, error) {
+	svc := r.Service
+	if svc == "" {
+		svc = "default"
+	}
+	if rel == "" {
+		rel = "/"
+	}
+	if !strings.HasPrefix(rel, "/") {
+		return "", fmt.Errorf("relative uri must start with '/': %q", rel)
+	}
+	var host string
+	for _, h := range hosts {
+		hsvc := h.Service
+		if hsvc == "" {
+			hsvc = "default"
+		}
+		if hsvc != svc {
+			continue
+		}
+		if h.Version == r.Version {
+			host = h.Host
+			break
+		}
+		if h.Version == "" && host == "" {
+			host = h.Host
+		}
+	}
+	if host == "" {
+		if r.Version != "" {
+			return "", fmt.Errorf("no host for App Engine service %q version %q", svc, r.Version)
+		}
+		return "", fmt.Errorf("no host for App Engine service %q", svc)
+	}
+	return "http://" + host + rel, nil
+}
+
+// Target destinations.
+const (
+	unknownDestination = iota
+	pubsubDestination
+	httpDestination
+	appEngineDestination
+)
+
+// destination returns the kind of the target's destination.
+func (t target) destination() int {
+	switch strings.ToLower(t.Destination) {
+	case "pub/sub", "pubsub":
+		return pubsubDestination
+	case "http":
+		return httpDestination
+	case "app engine http", "appenginehttp", "appenginehttptarget":
+		return appEngineDestination
+	default:
+		return unknownDestination
+	}
+}
+
+// topicList returns a comma-separated list of the topics of the target
+// and its fan-out targets, or the empty string if none of them is a
+// Pub/Sub target.
+func (t target) topicList() string {
+	var ids []string
+	for _, t := range t.targets() {
+		if t.destination() == pubsubDestination {
+			ids = append(ids, t.topicIDs()...)
+		}
+	}
+	return strings.Join(ids, ",")
+}
+
+// addSuffix appends suffix to the topic IDs of the target and its
+// fan-out targets.
+func (t *target) addSuffix(suffix string) {
+	if t.destination() == pubsubDestination {
+		t.Topic += suffix
+		for k := range t.Topics {
+			t.Topics[k].Topic += suffix
+		}
+	}
+	for i := range t.fanout {
+		t.fanout[i].addSuffix(suffix)
+	}
+}
+
+// flowControl is the publisher flow control configuration for a topic.
+type flowControl struct {
+	MaxOutstandingMessages int // Library default if zero.
+	MaxOutstandingBytes    int // Library default if zero.
+
+	// LimitExceededBehavior is the behaviour of publishing
+	// when a limit is reached. It is one of "ignore" (the
+	// default) where limits are not enforced, "block" where
+	// publishing blocks until the outstanding messages fall
+	// below the limits, or "error" where the publish fails
+	// and the failure is logged.
+	LimitExceededBehavior string
+}
+
+// settings returns the pubsub flow control settings for f. If f is nil,
+// settings returns nil.
+func (f *flowControl) settings() (*pubsub.FlowControlSettings, error) {
+	if f == nil {
+		return nil, nil
+	}
+	fc := pubsub.DefaultPublishSettings.FlowControlSettings
+	if f.MaxOutstandingMessages > 0 {
+		fc.MaxOutstandingMessages = f.MaxOutstandingMessages
+	}
+	if f.MaxOutstandingBytes > 0 {
+		fc.MaxOutstandingBytes = f.MaxOutstandingBytes
+	}
+	switch strings.ToLower(f.LimitExceededBehavior) {
+	case "", "ignore":
+		fc.LimitExceededBehavior = pubsub.FlowControlIgnore
+	case "block":
+		fc.LimitExceededBehavior = pubsub.FlowControlBlock
+	case "error":
+		fc.LimitExceededBehavior = pubsub.FlowControlSignalError
+	default:
+		return nil, fmt.Errorf("unknown limit exceeded behavior: %q", f.LimitExceededBehavior)
+	}
+	return &fc, nil
+}
+
+// topicSchema is a Pub/Sub schema for a target's topics.
+type topicSchema struct {
+	Name string // Name is the schema ID.
+	Type string // Type is "avro" or "protocol buffer".
+
+	// Definition is the schema definition. If it
+	// is empty, the definition is read from the
+	// file at DefinitionFile.
+	Definition     string
+	DefinitionFile string
+
+	// Encoding is the encoding of published
+	// messages; "json" (the default) or "binary".
+	Encoding string
+}
+
+// config returns the pubsub schema configuration for s.
+func (s *topicSchema) config() (pubsub.SchemaConfig, error) {
+	cfg := pubsub.SchemaConfig{Definition: s.Definition}
+	if s.Name == "" {
+		return cfg, errors.New("missing schema name")
+	}
+	switch strings.ReplaceAll(strings.ToLower(s.Type), " ", "") {
+	case "avro":
+		cfg.Type = pubsub.SchemaAvro
+	case "protocolbuffer", "protobuf":
+		cfg.Type = pubsub.SchemaProtocolBuffer
+	default:
+		return cfg, fmt.Errorf("unknown schema type: %q", s.Type)
+	}
+	if cfg.Definition == "" {
+		if s.DefinitionFile == "" {
+			return cfg, errors.New("missing schema definition")
+		}
+		b, err := os.ReadFile(s.DefinitionFile)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Definition = string(b)
+	}
+	return cfg, nil
+}
+
+// encoding returns the pubsub message encoding for s.
+func (s *topicSchema) encoding() (pubsub.SchemaEncoding, error) {
+	switch strings.ToLower(s.Encoding) {
+	case "", "json":
+		return pubsub.EncodingJSON, nil
+	case "binary":
+		return pubsub.EncodingBinary, nil
+	default:
+		return 0, fmt.Errorf("unknown schema encoding: %q", s.Encoding)
+	}
+}
+
+type weightedTopic struct {
+	Topic  string
+	Weight float64
+}
+
+// topicIDs returns the IDs of all the target's topics.
+func (t target) topicIDs() []string {
+	if len(t.Topics) == 0 {
+		return []string{t.Topic}
+	}
+	ids := make([]string, len(t.Topics))
+	for i, w := range t.Topics {
+		ids[i] = w.Topic
+	}
+	return ids
+}
+
+// pick returns the topic ID to publish to for a single firing.
+func (t target) pick() string {
+	if len(t.Topics) == 0 {
+		return t.Topic
+	}
+	var total float64
+	for _, w := range t.Topics {
+		total += w.Weight
+	}
+	x := rnd.Float64() * total
+	for _, w := range t.Topics {
+		x -= w.Weight
+		if x < 0 {
+			return w.Topic
+		}
+	}
+	return t.Topics[len(t.Topics)-1].Topic
+}
+
+// validate returns an error if the target's weighted topics are invalid.
+func (t target) validate() error {
+	if len(t.Topics) == 0 {
+		return nil
+	}
+	var total float64
+	for _, w := range t.Topics {
+		if w.Weight < 0 {
+			return fmt.Errorf("negative weight for topic %q", w.Topic)
+		}
+		total += w.Weight
+	}
+	if total == 0 {
+		return errors.New("no positive topic weights")
+	}
+	return nil
+}
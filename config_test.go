@@ -0,0 +1,284 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var timezoneTests = []struct {
+	name      string
+	global    string // global is the config's timezone.
+	defaults  string // defaults is the config's default job timezone.
+	timezone  string // timezone is the job's timezone.
+	frequency string
+
+	wantLoc  string
+	wantNext time.Time
+	wantErr  bool // wantErr is whether the schedule is invalid.
+}{
+	{
+		name:      "local",
+		frequency: "0 9 * * *",
+		wantLoc:   "Local",
+		wantNext:  time.Date(2021, 6, 2, 9, 0, 0, 0, time.Local),
+	},
+	{
+		name:      "global",
+		global:    "America/New_York",
+		frequency: "0 9 * * *",
+		wantLoc:   "America/New_York",
+		wantNext:  time.Date(2021, 6, 2, 9, 0, 0, 0, mustLoadLocation("America/New_York")),
+	},
+	{
+		name:      "cron_tz_over_global",
+		global:    "America/New_York",
+		frequency: "CRON_TZ=Asia/Tokyo 0 9 * * *",
+		wantLoc:   "America/New_York",
+		wantNext:  time.Date(2021, 6, 3, 9, 0, 0, 0, mustLoadLocation("Asia/Tokyo")),
+	},
+	{
+		name:      "job_over_global",
+		global:    "America/New_York",
+		timezone:  "Europe/London",
+		frequency: "0 9 * * *",
+		wantLoc:   "Europe/London",
+		wantNext:  time.Date(2021, 6, 2, 9, 0, 0, 0, mustLoadLocation("Europe/London")),
+	},
+	{
+		name:      "defaults_over_global",
+		global:    "America/New_York",
+		defaults:  "Europe/Paris",
+		frequency: "0 9 * * *",
+		wantLoc:   "Europe/Paris",
+		wantNext:  time.Date(2021, 6, 2, 9, 0, 0, 0, mustLoadLocation("Europe/Paris")),
+	},
+	{
+		name:      "job_over_defaults",
+		global:    "America/New_York",
+		defaults:  "Europe/Paris",
+		timezone:  "Australia/Sydney",
+		frequency: "0 9 * * *",
+		wantLoc:   "Australia/Sydney",
+		wantNext:  time.Date(2021, 6, 3, 9, 0, 0, 0, mustLoadLocation("Australia/Sydney")),
+	},
+	{
+		name:      "job_and_cron_tz",
+		global:    "America/New_York",
+		timezone:  "Europe/London",
+		frequency: "CRON_TZ=Asia/Tokyo 0 9 * * *",
+		wantLoc:   "Europe/London",
+		wantErr:   true,
+	},
+}
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
+func TestTimezonePrecedence(t *testing.T) {
+	// now is 2021-06-02T00:00:00Z, after 09:00 on
+	// 2021-06-02 in Sydney, at it in Tokyo and before
+	// it elsewhere.
+	now := time.Date(2021, 6, 2, 0, 0, 0, 0, time.UTC)
+	for _, test := range timezoneTests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := config{
+				Timezone: test.global,
+				Defaults: jobDefaults{Timezone: test.defaults},
+				Jobs:     []job{{Name: "job", Frequency: test.frequency, Timezone: test.timezone}},
+			}
+			cfg.Defaults.apply(&cfg.Jobs[0])
+			j := cfg.Jobs[0]
+
+			loc, err := cfg.location()
+			if err != nil {
+				t.Fatalf("unexpected error getting config location: %v", err)
+			}
+			jloc, err := j.location(loc)
+			if err != nil {
+				t.Fatalf("unexpected error getting job location: %v", err)
+			}
+			if jloc.String() != test.wantLoc {
+				t.Errorf("unexpected job location: got:%s want:%s", jloc, test.wantLoc)
+			}
+
+			sched, err := j.schedule()
+			if test.wantErr {
+				if err == nil {
+					t.Error("expected error for timezone with CRON_TZ frequency")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error parsing schedule: %v", err)
+			}
+			// The scheduler runs in the config's location.
+			got := sched.Next(now.In(loc))
+			if !got.Equal(test.wantNext) {
+				t.Errorf("unexpected next activation: got:%v want:%v", got, test.wantNext)
+			}
+		})
+	}
+}
+
+var loadConfigTests = []struct {
+	name    string
+	files   map[string]string
+	want    []string // want holds the names and timezones of the loaded jobs.
+	wantErr string
+}{
+	{
+		name: "include",
+		files: map[string]string{
+			"main.yaml": `project: test
+timezone: America/New_York
+include: [inc/*.yaml]
+defaults:
+  timezone: Europe/Paris
+  destination: pubsub
+jobs:
+  - name: main
+    frequency: "@every 1m"
+    target:
+      topic: main
+`,
+			"inc/a.yaml": `project: test
+jobs:
+  - name: a
+    frequency: "@every 1m"
+    timezone: Asia/Tokyo
+    target:
+      topic: a
+`,
+			"inc/b.yaml": `jobs:
+  - name: b
+    frequency: "@every 1m"
+    target:
+      topic: b
+`,
+		},
+		want: []string{"main:Europe/Paris", "a:Asia/Tokyo", "b:Europe/Paris"},
+	},
+	{
+		name: "conflicting_project",
+		files: map[string]string{
+			"main.yaml": `project: test
+include: [inc.yaml]
+`,
+			"inc.yaml": `project: other
+`,
+		},
+		wantErr: `inc.yaml: conflicting project "other" (previously "test")`,
+	},
+	{
+		name: "conflicting_attribute",
+		files: map[string]string{
+			"main.yaml": `attributes: {env: prod}
+include: [inc.yaml]
+`,
+			"inc.yaml": `attributes: {env: dev}
+`,
+		},
+		wantErr: `inc.yaml: conflicting attribute "env" value "dev" (previously "prod")`,
+	},
+	{
+		name: "duplicate_job",
+		files: map[string]string{
+			"main.yaml": `include: [inc.yaml]
+jobs:
+  - name: job
+    frequency: "@every 1m"
+`,
+			"inc.yaml": `jobs:
+  - name: job
+    frequency: "@every 1m"
+`,
+		},
+		wantErr: `inc.yaml: duplicate job name "job" (first defined in `,
+	},
+	{
+		name: "include_cycle",
+		files: map[string]string{
+			"main.yaml": `include: [inc.yaml]
+`,
+			"inc.yaml": `include: [main.yaml]
+`,
+		},
+		wantErr: "main.yaml: include cycle",
+	},
+	{
+		name: "no_match",
+		files: map[string]string{
+			"main.yaml": `include: [missing/*.yaml]
+`,
+		},
+		wantErr: `main.yaml: no files match include`,
+	},
+	{
+		name: "invalid_timezone",
+		files: map[string]string{
+			"main.yaml": `jobs:
+  - name: job
+    frequency: "@every 1m"
+    timezone: Nowhere/Special
+`,
+		},
+		wantErr: "main.yaml: job: invalid timezone",
+	},
+}
+
+func TestLoadConfigIncludes(t *testing.T) {
+	for _, test := range loadConfigTests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, text := range test.files {
+				path := filepath.Join(dir, name)
+				err := os.MkdirAll(filepath.Dir(path), 0o755)
+				if err != nil {
+					t.Fatalf("unexpected error creating directory: %v", err)
+				}
+				err = os.WriteFile(path, []byte(text), 0o644)
+				if err != nil {
+					t.Fatalf("unexpected error writing config: %v", err)
+				}
+			}
+			cfg, err := loadConfig(filepath.Join(dir, "main.yaml"), "")
+			if test.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error containing %q", test.wantErr)
+				}
+				if !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("unexpected error: got:%v want:%s", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			for _, j := range cfg.Jobs {
+				got = append(got, j.Name+":"+j.Timezone)
+				if j.Target.Destination != "pubsub" {
+					t.Errorf("default destination not applied to %s: got:%q", j.Name, j.Target.Destination)
+				}
+			}
+			if strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("unexpected jobs: got:%v want:%v", got, test.want)
+			}
+			if cfg.Timezone != "America/New_York" {
+				t.Errorf("unexpected timezone: got:%q want:%q", cfg.Timezone, "America/New_York")
+			}
+		})
+	}
+}
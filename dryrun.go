@@ -0,0 +1,194 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// timelineEntry is a single execution in a dry-run timeline.
+type timelineEntry struct {
+	time time.Time
+	job  job
+}
+
+// writeTimeline writes the executions of the jobs in cfg within horizon
+// of now to w in time order, without connecting to any service. Each
+// job is expanded to at most max scheduled activations.
+func writeTimeline(w io.Writer, cfg config, now time.Time, horizon time.Duration, max int) error {
+	loc, err := cfg.location()
+	if err != nil {
+		return err
+	}
+	now = now.In(loc)
+	until := now.Add(horizon)
+
+	jobs := make(map[string]job)
+	for _, j := range cfg.Jobs {
+		if j.Target.destination() == unknownDestination || j.Paused {
+			continue
+		}
+		jobs[j.Name] = j
+	}
+
+	// runs returns the times the named job runs,
+	// following dependencies to their scheduled job.
+	memo := make(map[string][]time.Time)
+	var runs func(name string) ([]time.Time, error)
+	runs = func(name string) ([]time.Time, error) {
+		if t, ok := memo[name]; ok {
+			return t, nil
+		}
+		j, ok := jobs[name]
+		if !ok {
+			return nil, nil
+		}
+		var times []time.Time
+		if j.DependsOn != "" {
+			dep, err := runs(j.DependsOn)
+			if err != nil {
+				return nil, err
+			}
+			for _, t := range dep {
+				times = append(times, t.Add(j.DependencyDelay))
+			}
+		} else {
+			sched, err := j.schedule()
+			if err != nil {
+				return nil, fmt.Errorf("error in cronspec for %q: %w", j.Name, err)
+			}
+			if j.RunAtStart {
+				times = append(times, now)
+			}
+			times = append(times, nextRuns(sched, now, until, max)...)
+		}
+		var kept []time.Time
+		for _, t := range times {
+			if !j.inWindow(t) || t.After(until) {
+				continue
+			}
+			if j.MaxRuns > 0 && len(kept) == j.MaxRuns {
+				break
+			}
+			kept = append(kept, t)
+		}
+		memo[name] = kept
+		return kept, nil
+	}
+
+	var timeline []timelineEntry
+	for _, j := range cfg.Jobs {
+		times, err := runs(j.Name)
+		if err != nil {
+			return err
+		}
+		jloc, err := j.location(loc)
+		if err != nil {
+			return fmt.Errorf("invalid timezone for %q: %w", j.Name, err)
+		}
+		for _, t := range times {
+			timeline = append(timeline, timelineEntry{time: t.In(jloc), job: j})
+		}
+	}
+	sort.SliceStable(timeline, func(i, j int) bool { return timeline[i].time.Before(timeline[j].time) })
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tJOB\tDESTINATION\tPAYLOAD")
+	count := make(map[string]int64)
+	for _, e := range timeline {
+		count[e.job.Name]++
+		data := templateData{JobName: e.job.Name, Now: e.time, ScheduledTime: e.time, RunCount: count[e.job.Name]}
+		for _, t := range e.job.Target.targets() {
+			j := e.job
+			j.Target = t
+			dst, payload, err := describe(j, data, cfg.AppEngine)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%q\n", e.time.Format(time.RFC3339), e.job.Name, dst, payload)
+		}
+	}
+	return tw.Flush()
+}
+
+// describe returns the destination and payload of an execution of j
+// with the given template data. App Engine URIs are resolved using hosts.
+func describe(j job, data templateData, hosts []appEngineHost) (dst, payload string, err error) {
+	switch j.Target.destination() {
+	case httpDestination, appEngineDestination:
+		method, err := httpMethod(j.Target.HTTPMethod)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid target for %q: %w", j.Name, err)
+		}
+		uri := j.Target.URI
+		if j.Target.destination() == appEngineDestination {
+			uri, err = appEngineURI(hosts, j.Target.AppEngineRouting, j.Target.RelativeURI)
+			if err != nil {
+				return "", "", fmt.Errorf("invalid target for %q: %w", j.Name, err)
+			}
+		}
+		query := make(map[string]string, len(j.Target.Query))
+		for k, v := range j.Target.Query {
+			query[k], err = renderString(k, v, data)
+			if err != nil {
+				return "", "", fmt.Errorf("invalid query parameter %q for %q: %w", k, j.Name, err)
+			}
+		}
+		uri, err = withQuery(uri, query)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid target for %q: %w", j.Name, err)
+		}
+		body, err := renderString("body", j.Target.Body, data)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid body for %q: %w", j.Name, err)
+		}
+		return method + " " + uri, body, nil
+	}
+	id, err := renderString("topic", j.Target.pick(), data)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid topic for %q: %w", j.Name, err)
+	}
+	switch {
+	case j.PayloadFile != "":
+		b, err := os.ReadFile(j.PayloadFile)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid payload for %q: %w", j.Name, err)
+		}
+		return "topic " + id, string(b), nil
+	case len(j.PayloadExec) != 0:
+		// Commands are not run in a dry run.
+		return "topic " + id, "$(" + strings.Join(j.PayloadExec, " ") + ")", nil
+	case j.PayloadBase64 != "", j.PayloadHex != "":
+		b, err := j.binaryPayload()
+		if err != nil {
+			return "", "", fmt.Errorf("invalid payload for %q: %w", j.Name, err)
+		}
+		return "topic " + id, string(b), nil
+	}
+	payload, err = renderString("payload", j.Payload, data)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid payload for %q: %w", j.Name, err)
+	}
+	return "topic " + id, payload, nil
+}
+
+// renderString returns s rendered as a template with data if it is a
+// template, and s otherwise.
+func renderString(name, s string, data templateData) (string, error) {
+	if !isTemplate(s) {
+		return s, nil
+	}
+	tmpl, err := parseTemplate(name, s)
+	if err != nil {
+		return "", err
+	}
+	return render(tmpl, data)
+}
@@ -0,0 +1,52 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/kortschak/scheduler/schedule"
+)
+
+// logDSTEffects logs the daylight saving time transitions between now
+// and end that change the fire times of jobs. Jobs without a timezone are
+// scheduled in loc.
+func logDSTEffects(jobs []job, loc *time.Location, now, end time.Time) {
+	for _, j := range jobs {
+		if j.DependsOn != "" || !j.At.IsZero() {
+			continue
+		}
+		jloc, err := j.location(loc)
+		if err != nil {
+			continue
+		}
+		sched, err := j.schedule()
+		if err != nil {
+			continue
+		}
+		for _, e := range schedule.DSTEffects(sched, now.In(jloc), end) {
+			slog.Warn("daylight saving transition affects job", "job", j.Name, "effect", describeDST(e, jloc))
+		}
+	}
+}
+
+// describeDST returns a description of the effect of a daylight saving
+// time transition on a job scheduled in loc.
+func describeDST(e schedule.DSTEffect, loc *time.Location) string {
+	at := e.Transition.In(loc).Format("2006-01-02 15:04:05 MST")
+	first := e.First.Format("15:04:05")
+	if e.Skipped {
+		if e.Count == 1 {
+			return fmt.Sprintf("clocks go forward at %s: %s is skipped and fires at the transition", at, first)
+		}
+		return fmt.Sprintf("clocks go forward at %s: %d fire times from %s are skipped and fire once at the transition", at, e.Count, first)
+	}
+	if e.Count == 1 {
+		return fmt.Sprintf("clocks go back at %s: repeated %s does not fire again", at, first)
+	}
+	return fmt.Sprintf("clocks go back at %s: %d repeated fire times from %s do not fire again", at, e.Count, first)
+}
@@ -0,0 +1,137 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/kortschak/scheduler/listen"
+	"google.golang.org/api/option"
+)
+
+// e2e subscribes to the scheduler's topics in-process and logs the
+// round trip of each published message.
+type e2e struct {
+	mu       sync.Mutex
+	pending  map[string]time.Time // pending holds the publish times of unreceived messages.
+	early    map[string]bool      // early holds messages received before their publish was noted.
+	received int
+	changed  chan struct{} // changed is closed and replaced when pending changes.
+
+	cancel  context.CancelFunc
+	done    sync.WaitGroup
+	clients []*pubsub.Client
+}
+
+// newE2E returns a new e2e. Its published method must be called with
+// the ID of each message published by the scheduler.
+func newE2E() *e2e {
+	return &e2e{
+		pending: make(map[string]time.Time),
+		early:   make(map[string]bool),
+		changed: make(chan struct{}),
+	}
+}
+
+// published notes the publication of the message with the given ID.
+func (e *e2e) published(id string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.early[id] {
+		delete(e.early, id)
+		return
+	}
+	e.pending[id] = time.Now()
+}
+
+// start subscribes to the given topics, keyed by project, and returns
+// once all the subscriptions are receiving. Subscriptions are named for
+// their topic with an "-e2e" suffix.
+func (e *e2e) start(topics map[string][]string, opts []option.ClientOption) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+	for project, ids := range topics {
+		client, err := pubsub.NewClient(ctx, project, opts...)
+		if err != nil {
+			return err
+		}
+		e.clients = append(e.clients, client)
+		subs := make([]listen.Subscription, len(ids))
+		for i, id := range ids {
+			subs[i] = listen.Subscription{ID: id + "-e2e", Topic: id}
+		}
+		ready := make(chan struct{})
+		errc := make(chan error, 1)
+		l := listen.New(client, listen.Subscribe(subs...), listen.OnReady(func() { close(ready) }))
+		e.done.Add(1)
+		go func() {
+			defer e.done.Done()
+			err := l.Receive(ctx, e.receive)
+			if err != nil {
+				errc <- err
+			}
+		}()
+		select {
+		case <-ready:
+		case err := <-errc:
+			return err
+		}
+	}
+	return nil
+}
+
+// receive logs the round trip of a received message.
+func (e *e2e) receive(_ context.Context, m listen.Message) {
+	now := time.Now()
+	e.mu.Lock()
+	sent, ok := e.pending[m.ID]
+	if ok {
+		delete(e.pending, m.ID)
+	} else {
+		e.early[m.ID] = true
+		sent = m.PublishTime
+	}
+	e.received++
+	close(e.changed)
+	e.changed = make(chan struct{})
+	e.mu.Unlock()
+	slog.Info("round trip", "job", m.Attributes["scheduler.job_name"], "subscription", m.Subscription,
+		"id", m.ID, "execution_id", m.Attributes["scheduler.execution_id"], "latency", now.Sub(sent))
+}
+
+// stop waits up to drain for pending messages to be received and then
+// stops the subscriptions. It returns the number of messages received
+// and the number that were published but not received.
+func (e *e2e) stop(drain time.Duration) (received, lost int) {
+	deadline := time.After(drain)
+wait:
+	for {
+		e.mu.Lock()
+		n, changed := len(e.pending), e.changed
+		e.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			break wait
+		}
+	}
+	if e.cancel != nil {
+		e.cancel()
+	}
+	e.done.Wait()
+	for _, c := range e.clients {
+		c.Close()
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.received, len(e.pending)
+}
@@ -0,0 +1,85 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// emulator is a gcloud Pub/Sub emulator run as a child process.
+type emulator struct {
+	addr   string
+	cmd    *exec.Cmd
+	exited chan error
+}
+
+// startEmulator starts the gcloud Pub/Sub emulator for project on a free
+// local port and directs the Pub/Sub clients to it by setting
+// PUBSUB_EMULATOR_HOST. It waits up to timeout for the emulator to
+// accept connections.
+func startEmulator(project string, timeout time.Duration) (*emulator, error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return nil, err
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	cmd := exec.Command("gcloud", "beta", "emulators", "pubsub", "start",
+		"--project="+project, "--host-port="+addr)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	// The emulator runs in a child of gcloud, so
+	// the whole process group must be stopped.
+	setProcessGroup(cmd)
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	e := &emulator{addr: addr, cmd: cmd, exited: make(chan error, 1)}
+	go func() { e.exited <- cmd.Wait() }()
+
+	deadline := time.After(timeout)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		select {
+		case err := <-e.exited:
+			return nil, fmt.Errorf("emulator exited: %v", err)
+		case <-deadline:
+			e.stop()
+			return nil, fmt.Errorf("timed out after %v waiting for emulator", timeout)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	err = os.Setenv("PUBSUB_EMULATOR_HOST", addr)
+	if err != nil {
+		e.stop()
+		return nil, err
+	}
+	return e, nil
+}
+
+// stop stops the emulator and waits for it to exit.
+func (e *emulator) stop() {
+	err := killProcessGroup(e.cmd)
+	if err != nil {
+		slog.Error("failed to stop emulator", "err", err)
+		return
+	}
+	select {
+	case <-e.exited:
+	case <-time.After(10 * time.Second):
+		slog.Warn("timed out waiting for emulator to exit")
+	}
+}
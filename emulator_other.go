@@ -0,0 +1,19 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "os/exec"
+
+// setProcessGroup is a no-op on this platform.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the process of cmd. Its children are not
+// killed on this platform.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
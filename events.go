@@ -0,0 +1,60 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// registeredEvent describes a job registered with the scheduler.
+type registeredEvent struct {
+	Name      string
+	Spec      string
+	At        time.Time // Zero unless one-shot.
+	Timezone  string
+	Topic     string
+	URI       string
+	DependsOn string
+	Paused    bool
+	Next      time.Time // Zero if paused or run by a dependency.
+}
+
+// attrs returns the attributes of the event for logging. Empty fields
+// are omitted.
+func (e registeredEvent) attrs() []any {
+	attrs := []any{"name", e.Name}
+	if e.Spec != "" {
+		attrs = append(attrs, "spec", e.Spec)
+	}
+	if !e.At.IsZero() {
+		attrs = append(attrs, "at", e.At)
+	}
+	attrs = append(attrs, "timezone", e.Timezone)
+	if e.Topic != "" {
+		attrs = append(attrs, "topic", e.Topic)
+	}
+	if e.URI != "" {
+		attrs = append(attrs, "uri", e.URI)
+	}
+	if e.DependsOn != "" {
+		attrs = append(attrs, "dependson", e.DependsOn)
+	}
+	if e.Paused {
+		attrs = append(attrs, "paused", true)
+	}
+	if !e.Next.IsZero() {
+		attrs = append(attrs, "next", e.Next)
+	}
+	return attrs
+}
+
+// logRegistered logs a "job registered" record for each of the events
+// with the default logger.
+func logRegistered(events []registeredEvent) {
+	for _, e := range events {
+		slog.Info("job registered", e.attrs()...)
+	}
+}
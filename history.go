@@ -0,0 +1,235 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kortschak/scheduler/internal/cli"
+	"go.etcd.io/bbolt"
+)
+
+// execution is the record of a job execution held in the history.
+type execution struct {
+	Job           string        `json:"job"`
+	ExecutionID   string        `json:"execution_id"`
+	ScheduledTime time.Time     `json:"scheduled_time"`
+	Time          time.Time     `json:"time"` // Time is the start of the first attempt.
+	Attempts      int           `json:"attempts"`
+	Destination   string        `json:"destination,omitempty"`
+	MessageIDs    []string      `json:"message_ids,omitempty"`
+	HTTPStatuses  []int         `json:"http_statuses,omitempty"`
+	Outcome       string        `json:"outcome"` // "success" or "failure".
+	Error         string        `json:"error,omitempty"`
+	Latency       time.Duration `json:"latency"` // Latency is the duration of the last attempt.
+}
+
+// executionResult collects the message IDs and HTTP statuses of the
+// targets executed during an execution.
+type executionResult struct {
+	mu         sync.Mutex
+	messageIDs []string
+	statuses   []int
+}
+
+// resultKey is the context key for the *executionResult of an execution.
+type resultKey struct{}
+
+// withResult returns a context carrying res.
+func withResult(ctx context.Context, res *executionResult) context.Context {
+	return context.WithValue(ctx, resultKey{}, res)
+}
+
+// noteMessageID records a published message ID in the execution result
+// held by ctx, if any.
+func noteMessageID(ctx context.Context, id string) {
+	res, ok := ctx.Value(resultKey{}).(*executionResult)
+	if !ok {
+		return
+	}
+	res.mu.Lock()
+	res.messageIDs = append(res.messageIDs, id)
+	res.mu.Unlock()
+}
+
+// noteHTTPStatus records an HTTP response status code in the execution
+// result held by ctx, if any.
+func noteHTTPStatus(ctx context.Context, code int) {
+	res, ok := ctx.Value(resultKey{}).(*executionResult)
+	if !ok {
+		return
+	}
+	res.mu.Lock()
+	res.statuses = append(res.statuses, code)
+	res.mu.Unlock()
+}
+
+// historyStore is a bbolt database of job executions. Executions are
+// held in a bucket for each job, keyed by sequence number.
+type historyStore struct {
+	db *bbolt.DB
+}
+
+// openHistory opens the history database at path, creating it if it
+// does not exist unless readOnly is true.
+func openHistory(path string, readOnly bool) (*historyStore, error) {
+	db, err := bbolt.Open(path, 0o644, &bbolt.Options{Timeout: time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &historyStore{db: db}, nil
+}
+
+// record adds e to the history.
+func (h *historyStore) record(e execution) error {
+	val, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return h.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(e.Job))
+		if err != nil {
+			return err
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		var key [8]byte
+		binary.BigEndian.PutUint64(key[:], seq)
+		return b.Put(key[:], val)
+	})
+}
+
+// executions returns the most recent limit executions of the named job
+// in the order they were recorded. All executions are returned if limit
+// is not positive.
+func (h *historyStore) executions(job string, limit int) ([]execution, error) {
+	var execs []execution
+	err := h.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(job))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil && (limit <= 0 || len(execs) < limit); k, v = c.Prev() {
+			var e execution
+			err := json.Unmarshal(v, &e)
+			if err != nil {
+				return err
+			}
+			execs = append(execs, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(execs)-1; i < j; i, j = i+1, j-1 {
+		execs[i], execs[j] = execs[j], execs[i]
+	}
+	return execs, nil
+}
+
+// all returns the executions of all jobs in chronological order.
+func (h *historyStore) all() ([]execution, error) {
+	var execs []execution
+	err := h.db.View(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(_ []byte, b *bbolt.Bucket) error {
+			return b.ForEach(func(_, v []byte) error {
+				var e execution
+				err := json.Unmarshal(v, &e)
+				if err != nil {
+					return err
+				}
+				execs = append(execs, e)
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortExecutions(execs)
+	return execs, nil
+}
+
+// close closes the history database.
+func (h *historyStore) close() error {
+	return h.db.Close()
+}
+
+// history runs the history subcommand.
+func history(args []string) {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	admin := flags.String("admin", "", "specify address of the scheduler admin API")
+	control := flags.String("control", "", "specify path of the scheduler control socket")
+	path := flags.String("history", "", "specify history database of a scheduler that is not running")
+	limit := flags.Int("n", 0, "specify number of most recent executions to print (all if zero)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s history [-admin addr | -control path | -history path] [-n limit] jobname\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	n := 0
+	for _, s := range []string{*admin, *control, *path} {
+		if s != "" {
+			n++
+		}
+	}
+	if n != 1 || flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	name := flags.Arg(0)
+
+	var execs []execution
+	if *path != "" {
+		h, err := openHistory(*path, true)
+		if err != nil {
+			cli.Fatal("failed to read history", "err", err)
+		}
+		execs, err = h.executions(name, *limit)
+		h.close()
+		if err != nil {
+			cli.Fatal("failed to read history", "job", name, "err", err)
+		}
+	} else {
+		client, base := adminClient(*admin, *control)
+		u := base + "/jobs/" + url.PathEscape(name) + "/history"
+		if *limit > 0 {
+			u += "?limit=" + strconv.Itoa(*limit)
+		}
+		resp, err := client.Get(u)
+		if err != nil {
+			cli.Fatal("failed to get history", "job", name, "err", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			cli.Fatal("failed to get history", "job", name, "err", adminError(resp))
+		}
+		err = json.NewDecoder(resp.Body).Decode(&execs)
+		if err != nil {
+			cli.Fatal("failed to read response", "err", err)
+		}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, e := range execs {
+		err := enc.Encode(e)
+		if err != nil {
+			cli.Fatal("failed to write history", "err", err)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// httpTarget is an executor that sends a job's HTTP request to its
+// target URI.
+type httpTarget struct {
+	job
+	uri       string
+	method    string
+	userAgent string
+
+	// routing holds the App Engine routing
+	// headers for App Engine HTTP targets.
+	routing map[string]string
+
+	// body is the request body template,
+	// or nil if the body is static.
+	body *template.Template
+
+	// query holds the query parameter
+	// templates, keyed by parameter name.
+	query map[string]*template.Template
+
+	*jobEnv
+}
+
+// newHTTPTarget returns an httpTarget for j, sending requests with env.
+func newHTTPTarget(j job, env *jobEnv) (*httpTarget, error) {
+	if j.Target.URI == "" {
+		return nil, errors.New("missing uri")
+	}
+	u, err := url.Parse(j.Target.URI)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid uri scheme: %q", u.Scheme)
+	}
+	method, err := httpMethod(j.Target.HTTPMethod)
+	if err != nil {
+		return nil, err
+	}
+	body, err := bodyTemplate(j.Target.Body)
+	if err != nil {
+		return nil, err
+	}
+	query, err := queryTemplates(j.Target.Query)
+	if err != nil {
+		return nil, err
+	}
+	return &httpTarget{
+		job:       j,
+		uri:       j.Target.URI,
+		method:    method,
+		userAgent: "Google-Cloud-Scheduler",
+		body:      body,
+		query:     query,
+		jobEnv:    env,
+	}, nil
+}
+
+// newAppEngineTarget returns an httpTarget for the App Engine HTTP
+// target of j, sending requests to the dev server in env serving the
+// target's routing.
+func newAppEngineTarget(j job, env *jobEnv) (*httpTarget, error) {
+	r := j.Target.AppEngineRouting
+	uri, err := appEngineURI(env.appEngine, r, j.Target.RelativeURI)
+	if err != nil {
+		return nil, err
+	}
+	method, err := httpMethod(j.Target.HTTPMethod)
+	if err != nil {
+		return nil, err
+	}
+	routing := map[string]string{"X-AppEngine-Service": r.Service}
+	if routing["X-AppEngine-Service"] == "" {
+		routing["X-AppEngine-Service"] = "default"
+	}
+	if r.Version != "" {
+		routing["X-AppEngine-Version"] = r.Version
+	}
+	if r.Instance != "" {
+		routing["X-AppEngine-Instance"] = r.Instance
+	}
+	body, err := bodyTemplate(j.Target.Body)
+	if err != nil {
+		return nil, err
+	}
+	query, err := queryTemplates(j.Target.Query)
+	if err != nil {
+		return nil, err
+	}
+	return &httpTarget{
+		job:       j,
+		uri:       uri,
+		method:    method,
+		userAgent: "AppEngine-Google; (+http://code.google.com/appengine)",
+		routing:   routing,
+		body:      body,
+		query:     query,
+		jobEnv:    env,
+	}, nil
+}
+
+// httpMethod returns the canonical form of the HTTP method m, POST if m
+// is empty.
+func httpMethod(m string) (string, error) {
+	method := strings.ToUpper(m)
+	switch method {
+	case "":
+		return http.MethodPost, nil
+	case http.MethodPost, http.MethodGet, http.MethodHead, http.MethodPut,
+		http.MethodDelete, http.MethodPatch, http.MethodOptions:
+		return method, nil
+	default:
+		return "", fmt.Errorf("invalid http method: %q", m)
+	}
+}
+
+// bodyTemplate returns the parsed template for an HTTP request body, or
+// nil if the body is static.
+func bodyTemplate(body string) (*template.Template, error) {
+	if !isTemplate(body) {
+		return nil, nil
+	}
+	tmpl, err := parseTemplate("body", body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid body template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// queryTemplates returns the parsed templates for the values of the
+// query parameters in query, or nil if there are none.
+func queryTemplates(query map[string]string) (map[string]*template.Template, error) {
+	if len(query) == 0 {
+		return nil, nil
+	}
+	tmpls := make(map[string]*template.Template, len(query))
+	for k, v := range query {
+		tmpl, err := parseTemplate(k, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid query parameter template for %q: %w", k, err)
+		}
+		tmpls[k] = tmpl
+	}
+	return tmpls, nil
+}
+
+// withQuery returns uri with the query parameters in query set.
+func withQuery(uri string, query map[string]string) (string, error) {
+	if len(query) == 0 {
+		return uri, nil
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	for k, v := range query {
+		q.Set(k, v)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// execute sends the job's HTTP request. Responses with a status outside
+// the 2xx range are reported as errors.
+func (t *httpTarget) execute(ctx context.Context, f firing) (string, error) {
+	var body io.Reader
+	switch {
+	case t.body != nil:
+		b, err := render(t.body, f.templateData(t.Name))
+		if err != nil {
+			return t.uri, fmt.Errorf("failed to render body: %w", err)
+		}
+		body = strings.NewReader(b)
+	case t.Target.Body != "":
+		body = strings.NewReader(t.Target.Body)
+	}
+	uri := t.uri
+	if t.query != nil {
+		data := f.templateData(t.Name)
+		query := make(map[string]string, len(t.query))
+		for k, tmpl := range t.query {
+			v, err := render(tmpl, data)
+			if err != nil {
+				return t.uri, fmt.Errorf("failed to render query parameter %q: %w", k, err)
+			}
+			query[k] = v
+		}
+		var err error
+		uri, err = withQuery(uri, query)
+		if err != nil {
+			return t.uri, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, t.method, uri, body)
+	if err != nil {
+		return uri, err
+	}
+	// Headers set by Cloud Scheduler.
+	req.Header.Set("User-Agent", t.userAgent)
+	for k, v := range t.routing {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("X-CloudScheduler", "true")
+	req.Header.Set("X-CloudScheduler-JobName", t.Name)
+	req.Header.Set("X-CloudScheduler-ScheduleTime", f.scheduled.UTC().Format(time.RFC3339))
+	for k, v := range t.Target.Headers {
+		req.Header.Set(k, v)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return t.uri, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	noteHTTPStatus(ctx, resp.StatusCode)
+	if resp.StatusCode < 200 || 300 <= resp.StatusCode {
+		return t.uri, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	slog.Info("requested", "job", t.Name, "status", resp.Status)
+	return t.uri, nil
+}
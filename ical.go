@@ -0,0 +1,303 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kortschak/scheduler/internal/cli"
+)
+
+// ical runs the ical subcommand.
+func ical(args []string) {
+	flags := flag.NewFlagSet("ical", flag.ExitOnError)
+	conf := flags.String("conf", "", "specify config file, directory, glob pattern, URL or - for stdin (required unless -conf-dir is set)")
+	confDir := flags.String("conf-dir", "", "specify directory of configs to merge")
+	format := flags.String("format", "", "specify config format (yaml, json or toml; determined from file extensions if empty)")
+	var only, skip selectors
+	flags.Var(&only, "only", "include only jobs matching a key=pattern selector, where key is name or a label key (may be repeated)")
+	flags.Var(&skip, "skip", "exclude jobs matching a key=pattern selector, where key is name or a label key (may be repeated)")
+	horizon := flags.String("horizon", "7d", "specify duration to expand schedules over (accepts d for days)")
+	max := flags.Int("max", 1000, "specify maximum number of events per job")
+	flags.Parse(args)
+	if (*conf == "") == (*confDir == "") {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := load(*conf, *confDir, *format)
+	if err != nil {
+		cli.Fatal("failed to load schedule config", "err", err)
+	}
+	cfg.Jobs = selectJobs(cfg.Jobs, only, skip)
+	d, err := parseHorizon(*horizon)
+	if err != nil {
+		cli.Fatal("invalid horizon", "err", err)
+	}
+	err = writeICal(os.Stdout, cfg, time.Now(), d, *max)
+	if err != nil {
+		cli.Fatal("failed to write calendar", "err", err)
+	}
+}
+
+// parseHorizon parses a duration, additionally accepting a whole number
+// of days with a d suffix.
+func parseHorizon(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// writeICal writes an iCalendar with a VEVENT for each activation of the
+// jobs in cfg within horizon of now to w. A VTIMEZONE is written for each
+// time zone referred to by the events.
+func writeICal(w io.Writer, cfg config, now time.Time, horizon time.Duration, max int) error {
+	loc, err := cfg.location()
+	if err != nil {
+		return err
+	}
+	now = now.In(loc)
+	end := now.Add(horizon)
+	stamp := now.UTC().Format("20060102T150405Z")
+
+	type event struct {
+		job job
+		t   time.Time
+	}
+	var (
+		events []event
+		zones  []*time.Location
+		seen   = make(map[string]bool)
+	)
+	for _, j := range cfg.Jobs {
+		if j.Target.destination() == unknownDestination || j.Paused {
+			continue
+		}
+		sched, err := j.schedule()
+		if err != nil {
+			return fmt.Errorf("error in cronspec for %q: %w", j.Name, err)
+		}
+		jloc, err := j.location(loc)
+		if err != nil {
+			return fmt.Errorf("invalid timezone for %q: %w", j.Name, err)
+		}
+		for _, t := range nextRuns(sched, now, end, max) {
+			if !j.inWindow(t) {
+				continue
+			}
+			t = t.In(jloc)
+			events = append(events, event{job: j, t: t})
+			if name := tzid(t); name != "" && !seen[name] {
+				seen[name] = true
+				zones = append(zones, t.Location())
+			}
+		}
+	}
+
+	ics := &icalWriter{w: bufio.NewWriter(w)}
+	ics.line("BEGIN:VCALENDAR")
+	ics.line("VERSION:2.0")
+	ics.line("PRODID:-//kortschak//scheduler//EN")
+	for _, z := range zones {
+		ics.vtimezone(z, now, end)
+	}
+	for _, e := range events {
+		j, t := e.job, e.t
+		ics.line("BEGIN:VEVENT")
+		ics.line("UID:" + fmt.Sprintf("%d-%s@scheduler", t.Unix(), strings.Map(uidRune, j.Name)))
+		ics.line("DTSTAMP:" + stamp)
+		ics.line(dtstart(t))
+		ics.line("SUMMARY:" + icalText(j.Name))
+		desc := fmt.Sprintf("Publish to %s", j.Target.topicList())
+		switch j.Target.destination() {
+		case httpDestination:
+			desc = fmt.Sprintf("Request %s", j.Target.URI)
+		case appEngineDestination:
+			desc = fmt.Sprintf("Request App Engine %s", j.Target.RelativeURI)
+		}
+		if j.Description != "" {
+			desc = j.Description + "\n" + desc
+		}
+		ics.line("DESCRIPTION:" + icalText(desc))
+		ics.line("END:VEVENT")
+	}
+	ics.line("END:VCALENDAR")
+	if ics.err != nil {
+		return ics.err
+	}
+	return ics.w.Flush()
+}
+
+// tzid returns the TZID of t's location, or the empty string if t is
+// written in UTC.
+func tzid(t time.Time) string {
+	name := t.Location().String()
+	if name == "UTC" || name == "Local" {
+		return ""
+	}
+	return name
+}
+
+// dtstart returns the DTSTART property for t, using a TZID parameter
+// when t is in a named tz database location. The TZID refers to a
+// VTIMEZONE written by vtimezone.
+func dtstart(t time.Time) string {
+	name := tzid(t)
+	if name == "" {
+		return "DTSTART:" + t.UTC().Format("20060102T150405Z")
+	}
+	return "DTSTART;TZID=" + name + ":" + t.Format("20060102T150405")
+}
+
+// vtimezone writes a VTIMEZONE component for loc with an observance for
+// each offset change in loc between start and end, and for the offset
+// in effect at start.
+func (w *icalWriter) vtimezone(loc *time.Location, start, end time.Time) {
+	w.line("BEGIN:VTIMEZONE")
+	w.line("TZID:" + loc.String())
+	// Find the change to the offset in effect at start
+	// within the preceding year. Zones without a change
+	// in that time are given an observance starting at
+	// start, which precedes all the events.
+	first := start.In(loc).Truncate(time.Second)
+	from := offset(first)
+	if changes := zoneChanges(loc, start.AddDate(-1, 0, 0), start); len(changes) != 0 {
+		first = changes[len(changes)-1]
+		from = offset(first.Add(-time.Second))
+	}
+	w.observance(first, from)
+	for _, t := range zoneChanges(loc, start, end) {
+		w.observance(t, offset(t.Add(-time.Second)))
+	}
+	w.line("END:VTIMEZONE")
+}
+
+// observance writes a STANDARD or DAYLIGHT observance starting at t,
+// when the offset changed from the given number of seconds east of UTC.
+func (w *icalWriter) observance(t time.Time, from int) {
+	kind := "STANDARD"
+	if t.IsDST() {
+		kind = "DAYLIGHT"
+	}
+	name, to := t.Zone()
+	w.line("BEGIN:" + kind)
+	// The start of an observance is given in the local
+	// time of the offset before the change.
+	w.line("DTSTART:" + t.UTC().Add(time.Duration(from)*time.Second).Format("20060102T150405"))
+	w.line("TZOFFSETFROM:" + icalOffset(from))
+	w.line("TZOFFSETTO:" + icalOffset(to))
+	w.line("TZNAME:" + icalText(name))
+	w.line("END:" + kind)
+}
+
+// zoneChanges returns the times in (start, end] at which the offset or
+// abbreviation of loc changes.
+func zoneChanges(loc *time.Location, start, end time.Time) []time.Time {
+	var changes []time.Time
+	prev := start.In(loc)
+	for prev.Before(end) {
+		next := prev.Add(24 * time.Hour)
+		if next.After(end) {
+			next = end.In(loc)
+		}
+		pname, poff := prev.Zone()
+		if nname, noff := next.Zone(); nname != pname || noff != poff {
+			// Zone transitions are at whole seconds, and
+			// there is at most one a day.
+			lo, hi := prev.Truncate(time.Second), next.Truncate(time.Second)
+			for hi.Sub(lo) > time.Second {
+				mid := lo.Add(hi.Sub(lo) / 2).Truncate(time.Second)
+				if mname, moff := mid.Zone(); mname == pname && moff == poff {
+					lo = mid
+				} else {
+					hi = mid
+				}
+			}
+			changes = append(changes, hi)
+		}
+		prev = next
+	}
+	return changes
+}
+
+// offset returns the offset of t in seconds east of UTC.
+func offset(t time.Time) int {
+	_, off := t.Zone()
+	return off
+}
+
+// icalOffset returns the offset, in seconds east of UTC, formatted as
+// an iCalendar UTC-OFFSET value.
+func icalOffset(secs int) string {
+	sign := "+"
+	if secs < 0 {
+		sign = "-"
+		secs = -secs
+	}
+	h, m, s := secs/3600, secs/60%60, secs%60
+	if s != 0 {
+		return fmt.Sprintf("%s%02d%02d%02d", sign, h, m, s)
+	}
+	return fmt.Sprintf("%s%02d%02d", sign, h, m)
+}
+
+// uidRune maps characters that are not valid in a UID to hyphens.
+func uidRune(r rune) rune {
+	switch {
+	case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		return r
+	default:
+		return '-'
+	}
+}
+
+// icalText escapes s as an iCalendar TEXT value.
+func icalText(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\n", `\n`,
+	).Replace(s)
+}
+
+// icalWriter writes iCalendar content lines, folding long lines.
+type icalWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+// line writes a content line, folding it at 75 octets.
+func (w *icalWriter) line(s string) {
+	if w.err != nil {
+		return
+	}
+	const width = 75
+	for len(s) > width {
+		// Do not split UTF-8 sequences.
+		i := width
+		for i > 0 && s[i]&0xc0 == 0x80 {
+			i--
+		}
+		_, w.err = w.w.WriteString(s[:i] + "\r\n ")
+		if w.err != nil {
+			return
+		}
+		s = s[i:]
+	}
+	_, w.err = w.w.WriteString(s + "\r\n")
+}
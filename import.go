@@ -0,0 +1,190 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kortschak/scheduler/internal/cli"
+	"gopkg.in/yaml.v2"
+)
+
+// importCron runs the import subcommand.
+func importCron(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	project := flags.String("project", "", "specify project of the generated config")
+	host := flags.String("host", "localhost:8080", "specify host:port of the App Engine dev server")
+	topic := flags.String("topic", "", "specify topic to publish to instead of requesting the entry url (may be a topic template)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s import [options] cron.yaml\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		cli.Fatal("failed to open cron.yaml", "err", err)
+	}
+	var cron appEngineCron
+	err = yaml.NewDecoder(f).Decode(&cron)
+	f.Close()
+	if err != nil {
+		cli.Fatal("failed to read cron.yaml", "err", err)
+	}
+	err = writeImport(os.Stdout, cron, *project, *host, *topic)
+	if err != nil {
+		cli.Fatal("failed to import cron.yaml", "err", err)
+	}
+}
+
+// appEngineCron is an App Engine cron.yaml file.
+type appEngineCron struct {
+	Cron []appEngineCronEntry
+}
+
+// appEngineCronEntry is an entry in an App Engine cron.yaml file.
+type appEngineCronEntry struct {
+	Description     string
+	URL             string `yaml:"url"`
+	Schedule        string
+	Timezone        string
+	Target          string
+	RetryParameters *struct {
+		JobRetryLimit     int     `yaml:"job_retry_limit"`
+		JobAgeLimit       string  `yaml:"job_age_limit"`
+		MinBackoffSeconds float64 `yaml:"min_backoff_seconds"`
+		MaxBackoffSeconds float64 `yaml:"max_backoff_seconds"`
+		MaxDoublings      *int    `yaml:"max_doublings"`
+	} `yaml:"retry_parameters"`
+}
+
+// writeImport writes a scheduler config holding a job for each entry in
+// cron to w. Jobs request their entry's URL from the App Engine dev
+// server at host unless topic is not empty, in which case they publish
+// to topic.
+func writeImport(w io.Writer, cron appEngineCron, project, host, topic string) error {
+	cfg := yaml.MapSlice{{Key: "project", Value: project}}
+	services := make(map[string]bool)
+	var jobs []yaml.MapSlice
+	names := make(map[string]int)
+	for _, e := range cron.Cron {
+		if e.Schedule == "" {
+			return fmt.Errorf("missing schedule for %q", e.URL)
+		}
+		name := jobName(e.URL)
+		names[name]++
+		if n := names[name]; n > 1 {
+			name += "-" + strconv.Itoa(n)
+		}
+		j := yaml.MapSlice{
+			{Key: "name", Value: name},
+			{Key: "description", Value: e.Description},
+			{Key: "frequency", Value: e.Schedule},
+		}
+		if e.Timezone != "" {
+			j = append(j, yaml.MapItem{Key: "timezone", Value: e.Timezone})
+		}
+		if topic != "" {
+			j = append(j, yaml.MapItem{Key: "target", Value: yaml.MapSlice{
+				{Key: "destination", Value: "Pub/Sub"},
+				{Key: "topic", Value: topic},
+			}})
+		} else {
+			service := e.Target
+			if service == "" {
+				service = "default"
+			}
+			services[service] = true
+			j = append(j, yaml.MapItem{Key: "target", Value: yaml.MapSlice{
+				{Key: "destination", Value: "App Engine HTTP"},
+				{Key: "httpmethod", Value: "GET"},
+				{Key: "relativeuri", Value: e.URL},
+				{Key: "appenginerouting", Value: yaml.MapSlice{{Key: "service", Value: service}}},
+				// App Engine cron requests carry this header.
+				{Key: "headers", Value: yaml.MapSlice{{Key: "X-Appengine-Cron", Value: "true"}}},
+			}})
+		}
+		if r := e.RetryParameters; r != nil {
+			rc := yaml.MapSlice{{Key: "retrycount", Value: r.JobRetryLimit}}
+			if r.JobAgeLimit != "" {
+				d, err := parseAgeLimit(r.JobAgeLimit)
+				if err != nil {
+					return fmt.Errorf("invalid job_age_limit for %q: %w", e.URL, err)
+				}
+				rc = append(rc, yaml.MapItem{Key: "maxretryduration", Value: d.String()})
+			}
+			if r.MinBackoffSeconds != 0 {
+				rc = append(rc, yaml.MapItem{Key: "minbackoffduration", Value: seconds(r.MinBackoffSeconds).String()})
+			}
+			if r.MaxBackoffSeconds != 0 {
+				rc = append(rc, yaml.MapItem{Key: "maxbackoffduration", Value: seconds(r.MaxBackoffSeconds).String()})
+			}
+			if r.MaxDoublings != nil {
+				rc = append(rc, yaml.MapItem{Key: "maxdoublings", Value: *r.MaxDoublings})
+			}
+			j = append(j, yaml.MapItem{Key: "retryconfig", Value: rc})
+		}
+		jobs = append(jobs, j)
+	}
+	if len(services) != 0 {
+		var hosts []yaml.MapSlice
+		for _, e := range cron.Cron {
+			service := e.Target
+			if service == "" {
+				service = "default"
+			}
+			if !services[service] {
+				continue
+			}
+			delete(services, service)
+			hosts = append(hosts, yaml.MapSlice{
+				{Key: "service", Value: service},
+				{Key: "host", Value: host},
+			})
+		}
+		cfg = append(cfg, yaml.MapItem{Key: "appengine", Value: hosts})
+	}
+	cfg = append(cfg, yaml.MapItem{Key: "jobs", Value: jobs})
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// jobName returns a job name derived from a cron entry URL.
+func jobName(url string) string {
+	url = strings.SplitN(url, "?", 2)[0]
+	name := strings.Trim(strings.ReplaceAll(url, "/", "-"), "-")
+	if name == "" {
+		return "root"
+	}
+	return name
+}
+
+// parseAgeLimit parses an App Engine job_age_limit, a number followed by
+// a unit of s, m, h or d.
+func parseAgeLimit(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		return parseHorizon(s)
+	}
+	return time.ParseDuration(s)
+}
+
+// seconds returns the duration of s seconds.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
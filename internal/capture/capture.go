@@ -0,0 +1,101 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package capture implements the envelope in which listener captures
+// received Pub/Sub messages and scheduler replays them.
+//
+// A capture is a sequence of JSON envelopes, one per line. Each envelope
+// holds its version so that readers can reject captures written in a
+// format they do not understand. Fields added within a version are
+// ignored by older readers.
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Version is the version of the envelopes written by this package.
+// Envelopes with a later version cannot be read.
+const Version = 1
+
+// Envelope is a captured Pub/Sub message. The data is base64 encoded
+// in JSON.
+type Envelope struct {
+	Version     int               `json:"version"`
+	Topic       string            `json:"topic"`
+	Data        []byte            `json:"data"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	OrderingKey string            `json:"ordering_key,omitempty"`
+	PublishTime time.Time         `json:"publish_time"`
+}
+
+// Writer writes envelopes. It is safe for concurrent use.
+type Writer struct {
+	mu  sync.Mutex
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+// NewWriter returns a Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	bw := bufio.NewWriter(w)
+	return &Writer{w: bw, enc: json.NewEncoder(bw)}
+}
+
+// Write writes e with the current version. Envelopes are buffered until
+// the Writer is flushed.
+func (w *Writer) Write(e Envelope) error {
+	e.Version = Version
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.enc.Encode(e)
+}
+
+// Flush writes any buffered envelopes to the underlying writer.
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Flush()
+}
+
+// Reader reads envelopes.
+type Reader struct {
+	dec  *json.Decoder
+	line int
+}
+
+// NewReader returns a Reader reading from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{dec: json.NewDecoder(r)}
+}
+
+// Read returns the next envelope. It returns io.EOF when there are no
+// more envelopes, and an error if the envelope has no version or a
+// version later than Version.
+func (r *Reader) Read() (Envelope, error) {
+	var e Envelope
+	err := r.dec.Decode(&e)
+	if err != nil {
+		if err == io.EOF {
+			return e, err
+		}
+		return e, fmt.Errorf("invalid envelope %d: %w", r.line+1, err)
+	}
+	r.line++
+	switch {
+	case e.Version < 1:
+		return e, fmt.Errorf("invalid envelope %d: missing version", r.line)
+	case e.Version > Version:
+		return e, fmt.Errorf("invalid envelope %d: unsupported version %d (maximum %d)", r.line, e.Version, Version)
+	}
+	if e.Topic == "" {
+		return e, fmt.Errorf("invalid envelope %d: missing topic", r.line)
+	}
+	return e, nil
+}
@@ -0,0 +1,104 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package capture
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	want := []Envelope{
+		{
+			Version:     Version,
+			Topic:       "topic",
+			Data:        []byte("payload\x00"),
+			Attributes:  map[string]string{"scheduler.job_name": "job"},
+			OrderingKey: "key",
+			PublishTime: time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Version:     Version,
+			Topic:       "other",
+			Data:        []byte{},
+			PublishTime: time.Date(2024, time.January, 1, 0, 0, 1, 0, time.UTC),
+		},
+	}
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, e := range want {
+		e.Version = 0
+		err := w.Write(e)
+		if err != nil {
+			t.Fatalf("unexpected error writing envelope: %v", err)
+		}
+	}
+	err := w.Flush()
+	if err != nil {
+		t.Fatalf("unexpected error flushing envelopes: %v", err)
+	}
+
+	r := NewReader(&buf)
+	var got []Envelope
+	for {
+		e, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error reading envelope: %v", err)
+		}
+		got = append(got, e)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected envelopes:\ngot: %+v\nwant:%+v", got, want)
+	}
+}
+
+var readErrorTests = []struct {
+	capture string
+	want    string
+}{
+	{
+		capture: `{"topic":"t","data":"","publish_time":"2024-01-01T00:00:00Z"}`,
+		want:    "missing version",
+	},
+	{
+		capture: `{"version":2,"topic":"t","data":"","publish_time":"2024-01-01T00:00:00Z"}`,
+		want:    "unsupported version 2",
+	},
+	{
+		capture: `{"version":1,"data":"","publish_time":"2024-01-01T00:00:00Z"}`,
+		want:    "missing topic",
+	},
+	{
+		capture: `{"version":1,"topic":"t","data":"not base64!"}`,
+		want:    "invalid envelope 1",
+	},
+}
+
+func TestReadErrors(t *testing.T) {
+	for _, test := range readErrorTests {
+		_, err := NewReader(strings.NewReader(test.capture)).Read()
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("unexpected error for %s: got:%v want:%s", test.capture, err, test.want)
+		}
+	}
+}
+
+func TestReadUnknownFields(t *testing.T) {
+	const capture = `{"version":1,"topic":"t","data":"YQ==","publish_time":"2024-01-01T00:00:00Z","future":true}`
+	e, err := NewReader(strings.NewReader(capture)).Read()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e.Topic != "t" || string(e.Data) != "a" {
+		t.Errorf("unexpected envelope: %+v", e)
+	}
+}
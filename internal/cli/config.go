@@ -0,0 +1,279 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// ConfigFormat returns the format of the config file at path, yaml, json
+// or toml. If format is not empty it is returned after checking that it
+// is supported, otherwise the format is determined from the extension of
+// path, or for URLs, of the URL's path. Files with unknown extensions
+// and the standard input are treated as yaml.
+func ConfigFormat(path, format string) (string, error) {
+	switch format {
+	case "yaml", "json", "toml":
+		return format, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unsupported config format %q", format)
+	}
+	ext := filepath.Ext(path)
+	if IsRemote(path) {
+		u, err := url.Parse(path)
+		if err != nil {
+			return "", err
+		}
+		ext = filepath.Ext(u.Path)
+	}
+	switch strings.ToLower(ext) {
+	case ".json":
+		return "json", nil
+	case ".toml":
+		return "toml", nil
+	default:
+		return "yaml", nil
+	}
+}
+
+// ConfigFiles returns the sorted paths of the yaml, json and toml files
+// in dir.
+func ConfigFiles(dir string) ([]string, error) {
+	var paths []string
+	for _, ext := range []string{"*.yaml", "*.json", "*.toml"} {
+		matches, err := filepath.Glob(filepath.Join(dir, ext))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// LoadConfig decodes the config at path into dst. The config is read by
+// ReadConfig and its format is determined by ConfigFormat. References to
+// environment variables in its values are expanded by ExpandEnv. Keys
+// are the lowercased names of the fields of dst in all formats. Keys
+// that do not correspond to a field are errors, so misspelled keys are
+// not silently ignored. Each decoding error is reported with the path it
+// was found in, and for yaml files, with its line.
+func LoadConfig(path, format string, dst interface{}) error {
+	format, err := ConfigFormat(path, format)
+	if err != nil {
+		return err
+	}
+	b, err := ReadConfig(path)
+	if err != nil {
+		return err
+	}
+	b, err = ConvertConfig(path, format, b)
+	if err != nil {
+		return err
+	}
+	var doc yamlv3.Node
+	err = yamlv3.Unmarshal(b, &doc)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if doc.Kind == 0 {
+		// Empty config.
+		return nil
+	}
+	err = ExpandEnv(path, format, &doc)
+	if err != nil {
+		return err
+	}
+
+	// Values may not have the types of their fields
+	// until they are expanded, so only unknown keys
+	// are taken from decoding the unexpanded config.
+	var msgs []string
+	err = yaml.UnmarshalStrict(b, reflect.New(reflect.TypeOf(dst).Elem()).Interface())
+	var terr *yaml.TypeError
+	if errors.As(err, &terr) {
+		for _, e := range terr.Errors {
+			if unknownField.MatchString(e) {
+				msgs = append(msgs, e)
+			}
+		}
+	}
+	err = doc.Decode(dst)
+	if err != nil {
+		var terr *yamlv3.TypeError
+		if !errors.As(err, &terr) {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		msgs = append(msgs, terr.Errors...)
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	sort.SliceStable(msgs, func(i, j int) bool { return errorLine(msgs[i]) < errorLine(msgs[j]) })
+	errs := make([]error, len(msgs))
+	for i, e := range msgs {
+		if format == "yaml" {
+			e = linePrefix.ReplaceAllString(e, "$1:")
+		} else {
+			// Line numbers refer to the converted config.
+			e = linePrefix.ReplaceAllString(e, "")
+		}
+		errs[i] = fmt.Errorf("%s:%s", path, unknownField.ReplaceAllString(e, `unknown field "$1"`))
+	}
+	return errors.Join(errs...)
+}
+
+// errorLine returns the line number of a yaml decoding error message,
+// or zero if it has none.
+func errorLine(msg string) int {
+	m := linePrefix.FindStringSubmatch(msg)
+	if m == nil {
+		return 0
+	}
+	line, _ := strconv.Atoi(m[1])
+	return line
+}
+
+// ConvertConfig returns the config b read from path in the given format
+// converted to yaml, so that all formats share the yaml decoding of
+// configs. Yaml configs are returned unaltered.
+func ConvertConfig(path, format string, b []byte) ([]byte, error) {
+	if format == "yaml" {
+		return b, nil
+	}
+	var (
+		raw interface{}
+		err error
+	)
+	switch format {
+	case "json":
+		err = json.Unmarshal(b, &raw)
+	case "toml":
+		var m map[string]interface{}
+		_, err = toml.Decode(string(b), &m)
+		raw = m
+	default:
+		return nil, fmt.Errorf("unsupported config format %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	b, err = yaml.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return b, nil
+}
+
+// ExpandEnv expands references to environment variables in the values
+// of doc, the yaml document of the config read from path in the given
+// format and converted by ConvertConfig. Each ${VAR} is replaced by the
+// value of the environment variable VAR, and each ${VAR:-default} by the
+// value of VAR or by default if VAR is unset or empty. $${ is replaced by
+// a literal ${. Keys and comments are not expanded. Unquoted values are
+// resolved again after expansion, so they may hold numbers and booleans
+// as well as strings. A reference to an unset variable without a default
+// is an EnvError.
+func ExpandEnv(path, format string, doc *yamlv3.Node) error {
+	var errs []error
+	var walk func(n *yamlv3.Node)
+	walk = func(n *yamlv3.Node) {
+		switch n.Kind {
+		case yamlv3.DocumentNode, yamlv3.SequenceNode:
+			for _, c := range n.Content {
+				walk(c)
+			}
+		case yamlv3.MappingNode:
+			for i := 1; i < len(n.Content); i += 2 {
+				walk(n.Content[i])
+			}
+		case yamlv3.ScalarNode:
+			val, undefined := expandString(n.Value)
+			for _, name := range undefined {
+				e := &EnvError{Path: path, Name: name}
+				if format == "yaml" {
+					e.Line = n.Line
+				}
+				errs = append(errs, e)
+			}
+			if val == n.Value {
+				return
+			}
+			n.Value = val
+			if n.Style == 0 {
+				n.Tag = ""
+			}
+		}
+	}
+	walk(doc)
+	return errors.Join(errs...)
+}
+
+// expandString returns s with its references to environment variables
+// expanded, and the names of the variables referred to without a default
+// that are unset.
+func expandString(s string) (string, []string) {
+	var undefined []string
+	s = envRef.ReplaceAllStringFunc(s, func(ref string) string {
+		m := envRef.FindStringSubmatch(ref)
+		if m[1] != "" {
+			// Escaped reference.
+			return ref[1:]
+		}
+		val, ok := os.LookupEnv(m[2])
+		switch {
+		case m[3] != "" && val == "":
+			return m[4]
+		case ok:
+			return val
+		default:
+			undefined = append(undefined, m[2])
+			return ref
+		}
+	})
+	return s, undefined
+}
+
+// EnvError is an error for a reference to an undefined environment
+// variable in a config.
+type EnvError struct {
+	Path string
+	Line int // Line is zero if it is not known.
+	Name string
+}
+
+func (e *EnvError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: undefined environment variable %q", e.Path, e.Name)
+	}
+	return fmt.Sprintf("%s:%d: undefined environment variable %q", e.Path, e.Line, e.Name)
+}
+
+var (
+	// envRef matches environment variable references.
+	envRef = regexp.MustCompile(`\$(\$?)\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+	// linePrefix matches the line number prefix of yaml errors.
+	linePrefix = regexp.MustCompile(`^line (\d+):`)
+
+	// unknownField matches yaml errors for keys that do not
+	// correspond to a struct field.
+	unknownField = regexp.MustCompile(`field (\S+) not found in type \S+$`)
+)
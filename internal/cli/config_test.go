@@ -0,0 +1,120 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type testConfig struct {
+	Name    string
+	Port    int
+	Enabled bool
+	Data    string
+	Tags    []string
+}
+
+var loadConfigTests = []struct {
+	name    string
+	file    string
+	config  string
+	want    testConfig
+	wantErr string
+}{
+	{
+		name: "expand",
+		file: "config.yaml",
+		config: `# ${UNDEFINED} in a comment is not expanded.
+name: ${SCHEDULER_TEST_NAME}
+port: ${SCHEDULER_TEST_PORT}
+enabled: ${SCHEDULER_TEST_UNSET:-true}
+data: "$${literal}"
+tags: [a, "${SCHEDULER_TEST_NAME}-b"]
+`,
+		want: testConfig{Name: "test", Port: 8080, Enabled: true, Data: "${literal}", Tags: []string{"a", "test-b"}},
+	},
+	{
+		name: "quoted",
+		file: "config.yaml",
+		config: `name: "${SCHEDULER_TEST_PORT}"
+`,
+		want: testConfig{Name: "8080"},
+	},
+	{
+		name: "json",
+		file: "config.json",
+		config: `{"name": "${SCHEDULER_TEST_NAME}", "port": 1}
+`,
+		want: testConfig{Name: "test", Port: 1},
+	},
+	{
+		name: "undefined",
+		file: "config.yaml",
+		config: `name: a
+data: ${SCHEDULER_TEST_UNSET}
+`,
+		wantErr: `config.yaml:2: undefined environment variable "SCHEDULER_TEST_UNSET"`,
+	},
+	{
+		name: "undefined_json",
+		file: "config.json",
+		config: `{"data": "${SCHEDULER_TEST_UNSET}"}
+`,
+		wantErr: `config.json: undefined environment variable "SCHEDULER_TEST_UNSET"`,
+	},
+	{
+		name: "unknown_field",
+		file: "config.yaml",
+		config: `name: a
+port: ${SCHEDULER_TEST_PORT}
+bogus: ${SCHEDULER_TEST_NAME}
+`,
+		wantErr: `config.yaml:3: unknown field "bogus"`,
+	},
+	{
+		name: "type_error",
+		file: "config.yaml",
+		config: `name: a
+port: ${SCHEDULER_TEST_NAME}
+`,
+		wantErr: "config.yaml:2: cannot unmarshal !!str `test` into int",
+	},
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("SCHEDULER_TEST_NAME", "test")
+	t.Setenv("SCHEDULER_TEST_PORT", "8080")
+	os.Unsetenv("SCHEDULER_TEST_UNSET")
+	dir := t.TempDir()
+	for _, test := range loadConfigTests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, test.file)
+			err := os.WriteFile(path, []byte(test.config), 0o644)
+			if err != nil {
+				t.Fatalf("unexpected error writing config: %v", err)
+			}
+			var got testConfig
+			err = LoadConfig(path, "", &got)
+			if test.wantErr != "" {
+				if err == nil {
+					t.Fatalf("expected error: %s", test.wantErr)
+				}
+				if want := filepath.Join(dir, test.wantErr); err.Error() != want {
+					t.Errorf("unexpected error:\ngot: %s\nwant:%s", err, want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("unexpected config: got:%+v want:%+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+// IsRemote returns whether path is an http, https or gs URL.
+func IsRemote(path string) bool {
+	for _, scheme := range []string{"http://", "https://", "gs://"} {
+		if strings.HasPrefix(path, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadConfig returns the contents of the config at path. The path may
+// be a file path, "-" for the standard input, an http or https URL, or
+// a gs URL of a Cloud Storage object. Cloud Storage objects are read
+// with the application default credentials, or from the emulator at
+// STORAGE_EMULATOR_HOST if it is set. The standard input is read once,
+// and later reads return the same contents.
+func ReadConfig(path string) ([]byte, error) {
+	switch {
+	case path == "-":
+		stdin.once.Do(func() {
+			stdin.data, stdin.err = io.ReadAll(os.Stdin)
+		})
+		return stdin.data, stdin.err
+	case strings.HasPrefix(path, "gs://"):
+		return readGCS(path)
+	case IsRemote(path):
+		return fetch(http.DefaultClient, path, path)
+	default:
+		return os.ReadFile(path)
+	}
+}
+
+// stdin holds the contents of the standard input.
+var stdin struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+// fetchTimeout is the maximum time to wait for a remote config.
+const fetchTimeout = 30 * time.Second
+
+// readGCS returns the contents of the Cloud Storage object at the gs URL
+// path.
+func readGCS(path string) ([]byte, error) {
+	bucket, object, ok := strings.Cut(strings.TrimPrefix(path, "gs://"), "/")
+	if !ok || bucket == "" || object == "" {
+		return nil, fmt.Errorf("invalid cloud storage url: %s", path)
+	}
+	object = (&url.URL{Path: object}).EscapedPath()
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		return fetch(http.DefaultClient, path, fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(host, "/"), bucket, object))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+	client, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/devstorage.read_only")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return fetch(client, path, fmt.Sprintf("https://storage.googleapis.com/%s/%s", bucket, object))
+}
+
+// fetch returns the body of a GET request for url made with client. The
+// config path is used in errors.
+func fetch(client *http.Client, path, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected status: %s", path, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
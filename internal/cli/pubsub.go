@@ -0,0 +1,70 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"flag"
+
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// Connection holds the Pub/Sub client connection settings.
+type Connection struct {
+	Endpoint        string // host:port, the Pub/Sub service if empty.
+	CredentialsFile string // Application default credentials if empty.
+
+	// Insecure specifies that the endpoint is connected
+	// to without TLS or authentication, as for an emulator.
+	Insecure bool
+}
+
+// Options returns the client options for connecting with c.
+func (c Connection) Options() []option.ClientOption {
+	var opts []option.ClientOption
+	if c.Endpoint != "" {
+		opts = append(opts, option.WithEndpoint(c.Endpoint))
+	}
+	if c.CredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(c.CredentialsFile))
+	}
+	if c.Insecure {
+		opts = append(opts,
+			option.WithoutAuthentication(),
+			option.WithGRPCDialOption(grpc.WithInsecure()),
+		)
+	}
+	return opts
+}
+
+// ConnectionFlags holds the values of the Pub/Sub connection flags.
+type ConnectionFlags struct {
+	endpoint    *string
+	credentials *string
+	insecure    *bool
+}
+
+// AddConnectionFlags registers the -pubsub-endpoint, -credentials-file
+// and -pubsub-insecure flags with fs.
+func AddConnectionFlags(fs *flag.FlagSet) ConnectionFlags {
+	return ConnectionFlags{
+		endpoint:    fs.String("pubsub-endpoint", "", "specify Pub/Sub endpoint host:port, overriding the config (ignored if PUBSUB_EMULATOR_HOST is set)"),
+		credentials: fs.String("credentials-file", "", "specify service account credentials file, overriding the config"),
+		insecure:    fs.Bool("pubsub-insecure", false, "connect to -pubsub-endpoint without TLS or authentication"),
+	}
+}
+
+// Apply overrides the settings of c with the flags that were set.
+func (f ConnectionFlags) Apply(c *Connection) {
+	if *f.endpoint != "" {
+		c.Endpoint = *f.endpoint
+	}
+	if *f.credentials != "" {
+		c.CredentialsFile = *f.credentials
+	}
+	if *f.insecure {
+		c.Insecure = true
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"sort"
+	"time"
+)
+
+// Latencies holds percentiles of a set of latencies for a run report.
+type Latencies struct {
+	P50 time.Duration `json:"p50"`
+	P90 time.Duration `json:"p90"`
+	P99 time.Duration `json:"p99"`
+	Max time.Duration `json:"max"`
+}
+
+// NewLatencies returns the percentiles of d, or nil if d is empty. The
+// elements of d are sorted in place.
+func NewLatencies(d []time.Duration) *Latencies {
+	if len(d) == 0 {
+		return nil
+	}
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	return &Latencies{
+		P50: percentile(d, 50),
+		P90: percentile(d, 90),
+		P99: percentile(d, 99),
+		Max: d[len(d)-1],
+	}
+}
+
+// percentile returns the nearest-rank p'th percentile of the sorted
+// durations d.
+func percentile(d []time.Duration, p int) time.Duration {
+	rank := (p*len(d) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return d[rank-1]
+}
@@ -0,0 +1,470 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package listener implements the listener command, a simple Google
+// Cloud Pub/Sub subscriber. It runs a crom Pub/Sub subscriber based on
+// a provided yaml configuration file.
+package listener
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/kortschak/scheduler/internal/capture"
+	"github.com/kortschak/scheduler/internal/cli"
+	"github.com/kortschak/scheduler/listen"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/iterator"
+)
+
+// Main runs the listener command with the given name and command line
+// arguments.
+func Main(name string, args []string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	conf := flags.String("conf", "", "specify subscription config file, URL or - for stdin (required)")
+	format := flags.String("format", "", "specify config format (yaml, json or toml; determined from the file extension if empty)")
+	duration := flags.Duration("timeout", 0, "specify run duration (0 is forever)")
+	suffix := flags.String("suffix", "", "specify scheduler run suffix to match topics and append to subscriptions")
+	ackBatchSize := flags.Int("ack-batch-size", 0, "specify number of messages to ack in a batch (0 is no batching by size)")
+	ackBatchInterval := flags.Duration("ack-batch-interval", 0, "specify interval between batched acks (0 is no batching by time)")
+	assertOrdering := flags.Bool("assert-ordering", false, "fail if messages arrive out of seq attribute order within an ordering key")
+	keepSubs := flags.Bool("keep-subscriptions", false, "do not delete subscriptions when listener exits")
+	project := flags.String("project", "", "specify project to subscribe in, overriding the config")
+	conn := cli.AddConnectionFlags(flags)
+	logFormat := flags.String("log-format", "text", "specify log format (text or json)")
+	logLevel := flags.String("log-level", "info", "specify minimum log level (debug, info, warn or error)")
+	otlpEndpoint := flags.String("otlp-endpoint", "", "specify OTLP/HTTP collector host:port to export receive traces to (no tracing if empty)")
+	debugAddr := flags.String("debug-addr", "", "specify address to serve pprof debug endpoints (no endpoints if empty)")
+	metricsAddr := flags.String("metrics", "", "specify address to serve Prometheus metrics (no metrics if empty)")
+	reportFile := flags.String("report", "", "specify file to write a JSON summary of received messages to on exit")
+	readyFile := flags.String("ready-file", "", "specify file to create once all subscriptions are receiving")
+	captureFile := flags.String("capture", "", "specify file to write received messages to for scheduler replay (no capture if empty)")
+	help := flags.Bool("help", false, "display help")
+	flags.Parse(args)
+
+	if *help {
+		flags.Usage()
+		fmt.Fprint(os.Stderr, `
+listener is a Google Scheduler listener for testing a scheduler. It is
+also available as scheduler listen.
+
+It runs a crom Pub/Sub subscriber based on the provided yaml configuration
+file. See https://cloud.google.com/scheduler/docs/quickstart#create_a_job
+for the options handled by the configuration.
+
+Before starting listener, you should start scheduler. See github.com/kortschak/scheduler.
+
+Once the scheduler is ready, you can start listener. For listener
+to know to use the emulator it must be started with an appropriately set
+PUBSUB_EMULATOR_HOST. This can be obtained by running
+
+ $ gcloud beta emulators pubsub env-init
+
+and running the output prior to starting listener.
+
+listener requires a configuration yaml file which must either have a set
+of topics to subscribe to defined or a single project if all published
+topics should be subscribed to using the default subscription config.
+
+If scheduler was run with -unique-suffix, the logged suffix can be
+passed to listener with -suffix. Only topics with the suffix are
+subscribed to, the suffix is appended to configured topic and
+subscription names, and only subscriptions with the suffix are
+deleted when listener exits.
+
+If -keep-subscriptions is set, subscriptions are not deleted when
+listener exits. Subscriptions that already exist are used by later
+runs.
+
+To subscribe to a Pub/Sub service other than the emulator, leave
+PUBSUB_EMULATOR_HOST unset and give the project, endpoint and
+credentials in the pubsub section of the config, as for scheduler, or
+with -project, -pubsub-endpoint and -credentials-file.
+Application default credentials are used if no credentials file is
+given. If -pubsub-insecure is set, the endpoint is connected to without
+TLS or authentication.
+
+Log records are written to stderr as text, or as JSON if -log-format
+is json. Records below -log-level are not written. Received message
+records include the subscription, message id and latency since the
+message was published.
+
+If -metrics is set, listener serves Prometheus metrics for messages
+received, ack latency and redeliveries at /metrics on the given address.
+
+If -otlp-endpoint is set, the receipt of each message is recorded as a
+span and exported to the OTLP/HTTP collector at the given address,
+without TLS. The span continues any trace whose context is held in
+the message attributes, as added by scheduler's -otlp-endpoint.
+
+If -debug-addr is set, listener serves the net/http/pprof profiling
+endpoints under /debug/pprof/ on the given address.
+
+If -report is set, listener writes a JSON summary of the run to the
+given file on exit, holding the number of messages received and with
+unexpected payloads for each subscription, the times of the first and
+last receipts, publish to receive latency percentiles, and the number
+of messages received out of order.
+
+If -ready-file is set, listener creates the file once all its
+subscriptions have been created, and removes it on exit. Passing the
+same path to scheduler's -wait-for-listener flag makes scheduler wait
+for listener before it starts publishing.
+
+If -capture is set, listener writes each received message to the given
+file as a line of JSON holding the envelope version, topic, base64
+encoded data, attributes, ordering key and publish time. The capture
+can be published again with scheduler replay.
+
+`)
+		os.Exit(0)
+	}
+	if *conf == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	logger, err := cli.NewLogger(os.Stderr, *logFormat, *logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	var cfg config
+	err = cli.LoadConfig(*conf, *format, &cfg)
+	if err != nil {
+		cli.Fatal("failed to parse schedule config", "err", err)
+	}
+	if *project != "" {
+		cfg.Project = *project
+	}
+	conn.Apply(&cfg.PubSub)
+	for i, subs := range cfg.Subscriptions {
+		switch exp := subs.Config.ExpirationPolicy.(type) {
+		case nil:
+			// Do nothing.
+		case string:
+			d, err := time.ParseDuration(exp)
+			if err != nil {
+				cli.Fatal("failed to parse subscription config", "subscription", subs.ID, "err", err)
+			}
+			cfg.Subscriptions[i].Config.ExpirationPolicy = d
+		case int:
+			cfg.Subscriptions[i].Config.ExpirationPolicy = time.Duration(exp) * time.Second
+		default:
+			cli.Fatal("failed to parse subscription config: invalid expiration policy", "subscription", subs.ID, "policy", exp)
+		}
+		if subs.ExpectPayloadMatches != "" {
+			cfg.Subscriptions[i].expect, err = regexp.Compile(subs.ExpectPayloadMatches)
+			if err != nil {
+				cli.Fatal("failed to parse payload expectation", "subscription", subs.ID, "err", err)
+			}
+		}
+	}
+
+	if *readyFile != "" {
+		// Remove any stale ready file from a previous run.
+		err := os.Remove(*readyFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			cli.Fatal("failed to remove stale ready file", "err", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if *duration != 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), *duration)
+	}
+
+	client, err := pubsub.NewClient(ctx, cfg.Project, cfg.PubSub.Options()...)
+	if err != nil {
+		cli.Fatal("failed to create pubsub client", "err", err)
+	}
+	defer client.Close()
+
+	for i := range cfg.Subscriptions {
+		cfg.Subscriptions[i].Topic += *suffix
+		cfg.Subscriptions[i].ID += *suffix
+	}
+
+	all := len(cfg.Subscriptions) == 0
+	topit := client.Topics(ctx)
+	for {
+		t, err := topit.Next()
+		if err != nil {
+			if err == iterator.Done {
+				break
+			}
+			cli.Fatal("error during topic enumeration", "err", err)
+		}
+		slog.Info("available topic", "topic", t.ID())
+		if all && strings.HasSuffix(t.ID(), *suffix) {
+			id := t.ID()
+			slog.Info("adding topic", "topic", id)
+			cfg.Subscriptions = append(cfg.Subscriptions, subscription{Topic: id, ID: id})
+		}
+	}
+	if len(cfg.Subscriptions) == 0 {
+		slog.Info("no available subscriptions")
+		os.Exit(0)
+	}
+
+	var failures int64
+	var order *orderChecker
+	if *assertOrdering {
+		order = newOrderChecker()
+	}
+	if *otlpEndpoint != "" {
+		shutdown, err := cli.StartTracing(ctx, *otlpEndpoint, "listener")
+		if err != nil {
+			cli.Fatal("failed to start tracing", "err", err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err := shutdown(ctx)
+			if err != nil {
+				slog.Error("failed to flush traces", "err", err)
+			}
+		}()
+	}
+	if *debugAddr != "" {
+		srv, addr, err := cli.ServeDebug(*debugAddr)
+		if err != nil {
+			cli.Fatal("failed to serve debug endpoints", "err", err)
+		}
+		defer srv.Close()
+		slog.Info("serving pprof debug endpoints", "addr", addr.String())
+	}
+	var stats *metrics
+	if *metricsAddr != "" {
+		reg := prometheus.NewRegistry()
+		stats, err = newMetrics(reg)
+		if err != nil {
+			cli.Fatal("failed to create metrics", "err", err)
+		}
+		srv, addr, err := cli.ServeMetrics(*metricsAddr, reg)
+		if err != nil {
+			cli.Fatal("failed to serve metrics", "err", err)
+		}
+		defer srv.Close()
+		slog.Info("serving metrics", "addr", addr.String())
+	}
+	var rep *reporter
+	if *reportFile != "" {
+		rep = newReporter()
+	}
+	var captured *capture.Writer
+	if *captureFile != "" {
+		f, err := os.Create(*captureFile)
+		if err != nil {
+			cli.Fatal("failed to create capture file", "err", err)
+		}
+		defer f.Close()
+		captured = capture.NewWriter(f)
+	}
+
+	lopts := []listen.Option{listen.KeepSubscriptions(), listen.OnAck(stats.ack)}
+	if *ackBatchSize > 0 || *ackBatchInterval > 0 {
+		lopts = append(lopts, listen.BatchAcks(*ackBatchSize, *ackBatchInterval))
+	}
+	if *readyFile != "" {
+		lopts = append(lopts, listen.OnReady(func() {
+			err := os.WriteFile(*readyFile, []byte(time.Now().Format(time.RFC3339Nano)+"\n"), 0o644)
+			if err != nil {
+				slog.Error("failed to write ready file", "err", err)
+				return
+			}
+			slog.Info("wrote ready file", "path", *readyFile)
+		}))
+		defer os.Remove(*readyFile)
+	}
+	subs := make(map[string]subscription)
+	for _, sub := range cfg.Subscriptions {
+		subConfig := sub.Config
+		if isEmptyConfig(subConfig) {
+			slog.Info("using default config", "subscription", sub.ID, "config", fmt.Sprint(cfg.DefaultConfig))
+			subConfig = cfg.DefaultConfig
+		}
+		lopts = append(lopts, listen.Subscribe(listen.Subscription{
+			ID:              sub.ID,
+			Topic:           sub.Topic,
+			Config:          subConfig,
+			ReceiveSettings: sub.ReceiveSettings,
+		}))
+		subs[sub.ID] = sub
+	}
+
+	// Handle interrupt signal.
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt)
+
+	// Wait for cancellation or timeout.
+	go func() {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
+	failed := false
+	err = listen.New(client, lopts...).Receive(ctx, func(ctx context.Context, m listen.Message) {
+		sub := subs[m.Subscription]
+		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(m.Attributes))
+		_, span := tracer.Start(ctx, sub.ID,
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(
+				attribute.String("messaging.source", sub.Topic),
+				attribute.String("messaging.message_id", m.ID),
+			),
+		)
+		defer span.End()
+		slog.Info("received", "subscription", sub.ID, "id", m.ID, "data", string(m.Data),
+			"published", m.PublishTime, "latency", time.Since(m.PublishTime), "attempt", m.DeliveryAttempt,
+			"key", m.OrderingKey, "attributes", m.Attributes)
+		stats.receive(sub.ID, m.Message)
+		unexpected := sub.expect != nil && !sub.expect.Match(m.Data)
+		if unexpected {
+			slog.Error("unexpected payload", "subscription", sub.ID, "id", m.ID, "data", string(m.Data), "expect", sub.expect.String())
+			atomic.AddInt64(&failures, 1)
+		}
+		rep.receive(sub.ID, m.Message, unexpected)
+		if captured != nil {
+			err := captured.Write(capture.Envelope{
+				Topic:       sub.Topic,
+				Data:        m.Data,
+				Attributes:  m.Attributes,
+				OrderingKey: m.OrderingKey,
+				PublishTime: m.PublishTime,
+			})
+			if err != nil {
+				slog.Error("failed to capture message", "subscription", sub.ID, "id", m.ID, "err", err)
+			}
+		}
+		if order != nil {
+			order.check(sub.ID, m.Message)
+		}
+	})
+	if err != nil {
+		slog.Error("failed to receive", "err", err)
+		failed = true
+	}
+
+	fmt.Println("cancelling")
+
+	if captured != nil {
+		err := captured.Flush()
+		if err != nil {
+			slog.Error("failed to write capture", "path", *captureFile, "err", err)
+			failed = true
+		}
+	}
+
+	if rep != nil {
+		var outOfOrder int
+		if order != nil {
+			outOfOrder = order.count()
+		}
+		ids := make([]string, len(cfg.Subscriptions))
+		for i, sub := range cfg.Subscriptions {
+			ids[i] = sub.ID
+		}
+		err := rep.write(*reportFile, ids, outOfOrder)
+		if err != nil {
+			slog.Error("failed to write report", "path", *reportFile, "err", err)
+		}
+	}
+
+	if *keepSubs {
+		slog.Info("keeping subscriptions")
+	} else {
+		deleteAllSubscriptions(client, *suffix)
+	}
+
+	// Release signal.
+	signal.Stop(ch)
+
+	if n := atomic.LoadInt64(&failures); n != 0 {
+		slog.Error("messages did not match expected payload", "count", n)
+		failed = true
+	}
+	if order != nil && order.count() != 0 {
+		slog.Error("messages were received out of order", "count", order.count())
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// deleteAllSubscriptions deletes all the subscriptions in the client's
+// project with IDs ending in suffix.
+func deleteAllSubscriptions(client *pubsub.Client, suffix string) {
+	it := client.Subscriptions(context.Background())
+	for {
+		s, err := it.Next()
+		if err != nil {
+			if err == iterator.Done {
+				break
+			}
+			slog.Error("error during subscription clean up", "err", err)
+			continue
+		}
+		if !strings.HasSuffix(s.ID(), suffix) {
+			continue
+		}
+		err = s.Delete(context.Background())
+		if err != nil {
+			slog.Error("failed to delete subscription", "subscription", s.ID(), "err", err)
+		}
+	}
+}
+
+func isEmptyConfig(cfg pubsub.SubscriptionConfig) bool {
+	return reflect.DeepEqual(cfg, pubsub.SubscriptionConfig{})
+}
+
+type config struct {
+	Project       string
+	Subscriptions []subscription
+	DefaultConfig pubsub.SubscriptionConfig
+
+	// PubSub holds the Pub/Sub connection settings.
+	PubSub cli.Connection
+}
+
+type subscription struct {
+	Topic  string
+	ID     string
+	Config pubsub.SubscriptionConfig
+
+	// ReceiveSettings configures how messages are received,
+	// including ack deadline extension by the client with
+	// MaxExtension and MaxExtensionPeriod. Zero fields use
+	// the library defaults.
+	ReceiveSettings pubsub.ReceiveSettings
+
+	// ExpectPayloadMatches is a regular expression that
+	// received payloads must match. Messages that do not
+	// match are logged and cause listener to exit with a
+	// non-zero status. No validation if empty.
+	ExpectPayloadMatches string
+
+	expect *regexp.Regexp
+}
@@ -0,0 +1,97 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package listener
+
+import (
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics holds the listener's Prometheus collectors. A nil *metrics
+// records nothing.
+type metrics struct {
+	received    *prometheus.CounterVec
+	ackLatency  *prometheus.HistogramVec
+	redelivered *prometheus.CounterVec
+
+	mu      sync.Mutex
+	seen    map[subMessage]bool                 // seen holds the messages received on each subscription.
+	pending map[*pubsub.Message]receivedMessage // pending holds the messages not yet acked.
+}
+
+// subMessage is a message ID received on a subscription.
+type subMessage struct {
+	sub, id string
+}
+
+// receivedMessage records when a message was received on a subscription.
+type receivedMessage struct {
+	sub string
+	at  time.Time
+}
+
+// newMetrics returns a new metrics registered with reg.
+func newMetrics(reg prometheus.Registerer) (*metrics, error) {
+	m := &metrics{
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "listener_messages_received_total",
+			Help: "Number of messages received.",
+		}, []string{"subscription"}),
+		ackLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "listener_ack_latency_seconds",
+			Help: "Delay between receiving and acking messages.",
+		}, []string{"subscription"}),
+		redelivered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "listener_redeliveries_total",
+			Help: "Number of messages received more than once.",
+		}, []string{"subscription"}),
+		seen:    make(map[subMessage]bool),
+		pending: make(map[*pubsub.Message]receivedMessage),
+	}
+	for _, c := range []prometheus.Collector{m.received, m.ackLatency, m.redelivered} {
+		err := reg.Register(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// receive records the receipt of msg on the subscription with the given
+// ID. A message is counted as redelivered if it has already been seen on
+// the subscription or its delivery attempt is greater than one.
+func (m *metrics) receive(sub string, msg *pubsub.Message) {
+	if m == nil {
+		return
+	}
+	key := subMessage{sub: sub, id: msg.ID}
+	m.mu.Lock()
+	redelivered := m.seen[key] || (msg.DeliveryAttempt != nil && *msg.DeliveryAttempt > 1)
+	m.seen[key] = true
+	m.pending[msg] = receivedMessage{sub: sub, at: time.Now()}
+	m.mu.Unlock()
+
+	m.received.WithLabelValues(sub).Inc()
+	if redelivered {
+		m.redelivered.WithLabelValues(sub).Inc()
+	}
+}
+
+// ack records the acknowledgement of msg.
+func (m *metrics) ack(msg *pubsub.Message) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	r, ok := m.pending[msg]
+	delete(m.pending, msg)
+	m.mu.Unlock()
+	if ok {
+		m.ackLatency.WithLabelValues(r.sub).Observe(time.Since(r.at).Seconds())
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package listener
+
+import (
+	"log/slog"
+	"strconv"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// orderChecker checks that messages arrive in strictly increasing order
+// of their seq attribute within each subscription and ordering key.
+type orderChecker struct {
+	mu         sync.Mutex
+	last       map[orderKey]int64
+	violations int
+}
+
+// orderKey identifies an ordered stream of messages.
+type orderKey struct {
+	sub, key string
+}
+
+func newOrderChecker() *orderChecker {
+	return &orderChecker{last: make(map[orderKey]int64)}
+}
+
+// check records the sequence number of m received on the subscription
+// with the given ID, logging and counting any ordering violation.
+func (c *orderChecker) check(sub string, m *pubsub.Message) {
+	s, ok := m.Attributes["seq"]
+	if !ok {
+		slog.Warn("no seq attribute", "subscription", sub, "id", m.ID)
+		return
+	}
+	seq, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		slog.Warn("invalid seq attribute", "subscription", sub, "id", m.ID, "err", err)
+		return
+	}
+	k := orderKey{sub: sub, key: m.OrderingKey}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	last, ok := c.last[k]
+	if ok && seq <= last {
+		slog.Error("ordering violation", "subscription", sub, "key", m.OrderingKey, "seq", seq, "last", last)
+		c.violations++
+		return
+	}
+	c.last[k] = seq
+}
+
+// count returns the number of ordering violations seen.
+func (c *orderChecker) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.violations
+}
@@ -0,0 +1,108 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package listener
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/kortschak/scheduler/internal/cli"
+)
+
+// reporter accumulates received messages for the exit report. A nil
+// *reporter records nothing.
+type reporter struct {
+	start time.Time
+
+	mu   sync.Mutex
+	subs map[string]*subSummary
+}
+
+// subSummary accumulates the messages received on a subscription.
+type subSummary struct {
+	received, unexpected int
+	first, last          time.Time
+	latencies            []time.Duration
+}
+
+// newReporter returns a new reporter for a run starting now.
+func newReporter() *reporter {
+	return &reporter{start: time.Now(), subs: make(map[string]*subSummary)}
+}
+
+// receive records the receipt of m on the subscription with the given
+// ID, and whether its payload was unexpected.
+func (r *reporter) receive(sub string, m *pubsub.Message, unexpected bool) {
+	if r == nil {
+		return
+	}
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.subs[sub]
+	if !ok {
+		s = &subSummary{first: now}
+		r.subs[sub] = s
+	}
+	s.received++
+	if unexpected {
+		s.unexpected++
+	}
+	s.last = now
+	s.latencies = append(s.latencies, now.Sub(m.PublishTime))
+}
+
+// report is the JSON summary of a run written on exit.
+type report struct {
+	Start         time.Time                     `json:"start"`
+	End           time.Time                     `json:"end"`
+	Subscriptions map[string]subscriptionReport `json:"subscriptions"`
+	OutOfOrder    int                           `json:"out_of_order,omitempty"`
+}
+
+// subscriptionReport is the summary of a subscription in a report.
+type subscriptionReport struct {
+	Received     int            `json:"received"`
+	Unexpected   int            `json:"unexpected,omitempty"`
+	FirstReceive *time.Time     `json:"first_receive,omitempty"`
+	LastReceive  *time.Time     `json:"last_receive,omitempty"`
+	Latency      *cli.Latencies `json:"latency,omitempty"` // Nil if nothing was received.
+}
+
+// write writes a JSON summary of the messages received on the given
+// subscriptions, with the number of ordering violations, to the file at
+// path.
+func (r *reporter) write(path string, subs []string, outOfOrder int) error {
+	rep := report{
+		Start:         r.start,
+		End:           time.Now(),
+		Subscriptions: make(map[string]subscriptionReport),
+		OutOfOrder:    outOfOrder,
+	}
+	for _, id := range subs {
+		rep.Subscriptions[id] = subscriptionReport{}
+	}
+	r.mu.Lock()
+	for id, s := range r.subs {
+		first, last := s.first, s.last
+		rep.Subscriptions[id] = subscriptionReport{
+			Received:     s.received,
+			Unexpected:   s.unexpected,
+			FirstReceive: &first,
+			LastReceive:  &last,
+			Latency:      cli.NewLatencies(s.latencies),
+		}
+	}
+	r.mu.Unlock()
+
+	b, err := json.MarshalIndent(rep, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
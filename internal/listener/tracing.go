@@ -0,0 +1,11 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package listener
+
+import "go.opentelemetry.io/otel"
+
+// tracer is the tracer for message receipt. Spans are not recorded
+// unless tracing has been started.
+var tracer = otel.Tracer("github.com/kortschak/scheduler/listener")
@@ -0,0 +1,394 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// scheduledJob is a schedule.TimedJob that executes a job's target.
+type scheduledJob struct {
+	job
+
+	exec executor
+
+	// dependents are run after each
+	// successful execution of the job.
+	dependents []dependent
+
+	// succeeded, if not nil, is called after
+	// each successful execution of the job.
+	succeeded func()
+
+	// runs is the number of times
+	// the job has been fired.
+	runs int64
+
+	*jobEnv
+}
+
+// executor executes a job's target.
+type executor interface {
+	// execute makes an attempt to execute the target
+	// for a firing, returning the destination that was
+	// executed, such as a topic ID or URI.
+	execute(ctx context.Context, f firing) (dest string, err error)
+}
+
+// firing describes an attempt to execute a job.
+type firing struct {
+	// scheduled is the activation time the
+	// job was fired for, before any splay or
+	// jitter, and time is the time it fired.
+	scheduled time.Time
+	time      time.Time
+
+	// id identifies the execution. It
+	// is the same for all attempts.
+	id string
+
+	// attempt is the attempt number,
+	// starting from one.
+	attempt int
+
+	// run is the number of times the job has
+	// been fired, including this firing.
+	run int64
+
+	// seqs holds the sequence numbers assigned
+	// to the firing's messages. It is nil if
+	// messages are not numbered.
+	seqs map[seqKey]int64
+}
+
+// templateData returns the data for rendering the templates of the named
+// job for the firing.
+func (f firing) templateData(name string) templateData {
+	return templateData{JobName: name, Now: f.time, ScheduledTime: f.scheduled, RunCount: f.run}
+}
+
+// setupExecutor is an executor that must be set up before its first
+// execution.
+type setupExecutor interface {
+	executor
+	setup(ctx context.Context) error
+}
+
+// jobEnv holds the resources and settings shared by all jobs.
+type jobEnv struct {
+	pub     *publisher
+	client  *http.Client
+	stats   *metrics
+	latency *latency
+
+	// shutdown is cancelled when scheduler starts
+	// shutting down. Executions still waiting for
+	// their publish latency are then abandoned.
+	shutdown context.Context
+
+	// sequence numbers messages with a seq
+	// attribute if it is not nil.
+	sequence *sequencer
+
+	// attributes are attached to every
+	// message. Job-specific attributes
+	// take precedence.
+	attributes map[string]string
+
+	// appEngine maps App Engine services
+	// to local dev servers.
+	appEngine []appEngineHost
+
+	// splay is the bound on the random offset
+	// applied to each recurring job's schedule,
+	// and splayDist is the offset distribution.
+	splay     time.Duration
+	splayDist distribution
+
+	// history records job executions
+	// if it is not nil.
+	history *historyStore
+}
+
+// dependent is a job that is run after the job it depends on.
+type dependent struct {
+	job   cron.Job
+	delay time.Duration
+}
+
+// newScheduledJob returns a scheduledJob for j, executing with env.
+func newScheduledJob(j job, env *jobEnv) (*scheduledJob, error) {
+	if j.MaxRuns < 0 {
+		return nil, fmt.Errorf("negative max runs: %d", j.MaxRuns)
+	}
+	if j.CatchUpLimit < 0 {
+		return nil, fmt.Errorf("negative catch-up limit: %d", j.CatchUpLimit)
+	}
+	if j.Jitter < 0 {
+		return nil, fmt.Errorf("negative jitter: %v", j.Jitter)
+	}
+	_, err := parseDistribution(j.JitterDistribution)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jitter: %w", err)
+	}
+	if j.AttemptDeadline < 0 {
+		return nil, fmt.Errorf("negative attempt deadline: %v", j.AttemptDeadline)
+	}
+	if !j.StartTime.IsZero() && !j.EndTime.IsZero() && !j.EndTime.After(j.StartTime) {
+		return nil, fmt.Errorf("end time %v is not after start time %v", j.EndTime, j.StartTime)
+	}
+	err = j.RetryConfig.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid retry config: %w", err)
+	}
+	var exec executor
+	if len(j.Target.fanout) == 0 {
+		exec, err = newExecutor(j, env)
+	} else {
+		var f fanout
+		for i, t := range j.Target.targets() {
+			jt := j
+			jt.Target = t
+			e, err := newExecutor(jt, env)
+			if err != nil {
+				return nil, fmt.Errorf("target %d: %w", i, err)
+			}
+			f = append(f, e)
+		}
+		exec = f
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &scheduledJob{job: j, exec: exec, jobEnv: env}, nil
+}
+
+// newExecutor returns the executor for the target of j.
+func newExecutor(j job, env *jobEnv) (executor, error) {
+	switch dst := j.Target.destination(); dst {
+	case pubsubDestination:
+		return newPubsubTarget(j, env)
+	case httpDestination:
+		return newHTTPTarget(j, env)
+	case appEngineDestination:
+		return newAppEngineTarget(j, env)
+	default:
+		return nil, fmt.Errorf("unsupported destination: %q", j.Target.Destination)
+	}
+}
+
+// fanout is an executor that executes each of a job's targets in turn.
+type fanout []executor
+
+// execute executes each target for a firing. All targets are executed
+// even if some fail. The returned destination is a comma-separated list
+// of the destinations of the targets.
+func (f fanout) execute(ctx context.Context, fi firing) (string, error) {
+	dests := make([]string, len(f))
+	var errs []string
+	for i, e := range f {
+		dest, err := e.execute(ctx, fi)
+		dests[i] = dest
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", dest, err))
+		}
+	}
+	dest := strings.Join(dests, ",")
+	if errs != nil {
+		return dest, errors.New(strings.Join(errs, "; "))
+	}
+	return dest, nil
+}
+
+// setup sets up each target that must be set up.
+func (f fanout) setup(ctx context.Context) error {
+	for _, e := range f {
+		if s, ok := e.(setupExecutor); ok {
+			err := s.setup(ctx)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setup prepares the job's target for execution.
+func (j *scheduledJob) setup(ctx context.Context) error {
+	if s, ok := j.exec.(setupExecutor); ok {
+		return s.setup(ctx)
+	}
+	return nil
+}
+
+// attempt makes a single attempt to execute the job's target for a
+// firing, within the job's attempt deadline.
+func (j *scheduledJob) attempt(ctx context.Context, f firing) (string, error) {
+	deadline := j.AttemptDeadline
+	if deadline == 0 {
+		for _, t := range j.Target.targets() {
+			switch t.destination() {
+			case httpDestination, appEngineDestination:
+				deadline = 3 * time.Minute
+			}
+		}
+	}
+	if deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, deadline)
+		defer cancel()
+	}
+	return j.exec.execute(ctx, f)
+}
+
+// record records the outcome of an execution in the history, if there
+// is one. The execution's first attempt started at start, and its final
+// attempt took latency.
+func (j *scheduledJob) record(f firing, start time.Time, dest string, latency time.Duration, res *executionResult, err error) {
+	if j.history == nil {
+		return
+	}
+	e := execution{
+		Job:           j.Name,
+		ExecutionID:   f.id,
+		ScheduledTime: f.scheduled,
+		Time:          clock.Virtual(start),
+		Attempts:      f.attempt,
+		Destination:   dest,
+		Outcome:       "success",
+		Latency:       latency,
+	}
+	res.mu.Lock()
+	e.MessageIDs = res.messageIDs
+	e.HTTPStatuses = res.statuses
+	res.mu.Unlock()
+	if err != nil {
+		e.Outcome = "failure"
+		e.Error = err.Error()
+	}
+	err = j.history.record(e)
+	if err != nil {
+		slog.Error("failed to record execution", "job", j.Name, "err", err)
+	}
+}
+
+// Run executes the job's target for an activation at the current time.
+func (j *scheduledJob) Run() {
+	j.RunAt(clock.Now())
+}
+
+// RunAt executes the job's target for the activation scheduled at
+// scheduled.
+func (j *scheduledJob) RunAt(scheduled time.Time) {
+	if j.GateFile != "" {
+		_, err := os.Stat(j.GateFile)
+		if err != nil {
+			slog.Info("skipping job: gate file", "job", j.Name, "err", err)
+			return
+		}
+	}
+	f := firing{
+		scheduled: scheduled,
+		time:      clock.Now(),
+		id:        strconv.FormatInt(rnd.Int63(), 36),
+		run:       atomic.AddInt64(&j.runs, 1),
+	}
+	if j.sequence != nil {
+		f.seqs = make(map[seqKey]int64)
+	}
+	j.stats.fired(j.Name, f.time)
+	res := &executionResult{}
+	ctx, span := tracer.Start(withResult(context.Background(), res), j.Name,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("scheduler.job_name", j.Name),
+			attribute.String("scheduler.execution_id", f.id),
+		),
+	)
+	defer span.End()
+	err := j.latency.wait(j.shutdown)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+		slog.Warn("abandoned execution: shutting down", "job", j.Name)
+		return
+	}
+	first := time.Now()
+	for f.attempt = 1; ; f.attempt++ {
+		start := time.Now()
+		var dest string
+		dest, err = j.attempt(ctx, f)
+		latency := time.Since(start)
+		if dest != "" {
+			j.stats.publish(j.Name, dest, latency, err)
+		}
+		if err == nil {
+			span.SetAttributes(attribute.String("scheduler.destination", dest), attribute.Int("scheduler.attempts", f.attempt))
+			j.record(f, first, dest, latency, res, nil)
+			break
+		}
+		span.RecordError(err, trace.WithAttributes(attribute.Int("scheduler.attempt", f.attempt)))
+		delay, ok := j.RetryConfig.next(f.attempt-1, time.Since(first))
+		if !ok {
+			span.SetStatus(otelcodes.Error, err.Error())
+			slog.Error("failed to execute", "job", j.Name, "err", err)
+			j.record(f, first, dest, latency, res, err)
+			return
+		}
+		slog.Warn("failed to execute: retrying", "job", j.Name, "attempt", f.attempt, "delay", delay, "err", err)
+		if sleep(j.shutdown, delay) != nil {
+			span.SetStatus(otelcodes.Error, err.Error())
+			slog.Warn("abandoned retries: shutting down", "job", j.Name, "attempts", f.attempt)
+			j.record(f, first, dest, latency, res, err)
+			return
+		}
+	}
+	if j.GateFile != "" && j.ConsumeGateFile {
+		err = os.Remove(j.GateFile)
+		if err != nil {
+			slog.Error("failed to remove gate file", "job", j.Name, "err", err)
+		}
+	}
+	if j.succeeded != nil {
+		j.succeeded()
+	}
+	for _, d := range j.dependents {
+		d := d
+		go func() {
+			if sleep(j.shutdown, d.delay) != nil {
+				slog.Warn("abandoned dependent jobs: shutting down", "dependency", j.Name)
+				return
+			}
+			d.job.Run()
+		}()
+	}
+}
+
+// sleep waits for d, returning early with the context's error if ctx is
+// cancelled.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingExecutor records the firings it executes. The first failures
+// executions fail.
+type recordingExecutor struct {
+	failures int
+
+	mu      sync.Mutex
+	firings []firing
+}
+
+func (e *recordingExecutor) execute(_ context.Context, f firing) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.firings = append(e.firings, f)
+	if len(e.firings) <= e.failures {
+		return "topic", errors.New("execution failed")
+	}
+	return "topic", nil
+}
+
+func (e *recordingExecutor) got() []firing {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]firing(nil), e.firings...)
+}
+
+// newTestJob returns a scheduledJob for j that executes with exec.
+func newTestJob(t *testing.T, j job, exec executor) *scheduledJob {
+	t.Helper()
+	stats, err := newMetrics("", nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating metrics: %v", err)
+	}
+	return &scheduledJob{
+		job:  j,
+		exec: exec,
+		jobEnv: &jobEnv{
+			stats:    stats,
+			latency:  &latency{},
+			shutdown: context.Background(),
+		},
+	}
+}
+
+func TestGateFileRunCount(t *testing.T) {
+	gate := filepath.Join(t.TempDir(), "gate")
+	var exec recordingExecutor
+	j := newTestJob(t, job{Name: "gated", GateFile: gate}, &exec)
+
+	scheduled := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		j.RunAt(scheduled.Add(time.Duration(i) * time.Minute))
+	}
+	if got := exec.got(); len(got) != 0 {
+		t.Fatalf("unexpected executions without gate file: %d", len(got))
+	}
+
+	err := os.WriteFile(gate, nil, 0o644)
+	if err != nil {
+		t.Fatalf("unexpected error creating gate file: %v", err)
+	}
+	j.RunAt(scheduled.Add(3 * time.Minute))
+	got := exec.got()
+	if len(got) != 1 {
+		t.Fatalf("unexpected number of executions: got:%d want:1", len(got))
+	}
+	if got[0].run != 1 {
+		t.Errorf("unexpected run count: got:%d want:1", got[0].run)
+	}
+	if want := scheduled.Add(3 * time.Minute); !got[0].scheduled.Equal(want) {
+		t.Errorf("unexpected scheduled time: got:%v want:%v", got[0].scheduled, want)
+	}
+	if _, err := os.Stat(gate); err != nil {
+		t.Errorf("gate file unexpectedly removed: %v", err)
+	}
+}
+
+var retryTests = []struct {
+	name     string
+	failures int
+	retry    *retryConfig
+	shutdown bool // shutdown is whether the job's shutdown context is cancelled.
+	wantRuns int
+	wantOK   bool
+}{
+	{
+		name:     "no_retry",
+		failures: 1,
+		wantRuns: 1,
+	},
+	{
+		name:     "success",
+		wantRuns: 1,
+		wantOK:   true,
+	},
+	{
+		name:     "retried",
+		failures: 2,
+		retry:    &retryConfig{RetryCount: 3, MinBackoffDuration: time.Millisecond},
+		wantRuns: 3,
+		wantOK:   true,
+	},
+	{
+		name:     "exhausted",
+		failures: 5,
+		retry:    &retryConfig{RetryCount: 2, MinBackoffDuration: time.Millisecond},
+		wantRuns: 3,
+	},
+	{
+		name:     "max_retry_duration",
+		failures: 5,
+		retry:    &retryConfig{RetryCount: 5, MinBackoffDuration: time.Millisecond, MaxRetryDuration: 2 * time.Millisecond},
+		wantRuns: 2,
+	},
+	{
+		name:     "shutdown",
+		failures: 1,
+		retry:    &retryConfig{RetryCount: 1, MinBackoffDuration: time.Hour},
+		shutdown: true,
+		wantRuns: 1,
+	},
+}
+
+func TestRetry(t *testing.T) {
+	for _, test := range retryTests {
+		t.Run(test.name, func(t *testing.T) {
+			exec := recordingExecutor{failures: test.failures}
+			j := newTestJob(t, job{Name: "retried", RetryConfig: test.retry}, &exec)
+			if test.shutdown {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				j.shutdown = ctx
+			}
+			var ok bool
+			j.succeeded = func() { ok = true }
+
+			j.RunAt(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+			got := exec.got()
+			if len(got) != test.wantRuns {
+				t.Fatalf("unexpected number of attempts: got:%d want:%d", len(got), test.wantRuns)
+			}
+			for i, f := range got {
+				if f.attempt != i+1 {
+					t.Errorf("unexpected attempt number: got:%d want:%d", f.attempt, i+1)
+				}
+				if f.id != got[0].id {
+					t.Errorf("unexpected execution ID for attempt %d: got:%s want:%s", f.attempt, f.id, got[0].id)
+				}
+				if f.run != 1 {
+					t.Errorf("unexpected run count for attempt %d: got:%d want:1", f.attempt, f.run)
+				}
+			}
+			if ok != test.wantOK {
+				t.Errorf("unexpected success: got:%t want:%t", ok, test.wantOK)
+			}
+		})
+	}
+}
+
+func TestConsumeGateFile(t *testing.T) {
+	gate := filepath.Join(t.TempDir(), "gate")
+	err := os.WriteFile(gate, nil, 0o644)
+	if err != nil {
+		t.Fatalf("unexpected error creating gate file: %v", err)
+	}
+	exec := recordingExecutor{failures: 1}
+	j := newTestJob(t, job{Name: "gated", GateFile: gate, ConsumeGateFile: true}, &exec)
+
+	scheduled := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	j.RunAt(scheduled)
+	if _, err := os.Stat(gate); err != nil {
+		t.Fatalf("gate file removed after failed execution: %v", err)
+	}
+	j.RunAt(scheduled.Add(time.Minute))
+	if _, err := os.Stat(gate); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("gate file not removed after successful execution: %v", err)
+	}
+	j.RunAt(scheduled.Add(2 * time.Minute))
+	if got := exec.got(); len(got) != 2 {
+		t.Errorf("unexpected number of executions: got:%d want:2", len(got))
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// latency is a flag.Value specifying a fixed or uniformly distributed
+// delay. It is given as a single duration or as a min-max range of
+// durations.
+type latency struct {
+	min, max time.Duration
+}
+
+func (l *latency) String() string {
+	if l.min == l.max {
+		return l.min.String()
+	}
+	return fmt.Sprintf("%v-%v", l.min, l.max)
+}
+
+func (l *latency) Set(s string) error {
+	parts := strings.SplitN(s, "-", 2)
+	min, err := time.ParseDuration(parts[0])
+	if err != nil {
+		return err
+	}
+	max := min
+	if len(parts) == 2 {
+		max, err = time.ParseDuration(parts[1])
+		if err != nil {
+			return err
+		}
+	}
+	if min < 0 || max < min {
+		return fmt.Errorf("invalid latency range: %s", s)
+	}
+	l.min, l.max = min, max
+	return nil
+}
+
+// wait sleeps for a duration drawn from the latency's range, returning
+// early with the context's error if ctx is cancelled.
+func (l *latency) wait(ctx context.Context) error {
+	d := l.min
+	if l.max > l.min {
+		d += time.Duration(rnd.Int63n(int64(l.max - l.min)))
+	}
+	if d == 0 {
+		return nil
+	}
+	return sleep(ctx, d)
+}
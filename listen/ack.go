@@ -0,0 +1,96 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package listen
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// ackBatcher acknowledges received messages in batches.
+type ackBatcher struct {
+	size     int           // Flush when size messages are pending, unless zero.
+	interval time.Duration // Flush every interval, unless zero.
+
+	// acknowledge acknowledges a single message.
+	acknowledge func(*pubsub.Message)
+
+	log *slog.Logger
+
+	msgs chan *pubsub.Message
+	done chan struct{}
+}
+
+// newAckBatcher returns a new ackBatcher that acknowledges messages with
+// ack, logging flushed batches to log. The batcher's run method must be
+// called for messages to be acknowledged.
+func newAckBatcher(size int, interval time.Duration, ack func(*pubsub.Message), log *slog.Logger) *ackBatcher {
+	return &ackBatcher{
+		size:        size,
+		interval:    interval,
+		acknowledge: ack,
+		log:         log,
+		msgs:        make(chan *pubsub.Message),
+		done:        make(chan struct{}),
+	}
+}
+
+// ack queues m for acknowledgement.
+func (b *ackBatcher) ack(m *pubsub.Message) {
+	b.msgs <- m
+}
+
+// run acknowledges queued messages in batches until ctx is cancelled.
+// After ctx is cancelled, pending messages are acknowledged and further
+// queued messages are acknowledged immediately until close is called.
+func (b *ackBatcher) run(ctx context.Context) {
+	defer close(b.done)
+
+	var tick <-chan time.Time
+	if b.interval > 0 {
+		t := time.NewTicker(b.interval)
+		defer t.Stop()
+		tick = t.C
+	}
+	var batch []*pubsub.Message
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		for _, m := range batch {
+			b.acknowledge(m)
+		}
+		b.log.Info("acked batch", "messages", len(batch))
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case m := <-b.msgs:
+			batch = append(batch, m)
+			if b.size > 0 && len(batch) >= b.size {
+				flush()
+			}
+		case <-tick:
+			flush()
+		case <-ctx.Done():
+			// Drain.
+			flush()
+			for m := range b.msgs {
+				b.acknowledge(m)
+			}
+			return
+		}
+	}
+}
+
+// close stops the batcher once all receivers have returned and waits
+// for it to finish acknowledging messages.
+func (b *ackBatcher) close() {
+	close(b.msgs)
+	<-b.done
+}
@@ -0,0 +1,254 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package listen provides the subscriber core of the listener command
+// for embedding in Go programs and integration tests. It creates
+// subscriptions and passes received messages to a Handler, so tests can
+// collect messages directly rather than parsing log output.
+package listen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Message is a message received on a subscription.
+type Message struct {
+	// Subscription is the ID of the subscription
+	// the message was received on.
+	Subscription string
+
+	*pubsub.Message
+}
+
+// Handler handles received messages. Handlers for different
+// subscriptions may be called concurrently.
+type Handler func(ctx context.Context, m Message)
+
+// Send returns a Handler that sends received messages on ch. The
+// handler blocks until the message is sent or ctx is cancelled.
+func Send(ch chan<- Message) Handler {
+	return func(ctx context.Context, m Message) {
+		select {
+		case ch <- m:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// Subscription is a subscription to a topic.
+type Subscription struct {
+	// ID is the subscription's ID.
+	ID string
+
+	// Topic is the ID of the topic the subscription
+	// is attached to.
+	Topic string
+
+	// Config is the configuration used if the
+	// subscription is created. Its Topic field
+	// is ignored.
+	Config pubsub.SubscriptionConfig
+
+	// ReceiveSettings configures how messages are
+	// received. Zero fields use the library
+	// defaults.
+	ReceiveSettings pubsub.ReceiveSettings
+}
+
+// Option is a Listener option.
+type Option func(*Listener)
+
+// Subscribe adds subscriptions to a Listener. Subscriptions that do not
+// exist are created when messages are received, and those that already
+// exist are used as they are.
+func Subscribe(subs ...Subscription) Option {
+	return func(l *Listener) {
+		l.subs = append(l.subs, subs...)
+	}
+}
+
+// Filter adds a filter to a Listener. Messages for which any filter
+// returns false are acknowledged without being passed to the Handler.
+func Filter(keep func(Message) bool) Option {
+	return func(l *Listener) {
+		l.filters = append(l.filters, keep)
+	}
+}
+
+// ManualAck specifies that the Handler is responsible for acknowledging
+// messages. By default messages are acknowledged when the Handler
+// returns.
+func ManualAck() Option {
+	return func(l *Listener) {
+		l.manual = true
+	}
+}
+
+// BatchAcks specifies that messages are acknowledged in batches, when
+// size messages are pending or every interval. A zero size or interval
+// disables flushing on that condition. BatchAcks has no effect with
+// ManualAck.
+func BatchAcks(size int, interval time.Duration) Option {
+	return func(l *Listener) {
+		l.batchSize = size
+		l.batchInterval = interval
+	}
+}
+
+// OnAck specifies a function called after each message is acknowledged
+// by the Listener.
+func OnAck(fn func(*pubsub.Message)) Option {
+	return func(l *Listener) {
+		l.onAck = fn
+	}
+}
+
+// OnReady specifies a function called once all the subscriptions have
+// been created and messages are being received.
+func OnReady(fn func()) Option {
+	return func(l *Listener) {
+		l.onReady = fn
+	}
+}
+
+// KeepSubscriptions specifies that subscriptions created by a Listener
+// are not deleted when Receive returns.
+func KeepSubscriptions() Option {
+	return func(l *Listener) {
+		l.keep = true
+	}
+}
+
+// Logger specifies the logger for subscription and acknowledgement
+// events. If not given, slog.Default() is used.
+func Logger(log *slog.Logger) Option {
+	return func(l *Listener) {
+		l.log = log
+	}
+}
+
+// Listener receives messages from Pub/Sub subscriptions.
+type Listener struct {
+	client *pubsub.Client
+
+	subs          []Subscription
+	filters       []func(Message) bool
+	manual        bool
+	batchSize     int
+	batchInterval time.Duration
+	onAck         func(*pubsub.Message)
+	onReady       func()
+	keep          bool
+	log           *slog.Logger
+}
+
+// New returns a new Listener receiving with client.
+func New(client *pubsub.Client, opts ...Option) *Listener {
+	l := &Listener{client: client, log: slog.Default()}
+	for _, o := range opts {
+		o(l)
+	}
+	return l
+}
+
+// Receive creates the Listener's subscriptions and calls h for each
+// received message until ctx is cancelled. Unless KeepSubscriptions was
+// given, subscriptions created by Receive are deleted before it returns.
+func (l *Listener) Receive(ctx context.Context, h Handler) error {
+	if len(l.subs) == 0 {
+		return errors.New("listen: no subscriptions")
+	}
+	var created []*pubsub.Subscription
+	defer func() {
+		if l.keep {
+			return
+		}
+		for _, s := range created {
+			err := s.Delete(context.Background())
+			if err != nil {
+				l.log.Error("failed to delete subscription", "subscription", s.ID(), "err", err)
+			}
+		}
+	}()
+	handles := make([]*pubsub.Subscription, len(l.subs))
+	for i, sub := range l.subs {
+		l.log.Info("subscribing", "topic", sub.Topic, "subscription", sub.ID)
+		cfg := sub.Config
+		cfg.Topic = l.client.Topic(sub.Topic)
+		s, err := l.client.CreateSubscription(ctx, sub.ID, cfg)
+		switch {
+		case status.Code(err) == codes.AlreadyExists:
+			l.log.Info("using existing subscription", "subscription", sub.ID)
+			s = l.client.Subscription(sub.ID)
+		case err != nil:
+			return fmt.Errorf("listen: failed to create subscription %s: %w", sub.ID, err)
+		default:
+			created = append(created, s)
+		}
+		s.ReceiveSettings = sub.ReceiveSettings
+		handles[i] = s
+	}
+
+	ack := func(m *pubsub.Message) {
+		m.Ack()
+		if l.onAck != nil {
+			l.onAck(m)
+		}
+	}
+	var batcher *ackBatcher
+	if !l.manual && (l.batchSize > 0 || l.batchInterval > 0) {
+		batcher = newAckBatcher(l.batchSize, l.batchInterval, ack, l.log)
+		go batcher.run(ctx)
+		ack = batcher.ack
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for i, s := range handles {
+		id := l.subs[i].ID
+		s := s
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+				msg := Message{Subscription: id, Message: m}
+				for _, keep := range l.filters {
+					if !keep(msg) {
+						ack(m)
+						return
+					}
+				}
+				h(ctx, msg)
+				if !l.manual {
+					ack(m)
+				}
+			})
+			if err != nil && !errors.Is(err, context.Canceled) {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("listen: failed to receive on %s: %w", id, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	if l.onReady != nil {
+		l.onReady()
+	}
+	wg.Wait()
+	if batcher != nil {
+		batcher.close()
+	}
+	return errors.Join(errs...)
+}
@@ -3,29 +3,133 @@
 // license that can be found in the LICENSE file.
 
 // scheduler is a simple Google Scheduler emulator. It runs a crom Pub/Sub
-// publisher based on a provided yaml configuration file.
+// publisher and HTTP client based on a provided yaml configuration file.
 package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
-	"strings"
+	"strconv"
+	"syscall"
 	"time"
 
-	"cloud.google.com/go/pubsub"
-	"github.com/robfig/cron/v3"
+	"github.com/kortschak/scheduler/internal/cli"
+	"github.com/kortschak/scheduler/internal/listener"
+	"github.com/kortschak/scheduler/schedule"
+	"github.com/prometheus/client_golang/prometheus"
+	schedulerpb "google.golang.org/genproto/googleapis/cloud/scheduler/v1"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
-	"gopkg.in/yaml.v2"
 )
 
 func main() {
-	conf := flag.String("conf", "", "specify yaml config (required)")
+	var roundTrip bool
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "selftest":
+			selftest(os.Args[2:])
+			return
+		case "ical":
+			ical(os.Args[2:])
+			return
+		case "preview":
+			preview(os.Args[2:])
+			return
+		case "validate":
+			validateConfig(os.Args[2:])
+			return
+		case "run-now":
+			runNow(os.Args[2:])
+			return
+		case "import":
+			importCron(os.Args[2:])
+			return
+		case "history":
+			history(os.Args[2:])
+			return
+		case "timeline":
+			timeline(os.Args[2:])
+			return
+		case "replay":
+			replay(os.Args[2:])
+			return
+		case "listen":
+			listener.Main(os.Args[0]+" listen", os.Args[2:])
+			return
+		case "run":
+			// Equivalent to no subcommand.
+			os.Args = append(os.Args[:1:1], os.Args[2:]...)
+		case "e2e":
+			// Run with an in-process subscriber.
+			roundTrip = true
+			os.Args = append(os.Args[:1:1], os.Args[2:]...)
+		}
+	}
+
+	conf := flag.String("conf", "", "specify config file, directory, glob pattern, URL or - for stdin (required unless -conf-dir is set)")
+	confDir := flag.String("conf-dir", "", "specify directory of configs to merge")
+	format := flag.String("format", "", "specify config format (yaml, json or toml; determined from file extensions if empty)")
 	duration := flag.Duration("timeout", 0, "specify run duration (0 is forever)")
+	watch := flag.Duration("watch", 0, "specify interval to poll the config for changes to reload (no polling if zero)")
+	reloadFailure := flag.String("reload-failure", "keep", "specify action when a config reload fails (keep the old config or halt)")
+	grace := flag.Duration("shutdown-grace", 10*time.Second, "specify maximum time to wait for running jobs to finish publishing at shutdown")
+	exitWhenDone := flag.Bool("exit-when-done", false, "exit when all jobs with a bounded number of runs have completed")
+	builtin := flag.Bool("builtin-pubsub", false, "serve an in-process Pub/Sub emulator instead of using PUBSUB_EMULATOR_HOST")
+	builtinPort := flag.Int("builtin-pubsub-port", 0, "specify port for -builtin-pubsub (a free port if zero)")
+	startEmu := flag.Bool("start-emulator", false, "start the gcloud Pub/Sub emulator and stop it on exit")
+	emuTimeout := flag.Duration("emulator-timeout", time.Minute, "specify maximum time to wait for -start-emulator to become ready")
+	project := flag.String("project", "", "specify project to publish to, overriding the config")
+	conn := cli.AddConnectionFlags(flag.CommandLine)
+	waitEmu := flag.Duration("wait-for-emulator", 0, "specify maximum time to wait for the Pub/Sub emulator to accept connections (no waiting if zero)")
+	reconnects := flag.Int("reconnect-attempts", 5, "specify maximum number of pubsub reconnection attempts")
+	requireSubs := flag.Bool("require-subscribers", false, "fail if any configured topic has no subscriptions within -require-subscribers-timeout of creating topics")
+	requireSubsTimeout := flag.Duration("require-subscribers-timeout", 30*time.Second, "specify maximum time to wait for -require-subscribers to find subscriptions")
+	reuseTopics := flag.Bool("reuse-topics", false, "use topics that already exist instead of failing, and only delete topics created by scheduler")
+	keepTopics := flag.Bool("keep-topics", false, "do not delete topics created by scheduler when it exits")
+	uniqueSuffix := flag.Bool("unique-suffix", false, "append a unique run suffix to every topic name")
+	errTopic := flag.String("error-topic", "", "specify topic to receive job panic diagnostics (log only if empty)")
+	maxDynamic := flag.Int("max-dynamic-topics", 100, "specify maximum number of topics created from topic templates")
+	injectSeq := flag.Bool("inject-sequence", false, "attach a monotonically increasing seq attribute to messages, counted per topic and ordering key, or per job and topic without an ordering key")
+	waitListener := flag.String("wait-for-listener", "", "specify listener ready file to wait for before publishing")
+	waitListenerTimeout := flag.Duration("wait-for-listener-timeout", 30*time.Second, "specify maximum time to wait for the listener ready file")
+	grpcAddr := flag.String("grpc-addr", "", "specify address to serve the Cloud Scheduler gRPC API (no API if empty)")
+	adminAddr := flag.String("admin", "", "specify address to serve the JSON admin API (no API if empty)")
+	control := flag.String("control", "", "specify unix socket path to serve the JSON admin API (no socket if empty)")
+	location := flag.String("location", "local", "specify location used in Cloud Scheduler API job names")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "specify OTLP/HTTP collector host:port to export job execution traces to (no tracing if empty)")
+	debugAddr := flag.String("debug-addr", "", "specify address to serve pprof debug endpoints (no endpoints if empty)")
+	metricsAddr := flag.String("metrics", "", "specify address to serve Prometheus metrics (no metrics if empty)")
+	pushURL := flag.String("pushgateway-url", "", "specify Prometheus Pushgateway URL to push metrics to at exit (no push if empty)")
+	pushJob := flag.String("pushgateway-job", "scheduler", "specify job label for metrics pushed to the Pushgateway")
+	pushEvery := flag.Duration("pushgateway-interval", 0, "specify interval between metric pushes to the Pushgateway (only at exit if zero)")
+	statsdAddr := flag.String("statsd-addr", "", "specify DogStatsD UDP address for metrics (no metrics if empty)")
+	var only, skip selectors
+	flag.Var(&only, "only", "run only jobs matching a key=pattern selector, where key is name or a label key (may be repeated)")
+	flag.Var(&skip, "skip", "do not run jobs matching a key=pattern selector, where key is name or a label key (may be repeated)")
+	var pubLatency latency
+	flag.Var(&pubLatency, "publish-latency", "specify artificial delay before each publish as a duration or min-max range")
+	dryRun := flag.Bool("dry-run", false, "print a timeline of the executions within -horizon without connecting to any service")
+	horizon := flag.String("horizon", "1d", "specify duration of the -dry-run timeline (accepts d for days)")
+	dstHorizon := flag.String("dst-horizon", "30d", "specify period to warn of daylight saving transitions that change job fire times over (accepts d for days; no warnings if zero)")
+	speed := flag.Float64("speed", 1, "specify speed of the virtual clock jobs are scheduled against as a multiple of real time (0 stops the clock)")
+	reportPath := flag.String("report", "", "specify file to write a JSON summary of the run to on exit (no report if empty)")
+	failOnError := flag.Bool("fail-on-publish-error", false, "exit with a non-zero status if any publish or HTTP request failed")
+	minPublishes := flag.Int("min-publishes", 0, "exit with a non-zero status if fewer than this many publishes and HTTP requests succeeded")
+	e2eDrain := flag.Duration("e2e-drain", 5*time.Second, "specify maximum time for the e2e subcommand to wait for published messages to be received at shutdown")
+	historyPath := flag.String("history", "", "specify database file to record job executions in (no history if empty)")
+	statePath := flag.String("state", "", "specify file to persist job fire times for catching up missed runs (no persistence if empty)")
+	splay := flag.Duration("splay", 0, "specify bound on a random offset applied to each recurring job's schedule")
+	splayDist := flag.String("splay-distribution", "uniform", "specify distribution of -splay offsets (uniform, normal or exponential)")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "specify random seed")
+	logFormat := flag.String("log-format", "text", "specify log format (text or json)")
+	logLevel := flag.String("log-level", "info", "specify minimum log level (debug, info, warn or error)")
 	help := flag.Bool("help", false, "display help")
 	flag.Parse()
 
@@ -53,87 +157,628 @@ PUBSUB_EMULATOR_HOST. This can be obtained by running
 
 and running the output prior to starting scheduler.
 
+Running scheduler with no subcommand, or with the run subcommand, runs
+the scheduler. The listener that subscribes to the scheduler's topics
+is run with the listen subcommand, which takes the same flags as the
+listener command. For help on the listener, run
+
+ $ scheduler listen -help
+
+The e2e subcommand runs the scheduler with an in-process subscriber to
+each of the configured topics and logs the round trip of every message
+it publishes, so a smoke test needs only the emulator and one process.
+Messages not received within -e2e-drain of shutdown give a non-zero
+exit status. Dynamic topics created from templates are not subscribed.
+
+To publish to a Pub/Sub service other than the emulator, for example
+for smoke tests against a staging project, leave PUBSUB_EMULATOR_HOST
+unset. The project, endpoint and credentials may be given by -project,
+-pubsub-endpoint and -credentials-file, or in the pubsub section of the
+config. Application default credentials are used if no credentials file
+is given. If -pubsub-insecure is set, the endpoint is connected to
+without TLS or authentication.
+
+If -start-emulator is set, scheduler starts the gcloud emulator itself
+on a free port, waits for it to become ready and stops it on exit. The
+emulator's address is logged.
+
+If -wait-for-emulator is set, scheduler waits up to the given time for
+the emulator at PUBSUB_EMULATOR_HOST, or the pubsub endpoint, to accept
+connections before starting, retrying with exponential backoff. This
+allows scheduler and the emulator to be started concurrently.
+
+Alternatively, if -builtin-pubsub is set, scheduler serves its own
+in-memory Pub/Sub emulator and publishes to it. Its address is logged
+at start, and can be used as PUBSUB_EMULATOR_HOST for listener and
+other clients. Its state is lost when scheduler exits.
+
+Jobs with an http destination send a request to their uri on each
+firing instead of publishing to Pub/Sub. Jobs with an App Engine HTTP
+destination send a request to the local dev server configured for
+their App Engine service in the appengine section of the config.
+
 Then in a third terminal, you can receive the pubsub messages using the
 python snippets described in the emulator documentation.
 
+Log records are written to stderr as text, or as JSON if -log-format
+is json. Records below -log-level are not written. Publish records
+include the job, topic, message id and publish latency.
+
+If -metrics is set, scheduler serves Prometheus metrics for publishes,
+publish failures, publish latency, schedule lag and topics created at
+/metrics on the given address.
+
+If -pushgateway-url is set, the same metrics are pushed to a Prometheus
+Pushgateway under the -pushgateway-job job label when scheduler exits,
+and every -pushgateway-interval if it is set. This allows metrics to be
+collected from short-lived runs that are never scraped. The job label
+of pushed metrics is renamed to exported_job. The final push replaces
+the metrics pushed earlier in the run.
+
+If -otlp-endpoint is set, each job execution is recorded as a span and
+exported to the OTLP/HTTP collector at the given address, without TLS.
+The span's W3C trace context is added to published message attributes
+and HTTP request headers, so consumers can continue the trace.
+
+If -debug-addr is set, scheduler serves the net/http/pprof profiling
+endpoints under /debug/pprof/ on the given address.
+
+On platforms that support it, sending scheduler SIGUSR2 quiesces it;
+jobs are not run, but topics are retained and scheduler continues
+running. Sending a second SIGUSR2 resumes running jobs.
+
+If -dry-run is set, scheduler does not connect to Pub/Sub or run any
+jobs, but prints a timeline of the executions that would be made within
+-horizon, giving the time, job, destination and payload of each.
+
+If -exit-when-done is set, scheduler exits once every job with a
+bounded number of runs has completed. Bounded jobs are one-shot jobs,
+jobs with maxruns set and jobs with a counted ISO 8601 repeating
+interval.
+
+If -reuse-topics is set, topics that already exist, such as those left
+by an earlier run, are used instead of skipping the jobs that publish to
+them. Only topics created by scheduler are deleted when it exits.
+
+If -require-subscribers is set, scheduler waits up to
+-require-subscribers-timeout after creating its topics for every
+configured topic to have a subscription, and exits with status 1 if any
+do not. Topics created by scheduler have no subscriptions until a
+subscriber such as listener subscribes to them, so subscribers must be
+started alongside scheduler, or -reuse-topics used with existing
+subscribed topics. Topics created from templates at run time are not
+checked.
+
+On platforms that support it, sending scheduler SIGHUP reloads the
+job configuration. Jobs that have been added, removed or changed are
+updated without restarting; other jobs and their topics are untouched.
+Jobs in dependency chains are not reloaded, and changes to the top-level
+configuration require a restart. If -watch is set, the configuration
+is polled at the given interval and reloaded in the same way when it
+changes.
+
+The -reload-failure flag determines what happens when a reload fails
+because the configuration cannot be read or is invalid, or because a
+job cannot be added. With keep, the default, the failure is logged and
+scheduler continues with the jobs it has; valid jobs in the new
+configuration are still applied. With halt, scheduler shuts down as it
+does on SIGTERM and exits with status 1, so that a supervisor can
+restart it.
+
+On SIGINT or SIGTERM, scheduler stops scheduling jobs and waits up to
+-shutdown-grace for running jobs to finish publishing before deleting
+its topics and exiting. A second signal stops the wait. Executions
+still waiting for their -publish-latency delay are abandoned.
+
+If -keep-topics is set, the topics and schemas created by scheduler are
+not deleted when it exits, so emulator state is preserved for other
+tools and later runs. Later runs should also set -reuse-topics.
+
+If -grpc-addr is set, scheduler serves the Cloud Scheduler v1 gRPC API,
+allowing jobs to be listed, created, deleted, paused, resumed and run
+with the Cloud Scheduler client libraries.
+
+If -admin is set, scheduler serves a JSON admin API over TCP for
+listing jobs and their previous and next run times, pausing, resuming
+and removing jobs and running jobs immediately. If -control is set, the
+same API is served on a unix socket:
+
+ GET    /jobs                list jobs
+ GET    /jobs/NAME           get a job
+ DELETE /jobs/NAME           remove a job (?topics=true deletes its topics)
+ POST   /jobs/NAME/pause     pause a job
+ POST   /jobs/NAME/resume    resume a job
+ POST   /jobs/NAME/run       run a job immediately
+ GET    /clock               get the virtual clock time
+ POST   /clock/advance?to=T  advance the virtual clock to T
+
+Removing a job leaves the other jobs running. With topics=true, the
+job's topics that were created by scheduler and are not used by another
+job are also deleted.
+
+A job can be run immediately, out of its schedule, by running
+
+ $ scheduler run-now -control /tmp/scheduler.sock jobname
+
+To convert an App Engine cron.yaml file into a scheduler config, run
+
+ $ scheduler import -project testing cron.yaml > jobs.yaml
+
+To check configuration files for unknown fields and invalid schedules,
+timezones, durations and targets, run
+
+ $ scheduler validate jobs.yaml
+
+To print the next fire times of each configured job, run
+
+ $ scheduler preview -conf jobs.yaml -n 10
+
+If -report is set, a JSON summary of the run is written to the given
+file when scheduler exits. It holds, for each job, the number of
+publishes and failures, the first and last fire times and publish
+latency percentiles.
+
+If -fail-on-publish-error is set, scheduler exits with status 1 if any
+publish or HTTP request failed, including attempts that were retried.
+If -min-publishes is set, scheduler exits with status 1 if fewer than
+the given number of publishes and HTTP requests succeeded over all jobs
+before it exited. Together with -timeout, these make a run an assertion
+in CI pipelines.
+
+If -history is set, each job execution is recorded in the given
+database file. The recorded executions of a job can be printed as
+JSON lines with
+
+ $ scheduler history -admin localhost:8080 jobname
+
+or, once scheduler has exited, with
+
+ $ scheduler history -history history.db jobname
+
+The executions of all jobs can be printed in the order they started,
+as a table or with -csv as CSV, with
+
+ $ scheduler timeline -history history.db
+
+To export the schedule of the configured jobs as an iCalendar file,
+run
+
+ $ scheduler ical -conf jobs.yaml -horizon 7d > jobs.ics
+
+Events are in each job's time zone, and a VTIMEZONE is written for each
+time zone used.
+
+Messages captured by listener with -capture can be published again,
+with their attributes and ordering keys, by running
+
+ $ scheduler replay -project testing capture.jsonl
+
+With -speed, replay reproduces the captured intervals between publish
+times, scaled by the given rate.
+
+To check that scheduler can publish and receive messages end to end
+without the gcloud emulator, run
+
+ $ scheduler selftest
+
 See https://cloud.google.com/pubsub/docs/emulator for more documentation
 about the gcloud emulator.
 
 `)
 		os.Exit(0)
 	}
-	if *conf == "" {
+	if (*conf == "") == (*confDir == "") {
 		flag.Usage()
 		os.Exit(2)
 	}
+	splayDistribution, err := parseDistribution(*splayDist)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid splay: %v\n", err)
+		os.Exit(2)
+	}
+	logger, err := cli.NewLogger(os.Stderr, *logFormat, *logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+	switch *reloadFailure {
+	case "keep", "halt":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid reload failure action: %q\n", *reloadFailure)
+		os.Exit(2)
+	}
 
-	f, err := os.Open(*conf)
+	cfg, err := load(*conf, *confDir, *format)
 	if err != nil {
-		log.Fatalf("failed to read schedule config: %v", err)
+		cli.Fatal("failed to load schedule config", "err", err)
 	}
-	defer f.Close()
-	dec := yaml.NewDecoder(f)
-	var cfg config
-	err = dec.Decode(&cfg)
+	if *project != "" {
+		cfg.Project = *project
+	}
+	conn.Apply(&cfg.PubSub)
+	for _, j := range cfg.Jobs {
+		if !j.enabled() {
+			slog.Info("job disabled", "job", j.Name)
+		}
+	}
+	cfg.Jobs = selectJobs(cfg.Jobs, only, skip)
+	rnd = newLockedRand(*seed)
+	if *speed < 0 {
+		fmt.Fprintln(os.Stderr, "invalid negative -speed")
+		os.Exit(2)
+	}
+	if *speed != 1 {
+		clock = schedule.NewClock(time.Time{}, *speed)
+	}
+	err = checkDependencies(cfg.Jobs)
 	if err != nil {
-		log.Fatalf("failed to parse schedule config: %v", err)
+		cli.Fatal("invalid job dependencies", "err", err)
 	}
 
-	client, err := pubsub.NewClient(context.Background(), cfg.Project) // googleapi options?
+	dstPeriod, err := parseHorizon(*dstHorizon)
 	if err != nil {
-		log.Fatalf("failed to create pubsub client: %v", err)
+		cli.Fatal("invalid daylight saving horizon", "err", err)
+	}
+
+	if *dryRun {
+		d, err := parseHorizon(*horizon)
+		if err != nil {
+			cli.Fatal("invalid horizon", "err", err)
+		}
+		err = writeTimeline(os.Stdout, cfg, clock.Now(), d, 1000)
+		if err != nil {
+			cli.Fatal("failed to write timeline", "err", err)
+		}
+		return
+	}
+
+	var suffix string
+	if *uniqueSuffix {
+		suffix = "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+		slog.Info("using topic suffix", "suffix", suffix)
+		for i := range cfg.Jobs {
+			cfg.Jobs[i].Target.addSuffix(suffix)
+		}
+		if *errTopic != "" {
+			*errTopic += suffix
+		}
 	}
-	defer client.Close()
 
-	var topics []*pubsub.Topic
-	c := cron.New()
+	// Set by the run assertions and applied
+	// after all other deferred clean-up.
+	var exitCode int
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
+	// The emulator started by -start-emulator would
+	// outlive scheduler if it exited without stopping
+	// it, so exit and fatal must be used in place of
+	// os.Exit and cli.Fatal from here on.
+	var emu *emulator
+	exit := func(code int) {
+		if emu != nil {
+			emu.stop()
+		}
+		os.Exit(code)
+	}
+	fatal := func(msg string, args ...any) {
+		slog.Error(msg, args...)
+		exit(1)
+	}
+
+	if *startEmu {
+		if *builtin {
+			fmt.Fprintln(os.Stderr, "-start-emulator and -builtin-pubsub are mutually exclusive")
+			exit(2)
+		}
+		slog.Info("starting pubsub emulator")
+		emu, err = startEmulator(cfg.Project, *emuTimeout)
+		if err != nil {
+			fatal("failed to start pubsub emulator", "err", err)
+		}
+		defer emu.stop()
+		slog.Info("pubsub emulator listening", "addr", emu.addr)
+	}
+	if *builtin {
+		srv, err := startBuiltinPubsub(*builtinPort)
+		if err != nil {
+			fatal("failed to start builtin pubsub", "err", err)
+		}
+		defer srv.Close()
+		slog.Info("serving builtin pubsub", "addr", srv.Addr)
+	}
+
+	if *waitEmu != 0 {
+		addr := os.Getenv("PUBSUB_EMULATOR_HOST")
+		if addr == "" {
+			addr = cfg.PubSub.Endpoint
+		}
+		if addr == "" {
+			fmt.Fprintln(os.Stderr, "-wait-for-emulator requires PUBSUB_EMULATOR_HOST or a pubsub endpoint")
+			exit(2)
+		}
+		slog.Info("waiting for pubsub emulator", "addr", addr)
+		err := waitForAddr(addr, *waitEmu)
+		if err != nil {
+			fatal("pubsub emulator not ready", "err", err)
+		}
+	}
+
+	if *otlpEndpoint != "" {
+		shutdown, err := cli.StartTracing(context.Background(), *otlpEndpoint, "scheduler")
+		if err != nil {
+			fatal("failed to start tracing", "err", err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err := shutdown(ctx)
+			if err != nil {
+				slog.Error("failed to flush traces", "err", err)
+			}
+		}()
+	}
+
+	pub, err := newPublisher(context.Background(), cfg.Project, *reconnects, *maxDynamic, cfg.PubSub.Options()...)
+	if err != nil {
+		fatal("failed to create pubsub client", "err", err)
+	}
+	pub.reuse = *reuseTopics
+	defer pub.close()
+
+	if *debugAddr != "" {
+		srv, addr, err := cli.ServeDebug(*debugAddr)
+		if err != nil {
+			fatal("failed to serve debug endpoints", "err", err)
+		}
+		defer srv.Close()
+		slog.Info("serving pprof debug endpoints", "addr", addr.String())
+	}
+	var promReg prometheus.Registerer
+	if *metricsAddr != "" || *pushURL != "" {
+		r := prometheus.NewRegistry()
+		if *metricsAddr != "" {
+			srv, addr, err := cli.ServeMetrics(*metricsAddr, r)
+			if err != nil {
+				fatal("failed to serve metrics", "err", err)
+			}
+			defer srv.Close()
+			slog.Info("serving metrics", "addr", addr.String())
+		}
+		if *pushURL != "" {
+			p := startPush(*pushURL, *pushJob, r, *pushEvery)
+			defer p.stop()
+			slog.Info("pushing metrics", "url", *pushURL, "job", *pushJob)
+		}
+		promReg = r
+	}
+	stats, err := newMetrics(*statsdAddr, promReg)
+	if err != nil {
+		fatal("failed to create metrics sink", "err", err)
+	}
+	defer stats.close()
+	pub.stats = stats
+	var rt *e2e
+	if roundTrip {
+		rt = newE2E()
+		pub.published = rt.published
+	}
+
+	loc, err := cfg.location()
+	if err != nil {
+		fatal("failed to load time zone", "err", err)
+	}
+
+	if *errTopic != "" {
+		err := pub.createTopic(context.Background(), *errTopic, topicSettings{})
+		if err != nil {
+			fatal("failed to create error topic", "topic", *errTopic, "err", err)
+		}
+	}
+
+	quiesce := newQuiescer()
+	defer quiesce.stop()
+
+	// shutdown is cancelled when scheduler stops
+	// scheduling jobs on a signal, timeout or
+	// completion of its bounded jobs.
+	shutdown, startShutdown := context.WithCancel(context.Background())
+	defer startShutdown()
+	// A publisher waiting to reconnect must not
+	// hold up shutdown.
+	context.AfterFunc(shutdown, pub.abandonReconnect)
+
+	s, err := schedule.New(schedule.Config{Location: loc, Clock: clock})
+	if err != nil {
+		fatal("failed to create scheduler", "err", err)
+	}
+	env := &jobEnv{
+		pub:        pub,
+		client:     &http.Client{},
+		stats:      stats,
+		latency:    &pubLatency,
+		shutdown:   shutdown,
+		attributes: cfg.Attributes,
+		appEngine:  cfg.AppEngine,
+		splay:      *splay,
+		splayDist:  splayDistribution,
+	}
+	if *injectSeq {
+		env.sequence = newSequencer()
+	}
+	var state *stateFile
+	if *statePath != "" {
+		state, err = loadState(*statePath)
+		if err != nil {
+			slog.Error("failed to load state", "err", err)
+			pub.stop()
+			exit(1)
+		}
+	}
+	if *historyPath != "" {
+		env.history, err = openHistory(*historyPath, false)
+		if err != nil {
+			slog.Error("failed to open history", "err", err)
+			pub.stop()
+			exit(1)
+		}
+		defer env.history.close()
+	}
+	reg := newRegistry(s, env, *errTopic, quiesce, state)
 	for _, j := range cfg.Jobs {
-		j := j
-		if strings.ToLower(j.Target.Destination) != "pub/sub" {
+		if j.Target.destination() == unknownDestination {
+			slog.Warn("skipping job: unsupported destination", "job", j.Name, "destination", j.Target.Destination)
 			continue
 		}
-		cronspec := j.Frequency
-		if j.Timezone != "" {
-			cronspec = fmt.Sprintf("CRON_TZ=%s %s", j.Timezone, j.Frequency)
-		}
-		t, err := client.CreateTopic(context.Background(), j.Target.Topic)
+		err := reg.add(context.Background(), j, j.Paused)
 		if err != nil {
-			if grpc.Code(err) == codes.AlreadyExists {
-				log.Printf("topic %q already exists", j.Target.Topic)
+			if grpc.Code(errors.Unwrap(err)) == codes.AlreadyExists || errors.Is(err, errJobExpired) {
+				slog.Warn("skipping job", "job", j.Name, "err", err)
 				continue
 			}
-			log.Printf("failed to publish topic %q: %v", j.Target.Topic, err)
+			slog.Error("failed to register job", "job", j.Name, "err", err)
 			// Clean-up and exit with a failure.
-			for _, t := range topics {
-				t.Stop()
-			}
-			os.Exit(1)
+			pub.stop()
+			exit(1)
+		}
+	}
+	reg.linkDependents()
+	if dstPeriod > 0 {
+		now := clock.Now()
+		logDSTEffects(cfg.Jobs, loc, now, now.Add(dstPeriod))
+	}
+
+	if *grpcAddr != "" {
+		l, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			slog.Error("failed to listen for Cloud Scheduler API", "err", err)
+			pub.stop()
+			exit(1)
 		}
-		_, err = c.AddFunc(cronspec, func() {
-			res := t.Publish(context.Background(), &pubsub.Message{Data: []byte(j.Payload)})
-			id, err := res.Get(context.Background())
+		srv := grpc.NewServer()
+		schedulerpb.RegisterCloudSchedulerServer(srv, newCloudScheduler(reg, parentName(cfg.Project, *location)))
+		go func() {
+			err := srv.Serve(l)
 			if err != nil {
-				log.Printf("failed to publish %q: %v", j.Name, err)
-				return
+				slog.Error("Cloud Scheduler API server failed", "err", err)
+			}
+		}()
+		defer srv.Stop()
+		slog.Info("serving Cloud Scheduler API", "addr", l.Addr().String())
+	}
+
+	for network, addr := range map[string]string{"tcp": *adminAddr, "unix": *control} {
+		if addr == "" {
+			continue
+		}
+		srv, addr, err := serveAdmin(network, addr, reg)
+		if err != nil {
+			slog.Error("failed to serve admin API", "err", err)
+			pub.stop()
+			exit(1)
+		}
+		defer srv.Close()
+		slog.Info("serving admin API", "addr", addr)
+	}
+
+	if *waitListener != "" {
+		slog.Info("waiting for listener ready file", "path", *waitListener)
+		err := waitForFile(*waitListener, *waitListenerTimeout)
+		if err != nil {
+			slog.Error("listener did not become ready", "err", err)
+			if !*keepTopics {
+				err = pub.deleteTopics(context.Background())
+				if err != nil {
+					slog.Error("failed to delete topic", "err", err)
+				}
 			}
-			log.Printf("published %q id=%s", j.Name, id)
-		})
+			exitCode = 1
+			return
+		}
+	}
+
+	if *requireSubs {
+		slog.Info("waiting for topic subscriptions", "timeout", *requireSubsTimeout)
+		ids, err := waitForSubscribers(context.Background(), pub, *requireSubsTimeout)
 		if err != nil {
-			log.Printf("error in cronspec for %q: %v", j.Name, err)
-			for _, t := range topics {
-				t.Stop()
+			slog.Error("failed to check topic subscriptions", "err", err)
+			pub.stop()
+			exitCode = 1
+			return
+		}
+		if len(ids) != 0 {
+			slog.Error("topics without subscriptions", "topics", ids, "timeout", *requireSubsTimeout)
+			if !*keepTopics {
+				err = pub.deleteTopics(context.Background())
+				if err != nil {
+					slog.Error("failed to delete topic", "err", err)
+				}
 			}
-			os.Exit(1)
+			exitCode = 1
+			return
 		}
-		topics = append(topics, t)
 	}
 
-	// Handle interrupt signal.
+	// Handle interrupt and termination signals.
 	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, os.Interrupt)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
 
-	// Start cron.
-	c.Start()
+	// Handle reload signals and config changes.
+	reload := make(chan os.Signal, 1)
+	if len(reloadSignals) != 0 {
+		signal.Notify(reload, reloadSignals...)
+	}
+	var changed <-chan struct{}
+	if *watch > 0 {
+		changed = watchConfig(*conf, *confDir, *format, *watch)
+	}
+	// reloadConfig reloads the job configuration, returning
+	// whether the reload failed and -reload-failure requires
+	// scheduler to halt.
+	reloadConfig := func() (halt bool) {
+		next, err := load(*conf, *confDir, *format)
+		if err != nil {
+			slog.Error("failed to reload schedule config", "err", err)
+			return *reloadFailure == "halt"
+		}
+		next.Jobs = selectJobs(next.Jobs, only, skip)
+		if suffix != "" {
+			for i := range next.Jobs {
+				next.Jobs[i].Target.addSuffix(suffix)
+			}
+		}
+		failed, err := reg.reload(context.Background(), cfg.Jobs, next.Jobs)
+		if err != nil {
+			slog.Error("failed to reload schedule config", "err", err)
+			return *reloadFailure == "halt"
+		}
+		cfg.Jobs = next.Jobs
+		if failed != nil {
+			slog.Error("failed to reload jobs", "jobs", failed)
+			return *reloadFailure == "halt"
+		}
+		return false
+	}
+
+	// Announce registered jobs and start the scheduler.
+	logRegistered(reg.events())
+	if rt != nil {
+		err = rt.start(pub.topicIDs(), cfg.PubSub.Options())
+		if err != nil {
+			fatal("failed to start e2e subscriber", "err", err)
+		}
+	}
+	start := clock.Now()
+	err = s.Start(context.Background())
+	if err != nil {
+		fatal("failed to start scheduler", "err", err)
+	}
+	reg.catchUp()
+	reg.runAtStart()
 
 	// Wait for cancellation or timeout.
 	var timeout <-chan time.Time
@@ -141,44 +786,108 @@ about the gcloud emulator.
 		// Dirty, but the program is terminating.
 		timeout = time.NewTimer(*duration).C
 	}
+	var done <-chan struct{}
+	if *exitWhenDone {
+		var ok bool
+		done, ok = reg.done()
+		if !ok {
+			slog.Warn("no jobs with a bounded number of runs: ignoring -exit-when-done")
+			done = nil
+		}
+	}
+wait:
+	for {
+		select {
+		case <-ch:
+			break wait
+		case <-timeout:
+			break wait
+		case <-done:
+			slog.Info("all bounded jobs completed")
+			break wait
+		case <-reload:
+			slog.Info("reloading schedule config")
+			if reloadConfig() {
+				slog.Error("halting after failed reload")
+				exitCode = 1
+				break wait
+			}
+		case <-changed:
+			slog.Info("schedule config changed: reloading")
+			if reloadConfig() {
+				slog.Error("halting after failed reload")
+				exitCode = 1
+				break wait
+			}
+		}
+	}
+	signal.Stop(reload)
+	startShutdown()
+	fmt.Println("cancelling")
+
+	// Stop the scheduler and wait for running
+	// jobs to resolve their publishes, then flush
+	// any messages still held by the publisher.
+	running := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(running)
+	}()
 	select {
+	case <-running:
+	case <-time.After(*grace):
+		slog.Warn("jobs still running after shutdown grace period", "grace", *grace)
 	case <-ch:
-	case <-timeout:
+		slog.Warn("not waiting for running jobs")
+	}
+	pub.stop()
+	if rt != nil {
+		received, lost := rt.stop(*e2eDrain)
+		slog.Info("e2e summary", "received", received, "lost", lost)
+		if lost != 0 {
+			slog.Error("published messages not received", "count", lost, "drain", *e2eDrain)
+			exitCode = 1
+		}
 	}
-	fmt.Println("cancelling")
 
-	// Stop cron.
-	c.Stop()
+	// Report weighted topic distributions.
+	for _, j := range cfg.Jobs {
+		if len(j.Target.Topics) != 0 {
+			stats.logDistribution(j.Name, j.Target.topicIDs())
+		}
+	}
+
+	if *reportPath != "" {
+		names := make([]string, len(cfg.Jobs))
+		for i, j := range cfg.Jobs {
+			names[i] = j.Name
+		}
+		err = stats.writeReport(*reportPath, start, names)
+		if err != nil {
+			slog.Error("failed to write report", "err", err)
+		}
+	}
 
 	// Delete pub topics.
-	for _, t := range topics {
-		log.Printf("deleting %v", t)
-		err := t.Delete(context.Background())
+	if *keepTopics {
+		slog.Info("keeping topics")
+	} else {
+		err = pub.deleteTopics(context.Background())
 		if err != nil {
-			log.Fatalf("failed to delete topic: %v", err)
+			fatal("failed to delete topic", "err", err)
 		}
 	}
 
 	// Release signal.
 	signal.Stop(ch)
-}
 
-// See https://cloud.google.com/scheduler/docs/quickstart#create_a_job
-type config struct {
-	Project string
-	Jobs    []job
-}
-
-type job struct {
-	Name        string
-	Description string
-	Frequency   string
-	Timezone    string // Local if empty.
-	Target      target
-	Payload     string
-}
-
-type target struct {
-	Destination string // Currently only supports Pub/Sub.
-	Topic       string
+	published, failed := stats.totals()
+	if *failOnError && failed != 0 {
+		slog.Error("publishes failed", "count", failed)
+		exitCode = 1
+	}
+	if published < *minPublishes {
+		slog.Error("too few publishes", "count", published, "min", *minPublishes)
+		exitCode = 1
+	}
 }
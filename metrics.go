@@ -0,0 +1,326 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// metrics holds the internal publish counters for the scheduler and
+// emits them to the configured sinks.
+type metrics struct {
+	mu        sync.Mutex
+	published map[jobTopic]int
+	failed    map[jobTopic]int
+	jobs      map[string]*jobSummary
+
+	// statsd is the StatsD sink. No metrics are
+	// emitted to StatsD if it is nil.
+	statsd net.Conn
+
+	// prom holds the Prometheus collectors. No
+	// metrics are exported to Prometheus if it
+	// is nil.
+	prom *promMetrics
+}
+
+// promMetrics holds the scheduler's Prometheus collectors.
+type promMetrics struct {
+	published     *prometheus.CounterVec
+	failed        *prometheus.CounterVec
+	latency       *prometheus.HistogramVec
+	lag           *prometheus.HistogramVec
+	topicsCreated *prometheus.CounterVec
+}
+
+// newPromMetrics returns a new promMetrics registered with reg.
+func newPromMetrics(reg prometheus.Registerer) (*promMetrics, error) {
+	m := &promMetrics{
+		published: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "scheduler_publishes_total",
+			Help: "Number of successful job executions.",
+		}, []string{"job", "topic"}),
+		failed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "scheduler_publish_failures_total",
+			Help: "Number of failed job executions.",
+		}, []string{"job", "topic"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "scheduler_publish_latency_seconds",
+			Help: "Latency of successful job executions.",
+		}, []string{"job"}),
+		lag: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "scheduler_schedule_lag_seconds",
+			Help:    "Delay between the scheduled and actual start of job invocations.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}, []string{"job"}),
+		topicsCreated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "scheduler_topics_created_total",
+			Help: "Number of topics created.",
+		}, []string{"project"}),
+	}
+	for _, c := range []prometheus.Collector{m.published, m.failed, m.latency, m.lag, m.topicsCreated} {
+		err := reg.Register(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// jobTopic is a metric key.
+type jobTopic struct {
+	job, topic string
+}
+
+// newMetrics returns a new metrics. If statsdAddr is not empty, metrics
+// are emitted as DogStatsD UDP packets to the provided address. If reg
+// is not nil, metrics are exported to Prometheus via reg.
+func newMetrics(statsdAddr string, reg prometheus.Registerer) (*metrics, error) {
+	m := &metrics{
+		published: make(map[jobTopic]int),
+		failed:    make(map[jobTopic]int),
+		jobs:      make(map[string]*jobSummary),
+	}
+	if statsdAddr != "" {
+		var err error
+		m.statsd, err = net.Dial("udp", statsdAddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if reg != nil {
+		var err error
+		m.prom, err = newPromMetrics(reg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// publish records the outcome of a publish for the given job and topic.
+func (m *metrics) publish(job, topic string, latency time.Duration, err error) {
+	key := jobTopic{job: job, topic: topic}
+	m.mu.Lock()
+	s := m.summary(job)
+	if err != nil {
+		m.failed[key]++
+		s.failed++
+	} else {
+		m.published[key]++
+		s.published++
+		s.latencies = append(s.latencies, latency)
+	}
+	m.mu.Unlock()
+
+	if m.prom != nil {
+		if err != nil {
+			m.prom.failed.WithLabelValues(job, topic).Inc()
+		} else {
+			m.prom.published.WithLabelValues(job, topic).Inc()
+			m.prom.latency.WithLabelValues(job).Observe(latency.Seconds())
+		}
+	}
+
+	if m.statsd == nil {
+		return
+	}
+	tags := fmt.Sprintf("#job:%s,topic:%s", statsdTag(job), statsdTag(topic))
+	if err != nil {
+		m.emit("scheduler.publish.failed:1|c|" + tags)
+		return
+	}
+	m.emit("scheduler.publish.count:1|c|" + tags)
+	m.emit(fmt.Sprintf("scheduler.publish.latency:%g|ms|%s", float64(latency)/float64(time.Millisecond), tags))
+}
+
+// fired records the firing of the named job at time t.
+func (m *metrics) fired(job string, t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.summary(job)
+	if s.first.IsZero() {
+		s.first = t
+	}
+	s.last = t
+}
+
+// summary returns the summary for the named job, creating it if
+// necessary. It must be called with m.mu held.
+func (m *metrics) summary(job string) *jobSummary {
+	s, ok := m.jobs[job]
+	if !ok {
+		s = &jobSummary{}
+		m.jobs[job] = s
+	}
+	return s
+}
+
+// totals returns the total number of successful and failed publishes
+// over all jobs.
+func (m *metrics) totals() (published, failed int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.jobs {
+		published += s.published
+		failed += s.failed
+	}
+	return published, failed
+}
+
+// scheduleLag records the delay between the scheduled and actual start
+// of an invocation of the named job.
+func (m *metrics) scheduleLag(job string, lag time.Duration) {
+	if m.prom == nil {
+		return
+	}
+	m.prom.lag.WithLabelValues(job).Observe(lag.Seconds())
+}
+
+// topicCreated records the creation of a topic in the given project.
+func (m *metrics) topicCreated(project string) {
+	if m.prom == nil {
+		return
+	}
+	m.prom.topicsCreated.WithLabelValues(project).Inc()
+}
+
+// logDistribution logs the distribution of successful publishes for the
+// named job over the provided topics.
+func (m *metrics) logDistribution(job string, topics []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var total int
+	for _, t := range topics {
+		total += m.published[jobTopic{job: job, topic: t}]
+	}
+	for _, t := range topics {
+		n := m.published[jobTopic{job: job, topic: t}]
+		var frac float64
+		if total != 0 {
+			frac = float64(n) / float64(total)
+		}
+		slog.Info("topic distribution", "job", job, "topic", t, "published", n, "total", total, "fraction", frac)
+	}
+}
+
+// emit sends a single StatsD packet.
+func (m *metrics) emit(packet string) {
+	_, err := m.statsd.Write([]byte(packet))
+	if err != nil {
+		slog.Error("failed to emit statsd metric", "err", err)
+	}
+}
+
+// close releases the resources held by the metrics sinks.
+func (m *metrics) close() error {
+	if m.statsd == nil {
+		return nil
+	}
+	return m.statsd.Close()
+}
+
+// statsdTag returns s with characters that are not valid in DogStatsD
+// tag values replaced by underscores.
+func statsdTag(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			return r
+		case r == '_', r == '-', r == '.', r == '/', r == ':':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
+
+// gatewayPusher pushes the metrics gathered from a Prometheus registry to
+// a Pushgateway.
+type gatewayPusher struct {
+	pusher *push.Pusher
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// startPush returns a gatewayPusher pushing the metrics gathered by g to
+// the Pushgateway at url, grouped under the given job label. The job
+// labels of the metrics are renamed to exported_job. If every is
+// positive, metrics are pushed at that interval until the pusher is
+// stopped.
+func startPush(url, job string, g prometheus.Gatherer, every time.Duration) *gatewayPusher {
+	p := &gatewayPusher{
+		pusher: push.New(url, job).Gatherer(exportJob{g}).Client(&http.Client{Timeout: 10 * time.Second}),
+		done:   make(chan struct{}),
+	}
+	if every > 0 {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			ticker := time.NewTicker(every)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					p.push()
+				case <-p.done:
+					return
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// stop stops periodic pushes and pushes the final metrics.
+func (p *gatewayPusher) stop() {
+	close(p.done)
+	p.wg.Wait()
+	p.push()
+}
+
+// push pushes the current metrics, replacing those previously pushed for
+// the job.
+func (p *gatewayPusher) push() {
+	err := p.pusher.Push()
+	if err != nil {
+		slog.Error("failed to push metrics", "err", err)
+		return
+	}
+	slog.Debug("pushed metrics")
+}
+
+// exportJob is a prometheus.Gatherer that renames the job label of the
+// metrics it gathers to exported_job, as Prometheus does for conflicting
+// labels when scraping. The Pushgateway reserves the job label for the
+// grouping key.
+type exportJob struct {
+	prometheus.Gatherer
+}
+
+func (g exportJob) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			for _, l := range m.Label {
+				if l.GetName() == "job" {
+					name := "exported_job"
+					l.Name = &name
+				}
+			}
+		}
+	}
+	return mfs, err
+}
@@ -0,0 +1,98 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/kortschak/scheduler/internal/cli"
+	"github.com/kortschak/scheduler/schedule"
+)
+
+// preview runs the preview subcommand.
+func preview(args []string) {
+	flags := flag.NewFlagSet("preview", flag.ExitOnError)
+	conf := flags.String("conf", "", "specify config file, directory, glob pattern, URL or - for stdin (required unless -conf-dir is set)")
+	confDir := flags.String("conf-dir", "", "specify directory of configs to merge")
+	format := flags.String("format", "", "specify config format (yaml, json or toml; determined from file extensions if empty)")
+	var only, skip selectors
+	flags.Var(&only, "only", "include only jobs matching a key=pattern selector, where key is name or a label key (may be repeated)")
+	flags.Var(&skip, "skip", "exclude jobs matching a key=pattern selector, where key is name or a label key (may be repeated)")
+	n := flags.Int("n", 5, "specify number of fire times to print per job")
+	flags.Parse(args)
+	if (*conf == "") == (*confDir == "") || *n < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := load(*conf, *confDir, *format)
+	if err != nil {
+		cli.Fatal("failed to load schedule config", "err", err)
+	}
+	cfg.Jobs = selectJobs(cfg.Jobs, only, skip)
+	err = writePreview(os.Stdout, cfg, time.Now(), *n)
+	if err != nil {
+		cli.Fatal("failed to preview schedules", "err", err)
+	}
+}
+
+// writePreview writes the next n fire times after now of each job in cfg
+// to w. Times are written in the job's location.
+func writePreview(w io.Writer, cfg config, now time.Time, n int) error {
+	loc, err := cfg.location()
+	if err != nil {
+		return err
+	}
+	now = now.In(loc)
+
+	bw := bufio.NewWriter(w)
+	for i, j := range cfg.Jobs {
+		if i != 0 {
+			fmt.Fprintln(bw)
+		}
+		jloc, err := j.location(loc)
+		if err != nil {
+			return fmt.Errorf("invalid timezone for %q: %w", j.Name, err)
+		}
+		switch {
+		case j.DependsOn != "":
+			fmt.Fprintf(bw, "%s: runs after %s\n", j.Name, j.DependsOn)
+			continue
+		case !j.At.IsZero():
+			fmt.Fprintf(bw, "%s: at %s\n", j.Name, j.At.Format(time.RFC3339))
+		default:
+			fmt.Fprintf(bw, "%s: %q (%s)\n", j.Name, j.Frequency, jloc)
+		}
+		sched, err := j.schedule()
+		if err != nil {
+			return fmt.Errorf("error in cronspec for %q: %w", j.Name, err)
+		}
+		if j.Paused {
+			fmt.Fprintln(bw, "\tpaused")
+		}
+		runs := nextRuns(sched, now, time.Unix(1<<62, 0), n)
+		if len(runs) == 0 {
+			fmt.Fprintln(bw, "\tno future fire times")
+		}
+		for _, t := range runs {
+			note := ""
+			if !j.inWindow(t) {
+				note = " (outside window)"
+			}
+			fmt.Fprintf(bw, "\t%s%s\n", t.In(jloc).Format("2006-01-02 15:04:05 MST Mon"), note)
+		}
+		if len(runs) != 0 {
+			for _, e := range schedule.DSTEffects(sched, now.In(jloc), runs[len(runs)-1]) {
+				fmt.Fprintf(bw, "\t%s\n", describeDST(e, jloc))
+			}
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,66 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// protoPayload specifies a protobuf message type used to encode a JSON
+// payload.
+type protoPayload struct {
+	Descriptor string // Path to a FileDescriptorSet file.
+	Message    string // Fully qualified message name.
+}
+
+// messageType returns the message descriptor for the payload's message
+// type.
+func (p *protoPayload) messageType() (protoreflect.MessageDescriptor, error) {
+	b, err := os.ReadFile(p.Descriptor)
+	if err != nil {
+		return nil, err
+	}
+	var set descriptorpb.FileDescriptorSet
+	err = proto.Unmarshal(b, &set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor set %s: %w", p.Descriptor, err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor set %s: %w", p.Descriptor, err)
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(p.Message))
+	if err != nil {
+		return nil, fmt.Errorf("no message %s in %s: %w", p.Message, p.Descriptor, err)
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s in %s is not a message", p.Message, p.Descriptor)
+	}
+	return md, nil
+}
+
+// encode returns the binary protobuf encoding of the JSON message in
+// data.
+func (p *protoPayload) encode(data []byte) ([]byte, error) {
+	md, err := p.messageType()
+	if err != nil {
+		return nil, err
+	}
+	m := dynamicpb.NewMessage(md)
+	err = protojson.Unmarshal(data, m)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s payload: %w", p.Message, err)
+	}
+	return proto.Marshal(m)
+}
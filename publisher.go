@@ -0,0 +1,712 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// publisher publishes messages to a set of Pub/Sub topics. If the
+// Pub/Sub server becomes unavailable, the publisher reconnects and
+// resumes publishing once connectivity returns.
+type publisher struct {
+	project string
+	opts    []option.ClientOption
+
+	// attempts is the maximum number of reconnection
+	// attempts made after the server becomes unavailable.
+	attempts int
+
+	// maxDynamic is the maximum number of topics
+	// that may be created by ensureTopic.
+	maxDynamic int
+
+	// reuse specifies that topics that already
+	// exist are used rather than failing.
+	reuse bool
+
+	// stats records topic creation if not nil.
+	stats *metrics
+
+	// published is called with the ID of each
+	// published message if it is not nil.
+	published func(id string)
+
+	mu       sync.Mutex
+	client   *pubsub.Client
+	topics   map[string]*pubsub.Topic
+	settings map[string]topicSettings
+	created  map[string]bool          // created holds the IDs of topics created by the publisher.
+	dynamic  int                      // dynamic is the number of topics created or being created by ensureTopic.
+	pending  map[string]chan struct{} // pending holds channels closed when ensureTopic's creation of a topic ends.
+	gen      int                      // gen is incremented on each reconnection.
+
+	// recovering is true while a reconnection or
+	// recreation is in progress. Recovery makes its
+	// network calls without holding mu.
+	recovering bool
+
+	// abandoned is cancelled by abandonReconnect
+	// to end any reconnection in progress.
+	abandoned context.Context
+	abandon   context.CancelFunc
+
+	// schemas is created when the first schema is
+	// created. schemaIDs holds the IDs of the schemas
+	// created by the publisher, and schemaConfigs holds
+	// the configs of all the schemas it has used.
+	schemas       *pubsub.SchemaClient
+	schemaIDs     []string
+	schemaConfigs map[string]pubsub.SchemaConfig
+
+	// projects holds the publishers for jobs
+	// publishing to other projects, keyed by
+	// project ID.
+	projects map[string]*publisher
+}
+
+// newPublisher returns a new publisher for the given project.
+func newPublisher(ctx context.Context, project string, attempts, maxDynamic int, opts ...option.ClientOption) (*publisher, error) {
+	client, err := pubsub.NewClient(ctx, project, opts...)
+	if err != nil {
+		return nil, err
+	}
+	abandoned, abandon := context.WithCancel(context.Background())
+	return &publisher{
+		project:    project,
+		opts:       opts,
+		attempts:   attempts,
+		maxDynamic: maxDynamic,
+		client:     client,
+		topics:     make(map[string]*pubsub.Topic),
+		settings:   make(map[string]topicSettings),
+		created:    make(map[string]bool),
+		pending:    make(map[string]chan struct{}),
+		abandoned:  abandoned,
+		abandon:    abandon,
+	}, nil
+}
+
+// forProject returns the publisher for the given project, creating it
+// with the same settings as p if necessary. It returns p if project is
+// empty or p's own project.
+func (p *publisher) forProject(ctx context.Context, project string) (*publisher, error) {
+	if project == "" || project == p.project {
+		return p, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if q, ok := p.projects[project]; ok {
+		return q, nil
+	}
+	q, err := newPublisher(ctx, project, p.attempts, p.maxDynamic, p.opts...)
+	if err != nil {
+		return nil, err
+	}
+	if p.abandoned.Err() != nil {
+		q.abandon()
+	}
+	q.reuse = p.reuse
+	q.stats = p.stats
+	q.published = p.published
+	if p.projects == nil {
+		p.projects = make(map[string]*publisher)
+	}
+	p.projects[project] = q
+	return q, nil
+}
+
+// others returns the publishers for other projects in project order.
+func (p *publisher) others() []*publisher {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	others := make([]*publisher, 0, len(p.projects))
+	for _, q := range p.projects {
+		others = append(others, q)
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i].project < others[j].project })
+	return others
+}
+
+// topicSettings holds the publish settings for a topic.
+type topicSettings struct {
+	// flowControl is the publisher flow control
+	// settings for the topic. Library defaults
+	// are used if nil.
+	flowControl *pubsub.FlowControlSettings
+
+	// ordered specifies that message
+	// ordering is enabled for the topic.
+	ordered bool
+
+	// schema is the ID of the schema attached
+	// to the topic when it is created, and
+	// encoding is the encoding of its messages.
+	// No schema is attached if schema is empty.
+	schema   string
+	encoding pubsub.SchemaEncoding
+}
+
+// apply applies the settings to t.
+func (s topicSettings) apply(t *pubsub.Topic) {
+	if s.flowControl != nil {
+		t.PublishSettings.FlowControlSettings = *s.flowControl
+	}
+	t.EnableMessageOrdering = s.ordered
+}
+
+// createTopic creates the topic with the given id using the provided
+// publish settings.
+func (p *publisher) createTopic(ctx context.Context, id string, settings topicSettings) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.createTopicLocked(ctx, id, settings)
+}
+
+// ensureTopic creates the topic with the given id if it has not already
+// been created by the publisher. The number of topics that may be created
+// by ensureTopic is limited by the publisher's maxDynamic field. The topic
+// is created without holding p.mu, so publishes to other topics are not
+// held up; concurrent calls for the same topic wait for its creation.
+func (p *publisher) ensureTopic(ctx context.Context, id string, settings topicSettings) error {
+	p.mu.Lock()
+	for {
+		if _, ok := p.topics[id]; ok {
+			p.mu.Unlock()
+			return nil
+		}
+		done, ok := p.pending[id]
+		if !ok {
+			break
+		}
+		p.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+		}
+		p.mu.Lock()
+	}
+	if p.dynamic >= p.maxDynamic {
+		p.mu.Unlock()
+		return fmt.Errorf("cannot create topic %q: reached limit of %d dynamic topics", id, p.maxDynamic)
+	}
+	// Reserve the topic and its slot
+	// while it is being created.
+	p.dynamic++
+	done := make(chan struct{})
+	p.pending[id] = done
+	client := p.client
+	gen := p.gen
+	p.mu.Unlock()
+
+	t, created, err := p.newTopic(ctx, client, id, settings)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.pending, id)
+	close(done)
+	if err != nil {
+		p.dynamic--
+		return err
+	}
+	if gen != p.gen {
+		// The client was replaced during creation.
+		t.Stop()
+		t = p.client.Topic(id)
+	}
+	p.addTopicLocked(id, t, settings, created)
+	if created {
+		slog.Info("created topic", "project", p.project, "topic", id)
+	}
+	return nil
+}
+
+// createTopicLocked creates the topic with the given id. Topics already
+// held by the publisher are not recreated, and if p.reuse is true, a
+// topic that already exists on the server is used instead. It must be
+// called with p.mu held.
+func (p *publisher) createTopicLocked(ctx context.Context, id string, settings topicSettings) error {
+	if _, ok := p.topics[id]; ok {
+		return nil
+	}
+	t, created, err := p.newTopic(ctx, p.client, id, settings)
+	if err != nil {
+		return err
+	}
+	p.addTopicLocked(id, t, settings, created)
+	return nil
+}
+
+// newTopic creates the topic with the given id using client, returning
+// its handle and whether it was created. If p.reuse is true, a topic
+// that already exists on the server is used instead. newTopic does not
+// use the publisher's mutable state, so it may be called without
+// holding p.mu.
+func (p *publisher) newTopic(ctx context.Context, client *pubsub.Client, id string, settings topicSettings) (t *pubsub.Topic, created bool, err error) {
+	t, err = client.CreateTopicWithConfig(ctx, id, p.topicConfig(settings))
+	switch {
+	case err == nil:
+		if p.stats != nil {
+			p.stats.topicCreated(p.project)
+		}
+		return t, true, nil
+	case p.reuse && grpc.Code(err) == codes.AlreadyExists:
+		slog.Info("using existing topic", "project", p.project, "topic", id)
+		return client.Topic(id), false, nil
+	default:
+		return nil, false, err
+	}
+}
+
+// addTopicLocked records t as the publisher's handle for the topic with
+// the given id, applying settings to it. It must be called with p.mu
+// held.
+func (p *publisher) addTopicLocked(id string, t *pubsub.Topic, settings topicSettings, created bool) {
+	if created {
+		p.created[id] = true
+	}
+	settings.apply(t)
+	p.settings[id] = settings
+	p.topics[id] = t
+}
+
+// topicConfig returns the config for creating a topic with the given
+// settings.
+func (p *publisher) topicConfig(settings topicSettings) *pubsub.TopicConfig {
+	var cfg pubsub.TopicConfig
+	if settings.schema != "" {
+		cfg.SchemaSettings = &pubsub.SchemaSettings{
+			Schema:   fmt.Sprintf("projects/%s/schemas/%s", p.project, settings.schema),
+			Encoding: settings.encoding,
+		}
+	}
+	return &cfg
+}
+
+// createSchema creates the schema with the given id. It is not an error
+// for the schema to already exist.
+func (p *publisher) createSchema(ctx context.Context, id string, cfg pubsub.SchemaConfig) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.schemas == nil {
+		var err error
+		opts := p.opts
+		if addr := os.Getenv("PUBSUB_EMULATOR_HOST"); addr != "" {
+			// Unlike pubsub.NewClient, the schema client
+			// does not connect to the emulator itself.
+			opts = append([]option.ClientOption{
+				option.WithEndpoint(addr),
+				option.WithoutAuthentication(),
+				option.WithGRPCDialOption(grpc.WithInsecure()),
+			}, opts...)
+		}
+		p.schemas, err = pubsub.NewSchemaClient(ctx, p.project, opts...)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := p.schemas.CreateSchema(ctx, id, cfg)
+	if err != nil && grpc.Code(err) != codes.AlreadyExists {
+		return err
+	}
+	if p.schemaConfigs == nil {
+		p.schemaConfigs = make(map[string]pubsub.SchemaConfig)
+	}
+	p.schemaConfigs[id] = cfg
+	if err != nil {
+		return nil
+	}
+	slog.Info("created schema", "project", p.project, "schema", id)
+	p.schemaIDs = append(p.schemaIDs, id)
+	return nil
+}
+
+// publish publishes msg to the topic with the given id, returning the
+// server-generated message ID. If the server is unavailable, publish
+// attempts to reconnect before returning the error.
+func (p *publisher) publish(ctx context.Context, id string, msg *pubsub.Message) (string, error) {
+	p.mu.Lock()
+	t, ok := p.topics[id]
+	gen := p.gen
+	p.mu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("no topic %q", id)
+	}
+	msgID, err := t.Publish(ctx, msg).Get(ctx)
+	if err == nil && p.published != nil {
+		p.published(msgID)
+	}
+	if err != nil && msg.OrderingKey != "" {
+		// Publishing for an ordering key is paused
+		// after a failure until it is resumed.
+		t.ResumePublish(msg.OrderingKey)
+	}
+	switch grpc.Code(err) {
+	case codes.Unavailable:
+		p.reconnect(ctx, gen)
+	case codes.NotFound:
+		p.recreate(ctx, gen, id)
+	}
+	return msgID, err
+}
+
+// recreate recreates the publisher's schemas and topics after the topic
+// with the given id is found to be missing, as happens when the emulator
+// is restarted. If another reconnection or recreation is in progress or
+// has happened since generation gen, recreate is a no-op.
+func (p *publisher) recreate(ctx context.Context, gen int, missing string) {
+	if !p.beginRecovery(gen) {
+		return
+	}
+	defer p.endRecovery()
+	slog.Warn("topic not found: recreating topics", "project", p.project, "topic", missing)
+
+	p.mu.Lock()
+	client := p.client
+	schemas := p.schemas
+	schemaConfigs := make(map[string]pubsub.SchemaConfig, len(p.schemaConfigs))
+	for id, cfg := range p.schemaConfigs {
+		schemaConfigs[id] = cfg
+	}
+	settings := make(map[string]topicSettings, len(p.topics))
+	for id := range p.topics {
+		settings[id] = p.settings[id]
+	}
+	p.mu.Unlock()
+
+	ids := make([]string, 0, len(schemaConfigs))
+	for id := range schemaConfigs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		_, err := schemas.CreateSchema(ctx, id, schemaConfigs[id])
+		if err != nil && grpc.Code(err) != codes.AlreadyExists {
+			slog.Error("failed to recreate schema", "project", p.project, "schema", id, "err", err)
+		}
+	}
+	ids = ids[:0]
+	for id := range settings {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	topics := make(map[string]*pubsub.Topic, len(ids))
+	for _, id := range ids {
+		t, err := client.CreateTopicWithConfig(ctx, id, p.topicConfig(settings[id]))
+		switch {
+		case err == nil:
+			slog.Info("recreated topic", "project", p.project, "topic", id)
+			if p.stats != nil {
+				p.stats.topicCreated(p.project)
+			}
+		case grpc.Code(err) == codes.AlreadyExists:
+			t = client.Topic(id)
+		default:
+			slog.Error("failed to recreate topic", "project", p.project, "topic", id, "err", err)
+			continue
+		}
+		settings[id].apply(t)
+		topics[id] = t
+	}
+
+	p.mu.Lock()
+	var stale []*pubsub.Topic
+	for id, t := range topics {
+		old, ok := p.topics[id]
+		if !ok {
+			// The topic was deleted during recreation.
+			t.Stop()
+			continue
+		}
+		stale = append(stale, old)
+		p.topics[id] = t
+	}
+	p.gen++
+	p.mu.Unlock()
+	for _, t := range stale {
+		t.Stop()
+	}
+}
+
+// reconnect replaces the publisher's client with a new client and
+// re-fetches its topic handles. If another reconnection or recreation is
+// in progress or has happened since generation gen, reconnect is a no-op.
+// Reconnection is abandoned when ctx is cancelled or abandonReconnect
+// is called.
+func (p *publisher) reconnect(ctx context.Context, gen int) {
+	if !p.beginRecovery(gen) {
+		return
+	}
+	defer p.endRecovery()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(p.abandoned, cancel)()
+	backoff := time.Second
+	for i := 1; i <= p.attempts; i++ {
+		slog.Info("reconnecting to pubsub", "project", p.project, "attempt", i, "attempts", p.attempts)
+		client, err := pubsub.NewClient(ctx, p.project, p.opts...)
+		if err == nil {
+			err = ping(ctx, client)
+			if err == nil {
+				p.swapClient(client)
+				slog.Info("reconnected to pubsub", "project", p.project)
+				return
+			}
+			client.Close()
+		}
+		slog.Warn("failed to reconnect to pubsub", "project", p.project, "err", err)
+		if i == p.attempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+	slog.Error("giving up reconnecting to pubsub", "project", p.project, "attempts", p.attempts)
+}
+
+// swapClient replaces the publisher's client with client, replacing its
+// topic handles with handles from the new client. The old topics are
+// stopped and the old client is closed without holding p.mu.
+func (p *publisher) swapClient(client *pubsub.Client) {
+	p.mu.Lock()
+	old := p.client
+	stale := make([]*pubsub.Topic, 0, len(p.topics))
+	p.client = client
+	for id, t := range p.topics {
+		stale = append(stale, t)
+		t = client.Topic(id)
+		p.settings[id].apply(t)
+		p.topics[id] = t
+	}
+	p.gen++
+	p.mu.Unlock()
+	for _, t := range stale {
+		t.Stop()
+	}
+	old.Close()
+}
+
+// beginRecovery returns whether the caller should recover the publisher
+// from a failure seen at generation gen. It returns false if another
+// recovery is in progress or has happened since gen. If it returns true,
+// the caller must call endRecovery when it is done.
+func (p *publisher) beginRecovery(gen int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if gen != p.gen || p.recovering {
+		return false
+	}
+	p.recovering = true
+	return true
+}
+
+// endRecovery marks the end of a recovery started by beginRecovery.
+func (p *publisher) endRecovery() {
+	p.mu.Lock()
+	p.recovering = false
+	p.mu.Unlock()
+}
+
+// ping checks whether the server is reachable by the client.
+func ping(ctx context.Context, client *pubsub.Client) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, err := client.Topics(ctx).Next()
+	if errors.Is(err, iterator.Done) {
+		return nil
+	}
+	return err
+}
+
+// unsubscribed returns the IDs of the publisher's topics that have no
+// subscriptions. Topics in other projects are given by their full
+// resource names.
+func (p *publisher) unsubscribed(ctx context.Context) ([]string, error) {
+	p.mu.Lock()
+	topics := make(map[string]*pubsub.Topic, len(p.topics))
+	for id, t := range p.topics {
+		topics[id] = t
+	}
+	p.mu.Unlock()
+	var ids []string
+	for id, t := range topics {
+		_, err := t.Subscriptions(ctx).Next()
+		if err != nil {
+			if !errors.Is(err, iterator.Done) {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, q := range p.others() {
+		other, err := q.unsubscribed(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range other {
+			ids = append(ids, fmt.Sprintf("projects/%s/topics/%s", q.project, id))
+		}
+	}
+	return ids, nil
+}
+
+// topicIDs returns the sorted IDs of the publisher's topics, keyed by
+// project.
+func (p *publisher) topicIDs() map[string][]string {
+	p.mu.Lock()
+	ids := make([]string, 0, len(p.topics))
+	for id := range p.topics {
+		ids = append(ids, id)
+	}
+	p.mu.Unlock()
+	sort.Strings(ids)
+	topics := map[string][]string{p.project: ids}
+	for _, q := range p.others() {
+		for project, ids := range q.topicIDs() {
+			topics[project] = append(topics[project], ids...)
+		}
+	}
+	return topics
+}
+
+// abandonReconnect ends any reconnection in progress for the publisher
+// and the publishers for other projects, and prevents further attempts.
+func (p *publisher) abandonReconnect() {
+	p.abandon()
+	for _, q := range p.others() {
+		q.abandonReconnect()
+	}
+}
+
+// stop stops all the publisher's topics and abandons any reconnection in
+// progress.
+func (p *publisher) stop() {
+	p.abandon()
+	p.mu.Lock()
+	for _, t := range p.topics {
+		t.Stop()
+	}
+	p.mu.Unlock()
+	for _, q := range p.others() {
+		q.stop()
+	}
+}
+
+// deleteTopic deletes the topic with the given id if it was created by
+// the publisher, and returns whether it was deleted. Existing topics that
+// were reused are retained.
+func (p *publisher) deleteTopic(ctx context.Context, id string) (bool, error) {
+	p.mu.Lock()
+	t, ok := p.topics[id]
+	ok = ok && p.created[id]
+	p.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	slog.Info("deleting topic", "project", p.project, "topic", id)
+	t.Stop()
+	err := t.Delete(ctx)
+	if err != nil {
+		return false, err
+	}
+	p.mu.Lock()
+	delete(p.topics, id)
+	delete(p.settings, id)
+	delete(p.created, id)
+	p.mu.Unlock()
+	return true, nil
+}
+
+// deleteTopics deletes all the topics created by the publisher, and then
+// the schemas it created. Existing topics that were reused are retained.
+// Topics and schemas created by the publishers for other projects are
+// deleted first.
+func (p *publisher) deleteTopics(ctx context.Context) error {
+	for _, q := range p.others() {
+		err := q.deleteTopics(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	p.mu.Lock()
+	var ids []string
+	topics := make(map[string]*pubsub.Topic)
+	for id, t := range p.topics {
+		if !p.created[id] {
+			delete(p.topics, id)
+			continue
+		}
+		ids = append(ids, id)
+		topics[id] = t
+	}
+	schemas := p.schemas
+	schemaIDs := append([]string(nil), p.schemaIDs...)
+	p.mu.Unlock()
+
+	sort.Strings(ids)
+	for _, id := range ids {
+		slog.Info("deleting topic", "project", p.project, "topic", id)
+		err := topics[id].Delete(ctx)
+		if err != nil {
+			return err
+		}
+		p.mu.Lock()
+		delete(p.topics, id)
+		delete(p.settings, id)
+		delete(p.created, id)
+		p.mu.Unlock()
+	}
+	for _, id := range schemaIDs {
+		slog.Info("deleting schema", "project", p.project, "schema", id)
+		err := schemas.DeleteSchema(ctx, id)
+		if err != nil {
+			return err
+		}
+		p.mu.Lock()
+		for i, s := range p.schemaIDs {
+			if s == id {
+				p.schemaIDs = append(p.schemaIDs[:i], p.schemaIDs[i+1:]...)
+				break
+			}
+		}
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+// close closes the publisher's clients, including those of the
+// publishers for other projects.
+func (p *publisher) close() error {
+	for _, q := range p.others() {
+		q.close()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.schemas != nil {
+		p.schemas.Close()
+	}
+	return p.client.Close()
+}
@@ -0,0 +1,139 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub/pstest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// newTestPublisher returns a publisher for an in-process Pub/Sub server
+// that may create up to maxDynamic topics with ensureTopic.
+func newTestPublisher(t *testing.T, maxDynamic int) *publisher {
+	t.Helper()
+	srv := pstest.NewServer()
+	t.Cleanup(func() { srv.Close() })
+	p, err := newPublisher(context.Background(), "test", 1, maxDynamic,
+		option.WithEndpoint(srv.Addr),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error creating publisher: %v", err)
+	}
+	t.Cleanup(func() {
+		p.stop()
+		p.close()
+	})
+	return p
+}
+
+func TestEnsureTopicConcurrent(t *testing.T) {
+	p := newTestPublisher(t, 2)
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = p.ensureTopic(context.Background(), "dynamic", topicSettings{})
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("unexpected error from call %d: %v", i, err)
+		}
+	}
+	if p.dynamic != 1 {
+		t.Errorf("unexpected number of dynamic topics: got:%d want:1", p.dynamic)
+	}
+	if !p.created["dynamic"] {
+		t.Error("topic not recorded as created")
+	}
+	if len(p.pending) != 0 {
+		t.Errorf("unexpected pending creations: %v", p.pending)
+	}
+}
+
+func TestEnsureTopicLimit(t *testing.T) {
+	p := newTestPublisher(t, 2)
+	for i := 0; i < 2; i++ {
+		err := p.ensureTopic(context.Background(), fmt.Sprintf("topic-%d", i), topicSettings{})
+		if err != nil {
+			t.Fatalf("unexpected error creating topic %d: %v", i, err)
+		}
+	}
+	err := p.ensureTopic(context.Background(), "topic-0", topicSettings{})
+	if err != nil {
+		t.Errorf("unexpected error for existing topic: %v", err)
+	}
+	err = p.ensureTopic(context.Background(), "topic-2", topicSettings{})
+	if err == nil {
+		t.Error("expected error beyond dynamic topic limit")
+	}
+}
+
+func TestEnsureTopicFailure(t *testing.T) {
+	p := newTestPublisher(t, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := p.ensureTopic(ctx, "failed", topicSettings{})
+	if err == nil {
+		t.Fatal("expected error creating topic with cancelled context")
+	}
+	if p.dynamic != 0 {
+		t.Errorf("dynamic topic slot not released: got:%d want:0", p.dynamic)
+	}
+	if len(p.pending) != 0 {
+		t.Errorf("unexpected pending creations: %v", p.pending)
+	}
+	err = p.ensureTopic(context.Background(), "failed", topicSettings{})
+	if err != nil {
+		t.Errorf("unexpected error retrying topic creation: %v", err)
+	}
+}
+
+func TestReconnectAbandoned(t *testing.T) {
+	srv := pstest.NewServer()
+	p, err := newPublisher(context.Background(), "test", 10, 0,
+		option.WithEndpoint(srv.Addr),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error creating publisher: %v", err)
+	}
+	defer p.close()
+	srv.Close()
+
+	go func() {
+		// Wait for the first attempt to fail.
+		time.Sleep(100 * time.Millisecond)
+		p.abandonReconnect()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		p.reconnect(context.Background(), p.gen)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reconnection not abandoned")
+	}
+	if p.gen != 0 {
+		t.Errorf("unexpected reconnection: gen:%d", p.gen)
+	}
+}
@@ -0,0 +1,383 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/linkedin/goavro/v2"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// pubsubTarget is an executor that publishes a job's payload to its
+// target topic.
+type pubsubTarget struct {
+	job
+
+	data     []byte // data is the encoded payload if it is static.
+	settings topicSettings
+
+	// payload is the payload template,
+	// or nil if the payload is static.
+	payload *template.Template
+
+	// schema is the JSON Schema payloads
+	// must match, or nil if payloads are
+	// not validated.
+	schema *jsonschema.Schema
+
+	// topicSchema is the Pub/Sub schema attached
+	// to the job's topics, and avro is its codec
+	// if it is an Avro schema.
+	topicSchema *pubsub.SchemaConfig
+	avro        *goavro.Codec
+
+	// topics holds the parsed templates
+	// for templated topic names.
+	topics map[string]*template.Template
+
+	*jobEnv
+}
+
+// newPubsubTarget returns a pubsubTarget for j, publishing with env.
+func newPubsubTarget(j job, env *jobEnv) (*pubsubTarget, error) {
+	err := j.Target.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid target: %w", err)
+	}
+	n := 0
+	for _, set := range []bool{
+		j.Payload != "",
+		j.PayloadFile != "",
+		len(j.PayloadExec) != 0,
+		j.PayloadBase64 != "",
+		j.PayloadHex != "",
+	} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 {
+		return nil, errors.New("payload, payloadfile, payloadexec, payloadbase64 and payloadhex are mutually exclusive")
+	}
+	schema, err := loadSchema(j.PayloadSchema)
+	if err != nil {
+		return nil, err
+	}
+	t := &pubsubTarget{
+		job:    j,
+		schema: schema,
+		jobEnv: env,
+	}
+	if j.Target.Schema != nil {
+		cfg, err := j.Target.Schema.config()
+		if err != nil {
+			return nil, fmt.Errorf("invalid topic schema: %w", err)
+		}
+		enc, err := j.Target.Schema.encoding()
+		if err != nil {
+			return nil, fmt.Errorf("invalid topic schema: %w", err)
+		}
+		switch cfg.Type {
+		case pubsub.SchemaAvro:
+			if j.Proto != nil {
+				return nil, errors.New("proto cannot be used with an avro topic schema")
+			}
+			t.avro, err = goavro.NewCodec(cfg.Definition)
+			if err != nil {
+				return nil, fmt.Errorf("invalid avro schema: %w", err)
+			}
+		case pubsub.SchemaProtocolBuffer:
+			binary := j.PayloadBase64 != "" || j.PayloadHex != ""
+			switch {
+			case j.Proto != nil && enc != pubsub.EncodingBinary:
+				return nil, errors.New("proto cannot be used with a json protocol buffer topic schema")
+			case j.Proto == nil && !binary && enc == pubsub.EncodingBinary:
+				return nil, errors.New("binary protocol buffer topic schemas require proto or a binary payload")
+			}
+		}
+		t.topicSchema = &cfg
+		t.settings.schema = j.Target.Schema.Name
+		t.settings.encoding = enc
+	}
+	var (
+		data    []byte
+		payload *template.Template
+	)
+	switch {
+	case j.PayloadFile != "", len(j.PayloadExec) != 0:
+		// Read at fire time.
+	case j.PayloadBase64 != "", j.PayloadHex != "":
+		data, err = j.binaryPayload()
+		if err != nil {
+			return nil, err
+		}
+		err = validateJSON(schema, data)
+		if err != nil {
+			return nil, err
+		}
+	case isTemplate(j.Payload):
+		payload, err = parseTemplate("payload", j.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid payload template: %w", err)
+		}
+	default:
+		data, err = t.encode([]byte(j.Payload))
+		if err != nil {
+			return nil, err
+		}
+	}
+	fc, err := j.Target.FlowControl.settings()
+	if err != nil {
+		return nil, fmt.Errorf("invalid flow control: %w", err)
+	}
+	topics := make(map[string]*template.Template)
+	for _, id := range j.Target.topicIDs() {
+		if !isTemplate(id) {
+			continue
+		}
+		topics[id], err = parseTemplate("topic", id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid topic template: %w", err)
+		}
+	}
+	t.data = data
+	t.payload = payload
+	t.settings.flowControl = fc
+	t.settings.ordered = j.OrderingKey != ""
+	t.topics = topics
+	return t, nil
+}
+
+// setup creates the job's topic schema and its topics that are not
+// templated.
+func (t *pubsubTarget) setup(ctx context.Context) error {
+	pub, err := t.publisher(ctx)
+	if err != nil {
+		return err
+	}
+	if t.topicSchema != nil {
+		err := pub.createSchema(ctx, t.settings.schema, *t.topicSchema)
+		if err != nil {
+			return fmt.Errorf("failed to create schema %q: %w", t.settings.schema, err)
+		}
+	}
+	for _, id := range t.Target.topicIDs() {
+		if _, ok := t.topics[id]; ok {
+			continue
+		}
+		err := pub.createTopic(ctx, id, t.settings)
+		if err != nil {
+			return fmt.Errorf("failed to create topic %q: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// publisher returns the publisher for the job's project.
+func (t *pubsubTarget) publisher(ctx context.Context) (*publisher, error) {
+	pub, err := t.pub.forProject(ctx, t.Project)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create publisher for project %q: %w", t.Project, err)
+	}
+	return pub, nil
+}
+
+// execute publishes the job's payload.
+func (t *pubsubTarget) execute(ctx context.Context, f firing) (string, error) {
+	topic, err := t.topic(ctx, f)
+	if err != nil {
+		return "", err
+	}
+	msg, err := t.message(ctx, f, topic)
+	if err != nil {
+		return topic, err
+	}
+	pub, err := t.publisher(ctx)
+	if err != nil {
+		return topic, err
+	}
+	msg.Attributes = injectTrace(ctx, msg.Attributes)
+	start := time.Now()
+	id, err := pub.publish(ctx, topic, msg)
+	if err != nil {
+		return topic, err
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("messaging.message_id", id))
+	noteMessageID(ctx, id)
+	slog.Info("published", "job", t.Name, "topic", topic, "id", id, "latency", time.Since(start))
+	return topic, nil
+}
+
+// message returns the message to publish to topic for a firing.
+func (t *pubsubTarget) message(ctx context.Context, f firing, topic string) (*pubsub.Message, error) {
+	data, err := t.payloadData(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	msg := &pubsub.Message{Data: data, OrderingKey: t.OrderingKey}
+	for k, v := range t.attributes {
+		setAttr(msg, k, v)
+	}
+	for k, v := range t.Attributes {
+		setAttr(msg, k, v)
+	}
+	setAttr(msg, "scheduler.job_name", t.Name)
+	setAttr(msg, "scheduler.schedule_time", f.scheduled.UTC().Format(time.RFC3339))
+	setAttr(msg, "scheduler.execution_id", f.id)
+	setAttr(msg, "scheduler.attempt", strconv.Itoa(f.attempt))
+	if t.DeliveryDelay > 0 {
+		setAttr(msg, "not-before", f.time.Add(t.DeliveryDelay).UTC().Format(time.RFC3339))
+	}
+	if t.sequence != nil {
+		k := seqKey{project: t.Project, topic: topic, orderingKey: t.OrderingKey}
+		if k.orderingKey == "" {
+			k.job = t.Name
+		}
+		seq, ok := f.seqs[k]
+		if !ok {
+			// Retried attempts reuse the
+			// firing's sequence number.
+			seq = t.sequence.next(k)
+			f.seqs[k] = seq
+		}
+		setAttr(msg, "seq", strconv.FormatInt(seq, 10))
+	}
+	return msg, nil
+}
+
+// sequencer assigns the sequence numbers of published messages.
+type sequencer struct {
+	mu   sync.Mutex
+	last map[seqKey]int64
+}
+
+// seqKey identifies a sequence of messages. Messages with an ordering
+// key are numbered per topic and ordering key across all jobs, and
+// messages without one are numbered per job and topic.
+type seqKey struct {
+	job, project, topic, orderingKey string
+}
+
+func newSequencer() *sequencer {
+	return &sequencer{last: make(map[seqKey]int64)}
+}
+
+// next returns the next sequence number for k.
+func (s *sequencer) next(k seqKey) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last[k]++
+	return s.last[k]
+}
+
+// payloadData returns the encoded payload for a firing.
+func (t *pubsubTarget) payloadData(ctx context.Context, f firing) ([]byte, error) {
+	var (
+		data []byte
+		err  error
+	)
+	switch {
+	case t.PayloadFile != "":
+		data, err = os.ReadFile(t.PayloadFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read payload: %w", err)
+		}
+	case len(t.PayloadExec) != 0:
+		data, err = exec.CommandContext(ctx, t.PayloadExec[0], t.PayloadExec[1:]...).Output()
+		if err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) && len(exitErr.Stderr) != 0 {
+				err = fmt.Errorf("%w: %s", err, bytes.TrimSpace(exitErr.Stderr))
+			}
+			return nil, fmt.Errorf("failed to run payload command: %w", err)
+		}
+	case t.payload != nil:
+		p, err := render(t.payload, f.templateData(t.Name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to render payload: %w", err)
+		}
+		data = []byte(p)
+	default:
+		// Static payloads are validated
+		// and encoded once.
+		return t.data, nil
+	}
+	return t.encode(data)
+}
+
+// encode validates the JSON payload in data and returns it encoded for
+// publication. Payloads are encoded in protobuf wire format if the job
+// has a proto message type, and in Avro binary format if the topic has
+// a binary Avro schema.
+func (t *pubsubTarget) encode(data []byte) ([]byte, error) {
+	err := validateJSON(t.schema, data)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case t.Proto != nil:
+		data, err = t.Proto.encode(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode payload: %w", err)
+		}
+	case t.avro != nil:
+		native, _, err := t.avro.NativeFromTextual(data)
+		if err != nil {
+			return nil, fmt.Errorf("payload does not match avro schema: %w", err)
+		}
+		if t.settings.encoding == pubsub.EncodingBinary {
+			data, err = t.avro.BinaryFromNative(nil, native)
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode payload: %w", err)
+			}
+		}
+	}
+	return data, nil
+}
+
+// setAttr sets the attribute key to val in msg.
+func setAttr(msg *pubsub.Message, key, val string) {
+	if msg.Attributes == nil {
+		msg.Attributes = make(map[string]string)
+	}
+	msg.Attributes[key] = val
+}
+
+// topic returns the ID of the topic to publish to for a firing, creating
+// the topic if it is templated and has not been seen before.
+func (t *pubsubTarget) topic(ctx context.Context, f firing) (string, error) {
+	id := t.Target.pick()
+	tmpl, ok := t.topics[id]
+	if !ok {
+		return id, nil
+	}
+	id, err := render(tmpl, f.templateData(t.Name))
+	if err != nil {
+		return "", fmt.Errorf("failed to render topic: %w", err)
+	}
+	pub, err := t.publisher(ctx)
+	if err != nil {
+		return "", err
+	}
+	err = pub.ensureTopic(ctx, id, t.settings)
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
@@ -0,0 +1,60 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSequenceNumbers(t *testing.T) {
+	env := &jobEnv{sequence: newSequencer()}
+	newTarget := func(name, project, orderingKey string) *pubsubTarget {
+		j := pubsubJob(name, "@every 1m")
+		j.Payload = "payload"
+		j.Project = project
+		j.OrderingKey = orderingKey
+		tgt, err := newPubsubTarget(j, env)
+		if err != nil {
+			t.Fatalf("unexpected error creating target for %s: %v", name, err)
+		}
+		return tgt
+	}
+	a := newTarget("a", "", "")
+	b := newTarget("b", "", "")
+	orderedA := newTarget("ordered-a", "", "key")
+	orderedB := newTarget("ordered-b", "", "key")
+	otherProject := newTarget("other-project", "other", "key")
+
+	newFiring := func() firing {
+		return firing{scheduled: time.Unix(0, 0), id: "id", attempt: 1, seqs: make(map[seqKey]int64)}
+	}
+	retried := newFiring()
+	for _, test := range []struct {
+		target *pubsubTarget
+		f      firing
+		topic  string
+		want   string
+	}{
+		{target: a, f: newFiring(), topic: "t1", want: "1"},
+		{target: a, f: newFiring(), topic: "t1", want: "2"},
+		{target: a, f: newFiring(), topic: "t2", want: "1"}, // Per topic.
+		{target: b, f: newFiring(), topic: "t1", want: "1"}, // Per job without an ordering key.
+		{target: a, f: retried, topic: "t1", want: "3"},
+		{target: a, f: retried, topic: "t1", want: "3"}, // Retries reuse the firing's number.
+		{target: orderedA, f: newFiring(), topic: "t1", want: "1"},
+		{target: orderedB, f: newFiring(), topic: "t1", want: "2"},     // Shared across jobs with an ordering key.
+		{target: otherProject, f: newFiring(), topic: "t1", want: "1"}, // Per project.
+	} {
+		msg, err := test.target.message(context.Background(), test.f, test.topic)
+		if err != nil {
+			t.Fatalf("unexpected error creating message for %s: %v", test.target.Name, err)
+		}
+		if got := msg.Attributes["seq"]; got != test.want {
+			t.Errorf("unexpected seq for %s on %s: got:%s want:%s", test.target.Name, test.topic, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"time"
+)
+
+// quiescer holds the scheduler's quiesced state. While quiesced, job
+// invocations are skipped but the scheduler remains running.
+type quiescer struct {
+	state int32
+	sig   chan os.Signal
+}
+
+// newQuiescer returns a new quiescer that toggles its state on receipt
+// of the platform's quiesce signals. On platforms without quiesce
+// signals the quiescer never becomes quiesced.
+func newQuiescer() *quiescer {
+	q := &quiescer{sig: make(chan os.Signal, 1)}
+	if len(quiesceSignals) != 0 {
+		signal.Notify(q.sig, quiesceSignals...)
+		go func() {
+			for range q.sig {
+				q.toggle()
+			}
+		}()
+	}
+	return q
+}
+
+// toggle switches the quiescer between the quiesced and running states.
+func (q *quiescer) toggle() {
+	for {
+		old := atomic.LoadInt32(&q.state)
+		if atomic.CompareAndSwapInt32(&q.state, old, 1-old) {
+			if old == 0 {
+				slog.Info("quiesced: skipping job invocations until resumed")
+			} else {
+				slog.Info("resumed job invocations")
+			}
+			return
+		}
+	}
+}
+
+// quiesced returns whether the quiescer is in the quiesced state.
+func (q *quiescer) quiesced() bool {
+	return atomic.LoadInt32(&q.state) != 0
+}
+
+// stop stops signal handling for the quiescer.
+func (q *quiescer) stop() {
+	signal.Stop(q.sig)
+	close(q.sig)
+}
+
+// skipIfQuiesced returns a wrapper that skips invocations of the named
+// job while q is quiesced.
+func skipIfQuiesced(name string, q *quiescer) wrapper {
+	return func(j jobFunc) jobFunc {
+		return func(scheduled time.Time) {
+			if q.quiesced() {
+				slog.Info("skipping job: quiesced", "job", name)
+				return
+			}
+			j(scheduled)
+		}
+	}
+}
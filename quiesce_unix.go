@@ -0,0 +1,16 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// quiesceSignals are the signals that toggle the quiesced state.
+var quiesceSignals = []os.Signal{syscall.SIGUSR2}
@@ -0,0 +1,62 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// rnd is the scheduler's source of randomness. It is seeded by the
+// -seed flag so that runs can be reproduced.
+var rnd = newLockedRand(time.Now().UnixNano())
+
+// lockedRand is a rand.Rand that is safe for concurrent use.
+type lockedRand struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{rnd: rand.New(rand.NewSource(seed))}
+}
+
+// Int63 returns a non-negative pseudo-random int64.
+func (r *lockedRand) Int63() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rnd.Int63()
+}
+
+// Int63n returns a non-negative pseudo-random int64 in [0,n).
+func (r *lockedRand) Int63n(n int64) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rnd.Int63n(n)
+}
+
+// Float64 returns a pseudo-random float64 in [0,1).
+func (r *lockedRand) Float64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rnd.Float64()
+}
+
+// NormFloat64 returns a normally distributed float64 with mean 0 and
+// standard deviation 1.
+func (r *lockedRand) NormFloat64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rnd.NormFloat64()
+}
+
+// ExpFloat64 returns an exponentially distributed float64 with rate
+// parameter 1.
+func (r *lockedRand) ExpFloat64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rnd.ExpFloat64()
+}
@@ -0,0 +1,618 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/kortschak/scheduler/schedule"
+	"github.com/robfig/cron/v3"
+)
+
+var (
+	errJobExists   = errors.New("job already exists")
+	errJobNotFound = errors.New("job not found")
+	errJobExpired  = errors.New("one-shot job time has passed")
+)
+
+// registry holds the jobs registered with the scheduler. Jobs may be
+// added, removed, paused, resumed and run while the scheduler is running.
+type registry struct {
+	sched    *schedule.Scheduler
+	env      *jobEnv
+	errTopic string
+	quiesce  *quiescer
+	state    *stateFile // state is nil if fire times are not persisted.
+
+	mu    sync.Mutex
+	jobs  map[string]*entry
+	order []string // order holds job names in registration order.
+
+	// bounded holds the names of registered jobs
+	// with a bounded number of runs that have not
+	// yet completed. allDone is closed when the
+	// last of them completes.
+	bounded map[string]bool
+	allDone chan struct{}
+}
+
+// entry is a job held by a registry.
+type entry struct {
+	job job
+	sj  *scheduledJob
+
+	// run is the job wrapped for execution.
+	// It ignores the paused state.
+	run jobFunc
+
+	// sched is the job's schedule. It is nil
+	// for jobs run by their dependency.
+	sched cron.Schedule
+
+	paused bool
+
+	// runs is the number of successful executions
+	// of the job. finished is set when the job has
+	// reached its maximum number of runs.
+	runs     int
+	finished bool
+
+	// last is the time the job was
+	// last run. Zero if it has not run.
+	last time.Time
+}
+
+// jobStatus is a snapshot of the state of a registered job.
+type jobStatus struct {
+	job    job
+	paused bool
+	next   time.Time // Zero if the job is not scheduled, paused or finished.
+	prev   time.Time // Zero if the job has not run.
+}
+
+// newRegistry returns a new registry adding jobs to s and executing them
+// with env. If state is not nil, the times jobs are fired by their
+// schedules are recorded in it.
+func newRegistry(s *schedule.Scheduler, env *jobEnv, errTopic string, quiesce *quiescer, state *stateFile) *registry {
+	return &registry{
+		sched:    s,
+		env:      env,
+		errTopic: errTopic,
+		quiesce:  quiesce,
+		state:    state,
+		jobs:     make(map[string]*entry),
+		bounded:  make(map[string]bool),
+		allDone:  make(chan struct{}),
+	}
+}
+
+// isBounded returns whether a job with the given schedule has a bounded
+// number of runs.
+func isBounded(j job, sched cron.Schedule) bool {
+	if j.MaxRuns > 0 {
+		return true
+	}
+	switch sched := baseSchedule(sched).(type) {
+	case schedule.Once:
+		return true
+	case *schedule.Repeat:
+		return sched.Count() >= 0
+	}
+	return false
+}
+
+// add adds j to the registry, creating its topics and scheduling it
+// unless it is run by a dependency. If paused is true, the job is
+// registered, but is not run by its schedule until it is resumed.
+func (r *registry) add(ctx context.Context, j job, paused bool) error {
+	r.mu.Lock()
+	_, exists := r.jobs[j.Name]
+	r.mu.Unlock()
+	if exists {
+		return fmt.Errorf("%w: %q", errJobExists, j.Name)
+	}
+
+	sj, err := newScheduledJob(j, r.env)
+	if err != nil {
+		return err
+	}
+	var sched cron.Schedule
+	if j.DependsOn == "" {
+		sched, err = j.schedule()
+		if err != nil {
+			return fmt.Errorf("error in cronspec: %w", err)
+		}
+		if !j.At.IsZero() && !j.At.After(clock.Now()) {
+			return fmt.Errorf("%w: %q at %v", errJobExpired, j.Name, j.At)
+		}
+		if r.env.splay > 0 && j.At.IsZero() {
+			sched = offsetSchedule{sched: sched, offset: r.env.splayDist.delay(r.env.splay)}
+		}
+		if j.Jitter > 0 {
+			dist, err := parseDistribution(j.JitterDistribution)
+			if err != nil {
+				return fmt.Errorf("invalid jitter: %w", err)
+			}
+			sched = jitterSchedule{sched: sched, max: j.Jitter, dist: dist}
+		}
+	}
+	policy, err := concurrencyPolicy(j.Name, j.ConcurrencyPolicy)
+	if err != nil {
+		return err
+	}
+	if policy != nil && j.MaxConcurrent > 0 {
+		return errors.New("concurrency policy and max concurrent are mutually exclusive")
+	}
+	err = sj.setup(ctx)
+	if err != nil {
+		return err
+	}
+	wrappers := []wrapper{
+		recoverPanics(j.Name, r.env.pub, r.errTopic),
+		skipIfQuiesced(j.Name, r.quiesce),
+	}
+	if j.MaxConcurrent > 0 {
+		wrappers = append(wrappers, limitConcurrent(j.Name, j.MaxConcurrent))
+	}
+	if policy != nil {
+		wrappers = append(wrappers, policy)
+	}
+	e := &entry{
+		job:    j,
+		sj:     sj,
+		run:    chain(sj.RunAt, wrappers...),
+		sched:  sched,
+		paused: paused,
+	}
+	sj.succeeded = func() { r.succeeded(e) }
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.jobs[j.Name]; exists {
+		return fmt.Errorf("%w: %q", errJobExists, j.Name)
+	}
+	if sched != nil {
+		run := r.unlessPaused(e)
+		err = r.sched.Schedule(j.Name, sched, jobFunc(func(at time.Time) {
+			run(scheduledTime(sched, at))
+		}))
+		if err != nil {
+			return err
+		}
+	}
+	r.jobs[j.Name] = e
+	r.order = append(r.order, j.Name)
+	if isBounded(j, sched) {
+		r.bounded[j.Name] = true
+	}
+	return nil
+}
+
+// succeeded records a successful execution of e's job, disabling the
+// job if it has reached its maximum number of runs.
+func (r *registry) succeeded(e *entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e.runs++
+	if e.job.MaxRuns == 0 || e.runs < e.job.MaxRuns || e.finished {
+		return
+	}
+	e.finished = true
+	r.sched.RemoveJob(e.job.Name)
+	slog.Info("disabled job: reached run limit", "job", e.job.Name, "runs", e.runs)
+	r.completeLocked(e.job.Name)
+}
+
+// completeLocked marks the named job as having completed its bounded
+// runs. It must be called with r.mu held.
+func (r *registry) completeLocked(name string) {
+	if !r.bounded[name] {
+		return
+	}
+	delete(r.bounded, name)
+	if len(r.bounded) == 0 {
+		close(r.allDone)
+	}
+}
+
+// done returns a channel that is closed when all the registered jobs with
+// a bounded number of runs have completed, and whether there are any
+// such jobs.
+func (r *registry) done() (<-chan struct{}, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.allDone, len(r.bounded) != 0
+}
+
+// unlessPaused returns a jobFunc that runs e's job unless it is paused,
+// outside its run window or has reached its maximum number of runs.
+func (r *registry) unlessPaused(e *entry) jobFunc {
+	return func(scheduled time.Time) {
+		now := clock.Now()
+		r.mu.Lock()
+		paused := e.paused
+		inWindow := e.job.inWindow(now)
+		finished := e.finished
+		if !paused && inWindow && !finished {
+			e.last = now
+		}
+		r.mu.Unlock()
+		switch {
+		case finished:
+			slog.Info("skipping job: reached run limit", "job", e.job.Name, "runs", e.job.MaxRuns)
+		case paused:
+			slog.Info("skipping job: paused", "job", e.job.Name)
+		case !inWindow:
+			slog.Info("skipping job: outside window", "job", e.job.Name)
+		default:
+			if se, ok := r.sched.Entry(e.job.Name); ok && !se.Prev.IsZero() {
+				r.env.stats.scheduleLag(e.job.Name, now.Sub(se.Prev))
+			}
+			r.state.record(e.job.Name, now)
+			e.run(scheduled)
+		}
+		if _, ok := baseSchedule(e.sched).(*schedule.Repeat); ok && e.sched.Next(now).IsZero() {
+			r.mu.Lock()
+			r.completeLocked(e.job.Name)
+			r.mu.Unlock()
+		}
+		if !e.job.At.IsZero() && e.sched != nil {
+			err := r.remove(e.job.Name)
+			if err != nil {
+				slog.Error("failed to remove one-shot job", "job", e.job.Name, "err", err)
+				return
+			}
+			slog.Info("removed one-shot job", "job", e.job.Name)
+		}
+	}
+}
+
+// linkDependents attaches each registered job that depends on another
+// registered job to its dependency. It must be called before the cron
+// is started.
+func (r *registry) linkDependents() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, name := range r.order {
+		e := r.jobs[name]
+		if e.job.DependsOn == "" {
+			continue
+		}
+		dep, ok := r.jobs[e.job.DependsOn]
+		if !ok {
+			slog.Warn("dependency is not scheduled", "job", name, "dependency", e.job.DependsOn)
+			continue
+		}
+		dep.sj.dependents = append(dep.sj.dependents, dependent{job: r.unlessPaused(e), delay: e.job.DependencyDelay})
+	}
+}
+
+// remove removes the named job from the registry. Jobs that are part of
+// a dependency chain cannot be removed.
+func (r *registry) remove(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.jobs[name]
+	if !ok {
+		return fmt.Errorf("%w: %q", errJobNotFound, name)
+	}
+	if e.job.DependsOn != "" || len(e.sj.dependents) != 0 {
+		return fmt.Errorf("cannot remove %q: job is part of a dependency chain", name)
+	}
+	r.sched.RemoveJob(name)
+	delete(r.jobs, name)
+	r.completeLocked(name)
+	for i, n := range r.order {
+		if n == name {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// deleteTopics deletes the Pub/Sub topics of j that were created by the
+// scheduler and are not used by a registered job. It returns the IDs of
+// the deleted topics.
+func (r *registry) deleteTopics(ctx context.Context, j job) ([]string, error) {
+	project := j.Project
+	if project == "" {
+		project = r.env.pub.project
+	}
+	inUse := make(map[string]bool)
+	r.mu.Lock()
+	for _, e := range r.jobs {
+		p := e.job.Project
+		if p == "" {
+			p = r.env.pub.project
+		}
+		if p != project {
+			continue
+		}
+		for _, id := range jobTopics(e.job) {
+			inUse[id] = true
+		}
+	}
+	r.mu.Unlock()
+	pub, err := r.env.pub.forProject(ctx, project)
+	if err != nil {
+		return nil, err
+	}
+	var deleted []string
+	for _, id := range jobTopics(j) {
+		if inUse[id] {
+			slog.Info("not deleting topic: used by another job", "job", j.Name, "topic", id)
+			continue
+		}
+		ok, err := pub.deleteTopic(ctx, id)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to delete topic %q: %w", id, err)
+		}
+		if ok {
+			deleted = append(deleted, id)
+		}
+	}
+	return deleted, nil
+}
+
+// jobTopics returns the IDs of j's Pub/Sub topics that are not templated.
+func jobTopics(j job) []string {
+	var ids []string
+	for _, t := range j.Target.targets() {
+		if t.destination() != pubsubDestination {
+			continue
+		}
+		for _, id := range t.topicIDs() {
+			if !isTemplate(id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// reload applies the difference between the jobs of a previous and a
+// new configuration to the registry. Jobs only in prev are removed, jobs
+// only in next are added and jobs that have changed are replaced. Jobs
+// that are part of a dependency chain in either configuration are not
+// changed. Jobs added by other means are not affected. Jobs that fail
+// to be removed or added are logged and skipped, so they are retried by
+// a later reload only if they have changed. The names of the jobs in
+// next that could not be added are returned.
+func (r *registry) reload(ctx context.Context, prev, next []job) (failed []string, err error) {
+	err = checkDependencies(next)
+	if err != nil {
+		return nil, fmt.Errorf("invalid job dependencies: %w", err)
+	}
+	chained := make(map[string]bool)
+	for _, jobs := range [][]job{prev, next} {
+		for _, j := range jobs {
+			if j.DependsOn != "" {
+				chained[j.Name] = true
+				chained[j.DependsOn] = true
+			}
+		}
+	}
+	old := make(map[string]job)
+	for _, j := range prev {
+		old[j.Name] = j
+	}
+	kept := make(map[string]bool)
+	for _, j := range next {
+		o, ok := old[j.Name]
+		if ok && reflect.DeepEqual(o, j) {
+			kept[j.Name] = true
+		}
+	}
+	for _, j := range prev {
+		if kept[j.Name] {
+			continue
+		}
+		if chained[j.Name] {
+			slog.Warn("not reloading job: job is part of a dependency chain", "job", j.Name)
+			continue
+		}
+		err := r.remove(j.Name)
+		if err != nil {
+			if !errors.Is(err, errJobNotFound) {
+				slog.Error("failed to remove job", "job", j.Name, "err", err)
+			}
+			continue
+		}
+		slog.Info("removed job", "job", j.Name)
+	}
+	for _, j := range next {
+		if kept[j.Name] || chained[j.Name] {
+			continue
+		}
+		if j.Target.destination() == unknownDestination {
+			slog.Warn("skipping job: unsupported destination", "job", j.Name, "destination", j.Target.Destination)
+			continue
+		}
+		err := r.add(ctx, j, j.Paused)
+		if err != nil {
+			slog.Error("failed to add job", "job", j.Name, "err", err)
+			failed = append(failed, j.Name)
+			continue
+		}
+		slog.Info("added job", "job", j.Name)
+	}
+	return failed, nil
+}
+
+// setPaused sets the paused state of the named job.
+func (r *registry) setPaused(name string, paused bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.jobs[name]
+	if !ok {
+		return fmt.Errorf("%w: %q", errJobNotFound, name)
+	}
+	e.paused = paused
+	return nil
+}
+
+// run runs the named job immediately, whether or not it is paused. The
+// job is run asynchronously.
+func (r *registry) run(name string) error {
+	r.mu.Lock()
+	e, ok := r.jobs[name]
+	if ok {
+		e.last = clock.Now()
+	}
+	r.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %q", errJobNotFound, name)
+	}
+	go e.run.Run()
+	return nil
+}
+
+// runAtStart runs the registered jobs that are marked to run when the
+// scheduler starts, unless they are paused or outside their run window.
+// The jobs are run asynchronously.
+func (r *registry) runAtStart() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := clock.Now()
+	for _, name := range r.order {
+		e := r.jobs[name]
+		if !e.job.RunAtStart {
+			continue
+		}
+		switch {
+		case e.paused:
+			slog.Info("skipping job at start: paused", "job", name)
+		case !e.job.inWindow(now):
+			slog.Info("skipping job at start: outside window", "job", name)
+		default:
+			e.last = now
+			go e.run.Run()
+		}
+	}
+}
+
+// catchUp runs the occurrences of registered jobs that were missed since
+// they were last fired according to the registry's state, up to each
+// job's catch-up limit. The missed runs of each job are run sequentially
+// and asynchronously, each for its missed activation time.
+func (r *registry) catchUp() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := clock.Now()
+	for _, name := range r.order {
+		e := r.jobs[name]
+		if e.job.CatchUpLimit <= 0 || e.sched == nil {
+			continue
+		}
+		last, ok := r.state.lastFired(name)
+		if !ok {
+			continue
+		}
+		missed := nextRuns(e.sched, last, now, e.job.CatchUpLimit+1)
+		if len(missed) == 0 {
+			continue
+		}
+		if len(missed) > e.job.CatchUpLimit {
+			missed = missed[:e.job.CatchUpLimit]
+			slog.Info("catching up missed runs (limit reached)", "job", name, "runs", len(missed))
+		} else {
+			slog.Info("catching up missed runs", "job", name, "runs", len(missed))
+		}
+		sched := e.sched
+		job := r.unlessPaused(e)
+		go func() {
+			for _, t := range missed {
+				job(scheduledTime(sched, t))
+			}
+		}()
+	}
+}
+
+// advance advances the virtual clock to t, running the scheduled jobs'
+// activations up to and including t in time order. Each run completes
+// before the next is started.
+func (r *registry) advance(t time.Time) error {
+	_, err := r.sched.Advance(t)
+	return err
+}
+
+// status returns the status of the named job.
+func (r *registry) status(name string) (jobStatus, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.jobs[name]
+	if !ok {
+		return jobStatus{}, fmt.Errorf("%w: %q", errJobNotFound, name)
+	}
+	return r.statusLocked(e), nil
+}
+
+// list returns the status of all registered jobs in registration order.
+func (r *registry) list() []jobStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := make([]jobStatus, 0, len(r.order))
+	for _, name := range r.order {
+		s = append(s, r.statusLocked(r.jobs[name]))
+	}
+	return s
+}
+
+func (r *registry) statusLocked(e *entry) jobStatus {
+	s := jobStatus{job: e.job, paused: e.paused, prev: e.last}
+	if e.sched == nil || e.paused || e.finished {
+		return s
+	}
+	se, _ := r.sched.Entry(e.job.Name)
+	s.next = se.Next
+	return s
+}
+
+// events returns registration events for the jobs in the registry in
+// registration order.
+func (r *registry) events() []registeredEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var events []registeredEvent
+	for _, name := range r.order {
+		e := r.jobs[name]
+		tz := e.job.Timezone
+		if tz == "" {
+			tz = r.sched.Location().String()
+		}
+		var uri string
+		switch exec := e.sj.exec.(type) {
+		case *httpTarget:
+			uri = exec.uri
+		case fanout:
+			for _, t := range exec {
+				if h, ok := t.(*httpTarget); ok {
+					uri = h.uri
+					break
+				}
+			}
+		}
+		ev := registeredEvent{
+			Name:      name,
+			Spec:      e.job.Frequency,
+			At:        e.job.At,
+			Timezone:  tz,
+			Topic:     e.job.Target.topicList(),
+			URI:       uri,
+			DependsOn: e.job.DependsOn,
+			Paused:    e.paused,
+			Next:      r.statusLocked(e).next,
+		}
+		events = append(events, ev)
+	}
+	return events
+}
@@ -0,0 +1,120 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/kortschak/scheduler/schedule"
+)
+
+// newTestRegistry returns a registry with the given jobs registered,
+// publishing to an in-process Pub/Sub server. The registry's scheduler
+// is not started.
+func newTestRegistry(t *testing.T, jobs []job) *registry {
+	t.Helper()
+	s, err := schedule.New(schedule.Config{})
+	if err != nil {
+		t.Fatalf("unexpected error creating scheduler: %v", err)
+	}
+	stats, err := newMetrics("", nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating metrics: %v", err)
+	}
+	env := &jobEnv{
+		pub:      newTestPublisher(t, 0),
+		stats:    stats,
+		latency:  &latency{},
+		shutdown: context.Background(),
+	}
+	r := newRegistry(s, env, "", nil, nil)
+	for _, j := range jobs {
+		err = r.add(context.Background(), j, j.Paused)
+		if err != nil {
+			t.Fatalf("unexpected error adding %s: %v", j.Name, err)
+		}
+	}
+	r.linkDependents()
+	return r
+}
+
+// pubsubJob returns a Pub/Sub job with the given name and frequency
+// publishing to a topic with the job's name.
+func pubsubJob(name, frequency string) job {
+	return job{Name: name, Frequency: frequency, Target: target{Destination: "pubsub", Topic: name}}
+}
+
+func TestRegistryReload(t *testing.T) {
+	parent := pubsubJob("parent", "@every 1h")
+	child := pubsubJob("child", "")
+	child.DependsOn = "parent"
+	prev := []job{
+		pubsubJob("kept", "@every 1m"),
+		pubsubJob("changed", "@every 1m"),
+		pubsubJob("removed", "@every 1m"),
+		parent,
+		child,
+	}
+	r := newTestRegistry(t, prev)
+	kept := r.jobs["kept"]
+
+	changedParent := parent
+	changedParent.Frequency = "@every 2h"
+	next := []job{
+		pubsubJob("kept", "@every 1m"),
+		pubsubJob("changed", "@every 5m"),
+		pubsubJob("added", "@every 1m"),
+		pubsubJob("invalid", "not a schedule"),
+		changedParent,
+		child,
+	}
+	failed, err := r.reload(context.Background(), prev, next)
+	if err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+	if strings.Join(failed, " ") != "invalid" {
+		t.Errorf("unexpected failed jobs: got:%v want:[invalid]", failed)
+	}
+
+	var got []string
+	for _, s := range r.list() {
+		got = append(got, s.job.Name+":"+s.job.Frequency)
+	}
+	want := []string{
+		"kept:@every 1m",
+		"parent:@every 1h",
+		"child:",
+		"changed:@every 5m",
+		"added:@every 1m",
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("unexpected jobs after reload:\ngot: %v\nwant:%v", got, want)
+	}
+	if r.jobs["kept"] != kept {
+		t.Error("unchanged job was replaced")
+	}
+	if _, ok := r.sched.Entry("removed"); ok {
+		t.Error("removed job still scheduled")
+	}
+	if _, ok := r.sched.Entry("added"); !ok {
+		t.Error("added job not scheduled")
+	}
+	if len(r.jobs["parent"].sj.dependents) != 1 {
+		t.Errorf("unexpected number of dependents of parent: got:%d want:1", len(r.jobs["parent"].sj.dependents))
+	}
+
+	// Invalid dependencies leave the registry unchanged.
+	cyclic := pubsubJob("kept", "")
+	cyclic.DependsOn = "kept"
+	_, err = r.reload(context.Background(), next, []job{cyclic})
+	if err == nil {
+		t.Error("expected error for dependency cycle")
+	}
+	if len(r.list()) != len(want) {
+		t.Errorf("unexpected number of jobs after failed reload: got:%d want:%d", len(r.list()), len(want))
+	}
+}
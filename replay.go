@@ -0,0 +1,129 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/kortschak/scheduler/internal/capture"
+	"github.com/kortschak/scheduler/internal/cli"
+)
+
+// replay runs the replay subcommand.
+func replay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	project := flags.String("project", "", "specify project to publish to (required)")
+	conn := cli.AddConnectionFlags(flags)
+	speed := flags.Float64("speed", 0, "specify rate relative to the captured publish times to replay at (as fast as possible if zero)")
+	suffix := flags.String("suffix", "", "specify suffix to append to captured topic names")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s replay -project project [options] capture.jsonl\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *project == "" || flags.NArg() != 1 || *speed < 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		cli.Fatal("failed to open capture", "err", err)
+	}
+	defer f.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	var c cli.Connection
+	conn.Apply(&c)
+	client, err := pubsub.NewClient(ctx, *project, c.Options()...)
+	if err != nil {
+		cli.Fatal("failed to create pubsub client", "err", err)
+	}
+	defer client.Close()
+
+	replayed, failed, err := replayCapture(ctx, client, capture.NewReader(f), *suffix, *speed)
+	slog.Info("replay summary", "replayed", replayed, "failed", failed)
+	if err != nil {
+		cli.Fatal("failed to replay capture", "err", err)
+	}
+	if failed != 0 {
+		cli.Fatal("failed to replay messages", "count", failed)
+	}
+}
+
+// replayCapture publishes the messages in the capture read by r to their
+// topics with suffix appended, returning the number of messages that were
+// published and that failed. If speed is positive, the messages are
+// published at the intervals between their captured publish times divided
+// by speed. Otherwise they are published without delay. Messages are
+// published in capture order and retain their attributes and ordering
+// keys.
+func replayCapture(ctx context.Context, client *pubsub.Client, r *capture.Reader, suffix string, speed float64) (replayed, failed int, err error) {
+	type pending struct {
+		topic  string
+		result *pubsub.PublishResult
+	}
+	var results []pending
+	topics := make(map[string]*pubsub.Topic)
+	defer func() {
+		for _, t := range topics {
+			t.Stop()
+		}
+	}()
+	var first time.Time
+	start := time.Now()
+	for {
+		e, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return replayed, failed, err
+		}
+		if speed > 0 {
+			if first.IsZero() {
+				first = e.PublishTime
+			}
+			at := start.Add(time.Duration(float64(e.PublishTime.Sub(first)) / speed))
+			select {
+			case <-time.After(time.Until(at)):
+			case <-ctx.Done():
+				return replayed, failed, ctx.Err()
+			}
+		}
+		id := e.Topic + suffix
+		t, ok := topics[id]
+		if !ok {
+			t = client.Topic(id)
+			t.EnableMessageOrdering = true
+			topics[id] = t
+		}
+		results = append(results, pending{topic: id, result: t.Publish(ctx, &pubsub.Message{
+			Data:        e.Data,
+			Attributes:  e.Attributes,
+			OrderingKey: e.OrderingKey,
+		})})
+	}
+	for _, p := range results {
+		id, err := p.result.Get(ctx)
+		if err != nil {
+			slog.Error("failed to replay message", "topic", p.topic, "err", err)
+			failed++
+			continue
+		}
+		slog.Info("replayed", "topic", p.topic, "id", id)
+		replayed++
+	}
+	return replayed, failed, nil
+}
@@ -0,0 +1,66 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/kortschak/scheduler/internal/cli"
+)
+
+// jobSummary accumulates the executions of a job for the exit report.
+type jobSummary struct {
+	published, failed int
+	first, last       time.Time
+	latencies         []time.Duration
+}
+
+// report is the JSON summary of a run written on exit.
+type report struct {
+	Start time.Time            `json:"start"`
+	End   time.Time            `json:"end"`
+	Jobs  map[string]jobReport `json:"jobs"`
+}
+
+// jobReport is the summary of a job's executions in a report.
+type jobReport struct {
+	Published int            `json:"published"`
+	Failed    int            `json:"failed"`
+	FirstFire *time.Time     `json:"first_fire,omitempty"`
+	LastFire  *time.Time     `json:"last_fire,omitempty"`
+	Latency   *cli.Latencies `json:"latency,omitempty"` // Nil if nothing was published.
+}
+
+// writeReport writes a JSON summary of the jobs executed since start,
+// including the named jobs that were never fired, to the file at path.
+func (m *metrics) writeReport(path string, start time.Time, names []string) error {
+	r := report{Start: start, End: clock.Now(), Jobs: make(map[string]jobReport)}
+	for _, name := range names {
+		r.Jobs[name] = jobReport{}
+	}
+	m.mu.Lock()
+	for name, s := range m.jobs {
+		jr := jobReport{
+			Published: s.published,
+			Failed:    s.failed,
+			Latency:   cli.NewLatencies(s.latencies),
+		}
+		if !s.first.IsZero() {
+			first, last := s.first, s.last
+			jr.FirstFire = &first
+			jr.LastFire = &last
+		}
+		r.Jobs[name] = jr
+	}
+	m.mu.Unlock()
+
+	b, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
@@ -0,0 +1,82 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// retryConfig is the Cloud Scheduler retry configuration for a job.
+// Backoff starts at MinBackoffDuration and doubles MaxDoublings times,
+// then increases linearly by 2^MaxDoublings*MinBackoffDuration until it
+// reaches MaxBackoffDuration.
+type retryConfig struct {
+	RetryCount         int           // No retries if zero.
+	MaxRetryDuration   time.Duration // Unlimited if zero.
+	MinBackoffDuration time.Duration // 5s if zero.
+	MaxBackoffDuration time.Duration // 1h if zero.
+	MaxDoublings       *int          // 5 if nil.
+}
+
+// validate returns an error if the retry configuration is invalid.
+func (r *retryConfig) validate() error {
+	if r == nil {
+		return nil
+	}
+	switch {
+	case r.RetryCount < 0:
+		return errors.New("negative retry count")
+	case r.MaxRetryDuration < 0, r.MinBackoffDuration < 0, r.MaxBackoffDuration < 0:
+		return errors.New("negative duration")
+	case r.MaxDoublings != nil && *r.MaxDoublings < 0:
+		return errors.New("negative max doublings")
+	}
+	min, max := r.bounds()
+	if min > max {
+		return errors.New("min backoff greater than max backoff")
+	}
+	return nil
+}
+
+// bounds returns the minimum and maximum backoff durations.
+func (r *retryConfig) bounds() (min, max time.Duration) {
+	min, max = r.MinBackoffDuration, r.MaxBackoffDuration
+	if min == 0 {
+		min = 5 * time.Second
+	}
+	if max == 0 {
+		max = time.Hour
+	}
+	return min, max
+}
+
+// next returns the delay before the retry following the given failed
+// attempt, counted from zero, when elapsed time has passed since the
+// first attempt. It returns false if no retry should be made.
+func (r *retryConfig) next(attempt int, elapsed time.Duration) (time.Duration, bool) {
+	if r == nil || attempt >= r.RetryCount {
+		return 0, false
+	}
+	doublings := 5
+	if r.MaxDoublings != nil {
+		doublings = *r.MaxDoublings
+	}
+	min, max := r.bounds()
+	var delay time.Duration
+	if attempt <= doublings {
+		delay = min << attempt
+	} else {
+		delay = (min << doublings) * time.Duration(attempt-doublings+1)
+	}
+	if delay > max || delay <= 0 {
+		// delay <= 0 on overflow.
+		delay = max
+	}
+	if r.MaxRetryDuration != 0 && elapsed+delay > r.MaxRetryDuration {
+		return 0, false
+	}
+	return delay, true
+}
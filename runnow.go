@@ -0,0 +1,79 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/kortschak/scheduler/internal/cli"
+)
+
+// runNow runs the run-now subcommand.
+func runNow(args []string) {
+	flags := flag.NewFlagSet("run-now", flag.ExitOnError)
+	admin := flags.String("admin", "", "specify address of the scheduler admin API")
+	control := flags.String("control", "", "specify path of the scheduler control socket")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s run-now [-admin addr | -control path] jobname\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if (*admin == "") == (*control == "") || flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	name := flags.Arg(0)
+
+	client, base := adminClient(*admin, *control)
+	resp, err := client.Post(base+"/jobs/"+url.PathEscape(name)+"/run", "", nil)
+	if err != nil {
+		cli.Fatal("failed to run job", "job", name, "err", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		cli.Fatal("failed to run job", "job", name, "err", adminError(resp))
+	}
+	_, err = io.Copy(os.Stdout, resp.Body)
+	if err != nil {
+		cli.Fatal("failed to read response", "err", err)
+	}
+}
+
+// adminClient returns a client for the scheduler admin API served on
+// the TCP address admin, or the unix socket control if admin is empty,
+// and the base URL of the API.
+func adminClient(admin, control string) (client *http.Client, base string) {
+	if control == "" {
+		return http.DefaultClient, "http://" + admin
+	}
+	client = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", control)
+		},
+	}}
+	return client, "http://scheduler"
+}
+
+// adminError returns the error reported in an admin API error response.
+func adminError(resp *http.Response) error {
+	var e struct {
+		Error string `json:"error"`
+	}
+	err := json.NewDecoder(resp.Body).Decode(&e)
+	if err != nil || e.Error == "" {
+		return errors.New(resp.Status)
+	}
+	return errors.New(e.Error)
+}
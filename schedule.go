@@ -0,0 +1,146 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// distribution is the distribution of random delays within a bound.
+type distribution int
+
+const (
+	// uniform delays are equally likely
+	// anywhere within the bound.
+	uniform distribution = iota
+
+	// normal delays cluster around the middle
+	// of the bound. They are drawn from a normal
+	// distribution with a standard deviation of
+	// a sixth of the bound.
+	normal
+
+	// exponential delays cluster at the start
+	// of the bound. They are drawn from an
+	// exponential distribution with a mean of a
+	// quarter of the bound.
+	exponential
+)
+
+// parseDistribution returns the named distribution. The empty string
+// is uniform.
+func parseDistribution(name string) (distribution, error) {
+	switch strings.ToLower(name) {
+	case "", "uniform":
+		return uniform, nil
+	case "normal":
+		return normal, nil
+	case "exponential":
+		return exponential, nil
+	default:
+		return uniform, fmt.Errorf("invalid distribution: %q", name)
+	}
+}
+
+// delay returns a random delay in [0,max) drawn from d. Normal and
+// exponential delays are truncated to the bound by resampling.
+func (d distribution) delay(max time.Duration) time.Duration {
+	var f float64
+	switch d {
+	case normal:
+		for f = -1; f < 0 || 1 <= f; {
+			f = 0.5 + rnd.NormFloat64()/6
+		}
+	case exponential:
+		for f = 1; 1 <= f; {
+			f = rnd.ExpFloat64() / 4
+		}
+	default:
+		return time.Duration(rnd.Int63n(int64(max)))
+	}
+	return time.Duration(f * float64(max))
+}
+
+// offsetSchedule is a cron.Schedule that activates a fixed offset after
+// each activation of a base schedule.
+type offsetSchedule struct {
+	sched  cron.Schedule
+	offset time.Duration
+}
+
+// Next returns the next activation time after t.
+func (s offsetSchedule) Next(t time.Time) time.Time {
+	next := s.sched.Next(t.Add(-s.offset))
+	if next.IsZero() {
+		return next
+	}
+	return next.Add(s.offset)
+}
+
+// jitterSchedule is a cron.Schedule that activates a random delay of
+// less than max, drawn from dist, after each activation of a base
+// schedule. The delay should be less than the interval between base
+// activations.
+type jitterSchedule struct {
+	sched cron.Schedule
+	max   time.Duration
+	dist  distribution
+}
+
+// Next returns the next activation time after t.
+func (s jitterSchedule) Next(t time.Time) time.Time {
+	next := s.sched.Next(t)
+	if next.IsZero() {
+		return next
+	}
+	return next.Add(s.dist.delay(s.max))
+}
+
+// baseSchedule returns the schedule underlying any offset or jitter
+// applied to s.
+func baseSchedule(s cron.Schedule) cron.Schedule {
+	for {
+		switch w := s.(type) {
+		case offsetSchedule:
+			s = w.sched
+		case jitterSchedule:
+			s = w.sched
+		default:
+			return s
+		}
+	}
+}
+
+// scheduledTime returns the activation time of the schedule underlying
+// any offset or jitter applied to s for the activation of s at t.
+func scheduledTime(s cron.Schedule, t time.Time) time.Time {
+	for {
+		switch w := s.(type) {
+		case offsetSchedule:
+			s, t = w.sched, t.Add(-w.offset)
+		case jitterSchedule:
+			// The delay is less than max, so the
+			// underlying activation is the first
+			// after t-max.
+			s, t = w.sched, w.sched.Next(t.Add(-w.max))
+		default:
+			return t
+		}
+	}
+}
+
+// nextRuns returns the activation times of sched after from and before
+// until, up to a maximum of max times.
+func nextRuns(sched cron.Schedule, from, until time.Time, max int) []time.Time {
+	var runs []time.Time
+	for t := sched.Next(from); !t.IsZero() && t.Before(until) && len(runs) < max; t = sched.Next(t) {
+		runs = append(runs, t)
+	}
+	return runs
+}
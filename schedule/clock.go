@@ -0,0 +1,91 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package schedule
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a virtual clock that runs at a multiple of real time. A
+// clock with zero speed only moves when it is set. A nil *Clock is the
+// real time clock.
+type Clock struct {
+	speed float64
+
+	mu     sync.Mutex
+	origin time.Time     // origin is the virtual time at start.
+	start  time.Time     // start is the real time at origin.
+	set    chan struct{} // set is closed when the clock is set.
+}
+
+// NewClock returns a virtual clock starting at the virtual time start
+// and running at speed times real time. If start is zero, the clock
+// starts at the current time.
+func NewClock(start time.Time, speed float64) *Clock {
+	now := time.Now()
+	if start.IsZero() {
+		start = now
+	}
+	return &Clock{speed: speed, origin: start, start: now, set: make(chan struct{})}
+}
+
+// Speed returns the speed of the clock relative to real time.
+func (c *Clock) Speed() float64 {
+	if c == nil {
+		return 1
+	}
+	return c.speed
+}
+
+// Now returns the current virtual time, or the real time if c is nil.
+func (c *Clock) Now() time.Time {
+	return c.Virtual(time.Now())
+}
+
+// Set sets the current virtual time to t.
+func (c *Clock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.origin = t
+	c.start = time.Now()
+	close(c.set)
+	c.set = make(chan struct{})
+}
+
+// changed returns a channel that is closed when the clock is next set.
+// It returns nil if c is nil.
+func (c *Clock) changed() <-chan struct{} {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.set
+}
+
+// Virtual returns the virtual time corresponding to the real time t.
+func (c *Clock) Virtual(t time.Time) time.Time {
+	if c == nil {
+		return t
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.origin.Add(time.Duration(float64(t.Sub(c.start)) * c.speed)).In(t.Location())
+}
+
+// Real returns the real time corresponding to the virtual time t. It
+// returns the zero time if the clock does not run.
+func (c *Clock) Real(t time.Time) time.Time {
+	if c == nil {
+		return t
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.speed == 0 {
+		return time.Time{}
+	}
+	return c.start.Add(time.Duration(float64(t.Sub(c.origin)) / c.speed)).In(t.Location())
+}
@@ -0,0 +1,216 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package schedule
+
+import (
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// dstSchedule is a cron.Schedule that applies wall clock semantics to
+// a cron.SpecSchedule over daylight saving time transitions.
+//
+// When clocks move forward, a job that would have fired during the
+// skipped interval fires once at the transition. When clocks move back,
+// a job does not fire again at a wall clock time that already occurred
+// during the first pass through the repeated interval, unless its hours
+// are a wildcard or step, in which case it continues to fire
+// periodically in real time.
+type dstSchedule struct {
+	*cron.SpecSchedule
+}
+
+// Next returns the next activation time after t.
+func (s dstSchedule) Next(t time.Time) time.Time {
+	next := s.SpecSchedule.Next(t)
+	if next.IsZero() {
+		return next
+	}
+	loc := s.Location
+	if loc == time.Local {
+		// cron.SpecSchedule uses the location
+		// of t for time.Local schedules.
+		loc = t.Location()
+	}
+	if skipped, ok := s.skipped(t, next, loc); ok {
+		return skipped
+	}
+	if periodicHours(s.Hour) {
+		return next
+	}
+	tr, ok := repeatedBy(next.In(loc))
+	if !ok || !t.Before(tr.at) {
+		// Activations in the second pass fire if the
+		// first pass was not seen.
+		return next
+	}
+	// Skip to the end of the repeated interval.
+	return s.Next(tr.at.Add(time.Duration(tr.before-tr.after-1) * time.Second))
+}
+
+// skipped returns the time of the first forward transition in (t, next)
+// that hides an activation of the schedule in loc.
+func (s dstSchedule) skipped(t, next time.Time, loc *time.Location) (time.Time, bool) {
+	for _, tr := range transitions(t.In(loc), next.In(loc)) {
+		if tr.after <= tr.before {
+			continue
+		}
+		// Find whether the schedule would have matched a wall clock
+		// time in the gap had the clocks not moved forward.
+		fixed := *s.SpecSchedule
+		fixed.Location = time.FixedZone("", tr.before)
+		gap := time.Duration(tr.after-tr.before) * time.Second
+		if fixed.Next(tr.at.Add(-time.Second)).Before(tr.at.Add(gap)) {
+			return tr.at, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// transition is a change in zone offset.
+type transition struct {
+	at            time.Time
+	before, after int // Offsets in seconds east of UTC.
+}
+
+// transitions returns the zone offset transitions in the location of
+// start that occur in (start, end).
+func transitions(start, end time.Time) []transition {
+	var trs []transition
+	const day = 24 * time.Hour
+	for lo := start; lo.Before(end); lo = lo.Add(day) {
+		hi := lo.Add(day)
+		if hi.After(end) {
+			hi = end
+		}
+		_, before := lo.Zone()
+		_, after := hi.Zone()
+		if before == after {
+			continue
+		}
+		// Find the first second with the new offset.
+		a, b := lo, hi
+		for b.Sub(a) > time.Second {
+			mid := a.Add(b.Sub(a) / 2).Truncate(time.Second)
+			if _, off := mid.Zone(); off == before {
+				a = mid
+			} else {
+				b = mid
+			}
+		}
+		trs = append(trs, transition{at: b, before: before, after: after})
+	}
+	return trs
+}
+
+// repeatedBy returns the transition that moved clocks back to repeat the
+// wall clock time of t, if t is in the second pass through a repeated
+// interval.
+func repeatedBy(t time.Time) (transition, bool) {
+	for _, tr := range transitions(t.Add(-24*time.Hour), t.Add(time.Second)) {
+		if tr.after >= tr.before {
+			continue
+		}
+		end := tr.at.Add(time.Duration(tr.before-tr.after) * time.Second)
+		if !t.Before(tr.at) && t.Before(end) {
+			return tr, true
+		}
+	}
+	return transition{}, false
+}
+
+// periodicHours returns whether the hour field bits of a cron spec match
+// every hour or hours at a fixed step through the day, so that the
+// schedule fires periodically rather than at particular times of day.
+func periodicHours(bits uint64) bool {
+	var hours []int
+	for h := 0; h < 24; h++ {
+		if bits&(1<<h) != 0 {
+			hours = append(hours, h)
+		}
+	}
+	if len(hours) < 2 {
+		return false
+	}
+	step := hours[1] - hours[0]
+	for i := 2; i < len(hours); i++ {
+		if hours[i]-hours[i-1] != step {
+			return false
+		}
+	}
+	return hours[0] < step && hours[len(hours)-1]+step >= 24
+}
+
+// DSTEffect is a change to the activations of a schedule caused by a
+// daylight saving time transition.
+type DSTEffect struct {
+	// Transition is the time of the transition.
+	Transition time.Time
+
+	// Skipped is true if clocks move forward
+	// over activations, which then fire once
+	// at the transition. Otherwise clocks move
+	// back and the repeated activations are
+	// suppressed.
+	Skipped bool
+
+	// First is the first affected activation,
+	// in a fixed zone with the offset of the
+	// wall clock time it is scheduled at.
+	First time.Time
+
+	// Count is the number of affected
+	// activations.
+	Count int
+}
+
+// DSTEffects returns the daylight saving time transitions in (start, end)
+// that change the activations of sched. Schedules in time.Local are
+// interpreted in the location of start. Only cron spec schedules are
+// affected by transitions; DSTEffects returns nil for other schedules.
+func DSTEffects(sched cron.Schedule, start, end time.Time) []DSTEffect {
+	s, ok := sched.(dstSchedule)
+	if !ok {
+		return nil
+	}
+	loc := s.Location
+	if loc == time.Local {
+		loc = start.Location()
+	}
+	var effects []DSTEffect
+	for _, tr := range transitions(start.In(loc), end.In(loc)) {
+		if tr.after < tr.before && periodicHours(s.Hour) {
+			// Periodic schedules continue to fire
+			// through repeated intervals.
+			continue
+		}
+		// Find the activations at the wall clock times
+		// skipped or repeated by the transition, using
+		// the offset that applies to those times.
+		off := tr.before
+		if tr.after < tr.before {
+			off = tr.after
+		}
+		fixed := *s.SpecSchedule
+		fixed.Location = time.FixedZone("", off)
+		width := tr.after - tr.before
+		if width < 0 {
+			width = -width
+		}
+		limit := tr.at.Add(time.Duration(width) * time.Second)
+		e := DSTEffect{Transition: tr.at, Skipped: tr.after > tr.before}
+		for a := fixed.Next(tr.at.Add(-time.Second)); !a.IsZero() && a.Before(limit); a = fixed.Next(a) {
+			if e.Count == 0 {
+				e.First = a.In(fixed.Location)
+			}
+			e.Count++
+		}
+		if e.Count != 0 {
+			effects = append(effects, e)
+		}
+	}
+	return effects
+}
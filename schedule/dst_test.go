@@ -0,0 +1,154 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+// In America/Los_Angeles in 2024, clocks move forward from 02:00 PST to
+// 03:00 PDT at 2024-03-10T10:00:00Z and back from 02:00 PDT to 01:00 PST
+// at 2024-11-03T09:00:00Z.
+var dstTests = []struct {
+	name    string
+	spec    string
+	seconds bool
+	start   string
+	want    []string
+}{
+	{
+		name:  "spring hourly",
+		spec:  "0 * * * *",
+		start: "2024-03-10T08:30:00Z",
+		want:  []string{"2024-03-10T09:00:00Z", "2024-03-10T10:00:00Z", "2024-03-10T11:00:00Z"},
+	},
+	{
+		name:  "spring daily in gap",
+		spec:  "30 2 * * *",
+		start: "2024-03-09T11:00:00Z",
+		want:  []string{"2024-03-10T10:00:00Z", "2024-03-11T09:30:00Z"},
+	},
+	{
+		name:  "spring sub-hourly",
+		spec:  "*/15 * * * *",
+		start: "2024-03-10T09:30:00Z",
+		want:  []string{"2024-03-10T09:45:00Z", "2024-03-10T10:00:00Z", "2024-03-10T10:15:00Z"},
+	},
+	{
+		name:    "spring per-second",
+		spec:    "* * * * * *",
+		seconds: true,
+		start:   "2024-03-10T09:59:58Z",
+		want:    []string{"2024-03-10T09:59:59Z", "2024-03-10T10:00:00Z", "2024-03-10T10:00:01Z"},
+	},
+	{
+		name:  "fall hourly",
+		spec:  "0 * * * *",
+		start: "2024-11-03T07:30:00Z",
+		want:  []string{"2024-11-03T08:00:00Z", "2024-11-03T09:00:00Z", "2024-11-03T10:00:00Z"},
+	},
+	{
+		name:  "fall daily in repeat",
+		spec:  "30 1 * * *",
+		start: "2024-11-03T07:00:00Z",
+		want:  []string{"2024-11-03T08:30:00Z", "2024-11-04T09:30:00Z"},
+	},
+	{
+		name:  "fall daily starting in second pass",
+		spec:  "30 1 * * *",
+		start: "2024-11-03T09:10:00Z",
+		want:  []string{"2024-11-03T09:30:00Z", "2024-11-04T09:30:00Z"},
+	},
+	{
+		name:  "fall sub-hourly",
+		spec:  "*/15 * * * *",
+		start: "2024-11-03T08:40:00Z",
+		want:  []string{"2024-11-03T08:45:00Z", "2024-11-03T09:00:00Z", "2024-11-03T09:15:00Z", "2024-11-03T09:30:00Z"},
+	},
+	{
+		name:  "fall sub-hourly in repeated hour",
+		spec:  "*/15 1 * * *",
+		start: "2024-11-03T08:40:00Z",
+		want:  []string{"2024-11-03T08:45:00Z", "2024-11-04T09:00:00Z"},
+	},
+	{
+		name:    "fall per-second",
+		spec:    "* * * * * *",
+		seconds: true,
+		start:   "2024-11-03T08:59:58Z",
+		want:    []string{"2024-11-03T08:59:59Z", "2024-11-03T09:00:00Z", "2024-11-03T09:00:01Z"},
+	},
+	{
+		name:    "fall per-second in repeated hour",
+		spec:    "* * 1 * * *",
+		seconds: true,
+		start:   "2024-11-03T08:59:58Z",
+		want:    []string{"2024-11-03T08:59:59Z", "2024-11-04T09:00:00Z", "2024-11-04T09:00:01Z"},
+	},
+}
+
+func TestDST(t *testing.T) {
+	for _, test := range dstTests {
+		sched, err := Parse("CRON_TZ=America/Los_Angeles "+test.spec, test.seconds)
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %v", test.spec, err)
+			continue
+		}
+		next, err := time.Parse(time.RFC3339, test.start)
+		if err != nil {
+			t.Fatalf("invalid start time: %v", err)
+		}
+		for i, want := range test.want {
+			next = sched.Next(next)
+			if got := next.UTC().Format(time.RFC3339); got != want {
+				t.Errorf("unexpected fire time %d for %s: got:%s want:%s", i, test.name, got, want)
+				break
+			}
+		}
+	}
+}
+
+var dstEffectsTests = []struct {
+	spec string
+	want []DSTEffect
+}{
+	{
+		spec: "30 2 * * *",
+		want: []DSTEffect{{Transition: time.Date(2024, time.March, 10, 10, 0, 0, 0, time.UTC), Skipped: true, Count: 1}},
+	},
+	{
+		spec: "*/15 1 * * *",
+		want: []DSTEffect{{Transition: time.Date(2024, time.November, 3, 9, 0, 0, 0, time.UTC), Count: 4}},
+	},
+	{
+		spec: "*/15 * * * *",
+		want: []DSTEffect{{Transition: time.Date(2024, time.March, 10, 10, 0, 0, 0, time.UTC), Skipped: true, Count: 4}},
+	},
+}
+
+func TestDSTEffects(t *testing.T) {
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range dstEffectsTests {
+		sched, err := Parse("CRON_TZ=America/Los_Angeles "+test.spec, false)
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %v", test.spec, err)
+			continue
+		}
+		got := DSTEffects(sched, start, end)
+		if len(got) != len(test.want) {
+			t.Errorf("unexpected number of effects for %q: got:%d want:%d", test.spec, len(got), len(test.want))
+			continue
+		}
+		for i, e := range got {
+			w := test.want[i]
+			if !e.Transition.Equal(w.Transition) || e.Skipped != w.Skipped || e.Count != w.Count {
+				t.Errorf("unexpected effect %d for %q: got:%v skipped=%t count=%d want:%v skipped=%t count=%d",
+					i, test.spec, e.Transition, e.Skipped, e.Count, w.Transition, w.Skipped, w.Count)
+			}
+		}
+	}
+}
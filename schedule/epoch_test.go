@@ -0,0 +1,111 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+// In America/Los_Angeles in 2024, clocks move forward from 02:00 PST to
+// 03:00 PDT at 2024-03-10T10:00:00Z and back from 02:00 PDT to 01:00 PST
+// at 2024-11-03T09:00:00Z.
+var epochTests = []struct {
+	name  string
+	spec  string
+	start string
+	want  []string
+}{
+	{
+		name:  "utc daily",
+		spec:  "@every 24h",
+		start: "2024-01-01T10:00:00Z",
+		want:  []string{"2024-01-02T00:00:00Z", "2024-01-03T00:00:00Z"},
+	},
+	{
+		name:  "local daily",
+		spec:  "CRON_TZ=America/Los_Angeles @every 24h",
+		start: "2024-01-01T10:00:00Z",
+		want:  []string{"2024-01-02T08:00:00Z", "2024-01-03T08:00:00Z"},
+	},
+	{
+		name:  "spring daily",
+		spec:  "CRON_TZ=America/Los_Angeles @every 24h",
+		start: "2024-03-09T09:00:00Z",
+		want:  []string{"2024-03-10T08:00:00Z", "2024-03-11T07:00:00Z", "2024-03-12T07:00:00Z"},
+	},
+	{
+		name:  "fall daily",
+		spec:  "CRON_TZ=America/Los_Angeles @every 24h",
+		start: "2024-11-02T08:00:00Z",
+		want:  []string{"2024-11-03T07:00:00Z", "2024-11-04T08:00:00Z", "2024-11-05T08:00:00Z"},
+	},
+	{
+		name:  "spring quarter hourly",
+		spec:  "CRON_TZ=America/Los_Angeles @every 15m",
+		start: "2024-03-10T09:40:00Z",
+		want:  []string{"2024-03-10T09:45:00Z", "2024-03-10T10:00:00Z", "2024-03-10T10:15:00Z"},
+	},
+	{
+		name:  "fall quarter hourly",
+		spec:  "CRON_TZ=America/Los_Angeles @every 15m",
+		start: "2024-11-03T08:40:00Z",
+		want:  []string{"2024-11-03T08:45:00Z", "2024-11-03T09:00:00Z", "2024-11-03T09:15:00Z"},
+	},
+	{
+		name:  "fall ninety minutes",
+		spec:  "CRON_TZ=America/Los_Angeles @every 90m",
+		start: "2024-11-03T08:10:00Z",
+		want:  []string{"2024-11-03T08:30:00Z", "2024-11-03T11:00:00Z", "2024-11-03T12:30:00Z"},
+	},
+}
+
+func TestEpochSchedule(t *testing.T) {
+	for _, test := range epochTests {
+		sched, err := Parse(test.spec, false)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", test.name, err)
+			continue
+		}
+		at, err := time.Parse(time.RFC3339, test.start)
+		if err != nil {
+			t.Fatalf("invalid start time for %q: %v", test.name, err)
+		}
+		for i, want := range test.want {
+			at = sched.Next(at)
+			if got := at.UTC().Format(time.RFC3339); got != want {
+				t.Errorf("unexpected activation %d for %q: got:%s want:%s", i, test.name, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestEpochNoDrift(t *testing.T) {
+	const every = 7 * time.Minute
+	sched, err := Parse("@every 7m", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	first := sched.Next(start)
+	if first.Sub(time.Unix(0, 0))%every != 0 {
+		t.Fatalf("first activation not aligned to epoch: %v", first)
+	}
+	prev := first
+	for i := 1; i <= 100000; i++ {
+		// Ask for the next activation after a processing
+		// delay, as the scheduler does when it re-arms.
+		delay := time.Duration(i%5) * 1500 * time.Millisecond
+		next := sched.Next(prev.Add(delay))
+		if got := next.Sub(prev); got != every {
+			t.Fatalf("unexpected interval at activation %d: got:%v want:%v", i, got, every)
+		}
+		prev = next
+	}
+	if want := first.Add(100000 * every); !prev.Equal(want) {
+		t.Errorf("cumulative drift after 100000 activations: got:%v want:%v", prev, want)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isRepeating returns whether spec is an ISO 8601 repeating interval.
+func isRepeating(spec string) bool {
+	return strings.HasPrefix(spec, "R") && strings.Contains(spec, "/")
+}
+
+// parseRepeating parses an ISO 8601 repeating interval of the form
+// Rn/start/duration or Rn/start/end, where n is the number of
+// activations, and is unbounded if omitted.
+func parseRepeating(spec string) (*Repeat, error) {
+	parts := strings.Split(spec, "/")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid repeating interval: %q", spec)
+	}
+	s := Repeat{count: -1}
+	if n := strings.TrimPrefix(parts[0], "R"); n != "" {
+		var err error
+		s.count, err = strconv.Atoi(n)
+		if err != nil || s.count < 0 {
+			return nil, fmt.Errorf("invalid repetition count: %q", parts[0])
+		}
+	}
+	var err error
+	s.start, err = time.Parse(time.RFC3339, parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid interval start: %w", err)
+	}
+	if strings.HasPrefix(parts[2], "P") {
+		s.every, err = parseISODuration(parts[2])
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		end, err := time.Parse(time.RFC3339, parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval end: %w", err)
+		}
+		s.every = isoDuration{clock: end.Sub(s.start)}
+	}
+	if !s.every.times(s.start, 1).After(s.start) {
+		return nil, errors.New("interval must be positive")
+	}
+	return &s, nil
+}
+
+// Repeat is a cron.Schedule for an ISO 8601 repeating interval. It
+// activates at the interval's start and then after each interval for
+// a number of activations.
+type Repeat struct {
+	start time.Time
+	every isoDuration
+	count int // count is the number of activations; unbounded if negative.
+}
+
+// Next returns the next activation time after t. Activations are
+// measured from the start of the interval so that calendar durations do
+// not drift when the day of the month is clamped.
+func (s *Repeat) Next(t time.Time) time.Time {
+	k := 0
+	if s.every.isClock() && t.After(s.start) {
+		// Skip directly to the activation before t.
+		k = int(t.Sub(s.start) / s.every.clock)
+	}
+	for ; s.count < 0 || k < s.count; k++ {
+		next := s.every.times(s.start, k)
+		if next.After(t) {
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+// Count returns the number of activations of the schedule, or -1 if
+// the number is unbounded.
+func (s *Repeat) Count() int {
+	if s.count < 0 {
+		return -1
+	}
+	return s.count
+}
+
+// isoDuration is an ISO 8601 duration.
+type isoDuration struct {
+	years, months, days int
+	clock               time.Duration
+}
+
+// isClock returns whether d has no calendar components.
+func (d isoDuration) isClock() bool {
+	return d.years == 0 && d.months == 0 && d.days == 0
+}
+
+// times returns t+k*d. When the years and months of k*d move t to a
+// shorter month, the day of the month is clamped to its last day.
+func (d isoDuration) times(t time.Time, k int) time.Time {
+	y, m, day := t.Date()
+	y += k * d.years
+	m += time.Month(k * d.months)
+	if last := time.Date(y, m+1, 0, 0, 0, 0, 0, t.Location()).Day(); day > last {
+		day = last
+	}
+	h, min, sec := t.Clock()
+	return time.Date(y, m, day+k*d.days, h, min, sec, t.Nanosecond(), t.Location()).Add(time.Duration(k) * d.clock)
+}
+
+// parseISODuration parses an ISO 8601 duration such as P1DT12H or P2W.
+func parseISODuration(s string) (isoDuration, error) {
+	var d isoDuration
+	rest := strings.TrimPrefix(s, "P")
+	if rest == "" || rest == s {
+		return d, fmt.Errorf("invalid duration: %q", s)
+	}
+	inTime := false
+	for rest != "" {
+		if rest[0] == 'T' {
+			if inTime {
+				return d, fmt.Errorf("invalid duration: %q", s)
+			}
+			inTime = true
+			rest = rest[1:]
+			continue
+		}
+		i := strings.IndexFunc(rest, func(r rune) bool { return (r < '0' || '9' < r) && r != '.' })
+		if i <= 0 {
+			return d, fmt.Errorf("invalid duration: %q", s)
+		}
+		v, err := strconv.ParseFloat(rest[:i], 64)
+		if err != nil {
+			return d, fmt.Errorf("invalid duration: %q", s)
+		}
+		unit := rest[i]
+		rest = rest[i+1:]
+		if unit != 'S' && v != float64(int(v)) {
+			return d, fmt.Errorf("invalid duration: %q: only seconds may be fractional", s)
+		}
+		switch {
+		case !inTime && unit == 'Y':
+			d.years += int(v)
+		case !inTime && unit == 'M':
+			d.months += int(v)
+		case !inTime && unit == 'W':
+			d.days += 7 * int(v)
+		case !inTime && unit == 'D':
+			d.days += int(v)
+		case inTime && unit == 'H':
+			d.clock += time.Duration(v) * time.Hour
+		case inTime && unit == 'M':
+			d.clock += time.Duration(v) * time.Minute
+		case inTime && unit == 'S':
+			d.clock += time.Duration(v * float64(time.Second))
+		default:
+			return d, fmt.Errorf("invalid duration: %q", s)
+		}
+	}
+	return d, nil
+}
@@ -0,0 +1,51 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+var repeatTests = []struct {
+	spec string
+	want []string
+}{
+	{
+		spec: "R/2024-01-31T00:00:00Z/P1M",
+		want: []string{"2024-01-31T00:00:00Z", "2024-02-29T00:00:00Z", "2024-03-31T00:00:00Z", "2024-04-30T00:00:00Z", "2024-05-31T00:00:00Z"},
+	},
+	{
+		spec: "R/2024-02-29T12:00:00Z/P1Y",
+		want: []string{"2024-02-29T12:00:00Z", "2025-02-28T12:00:00Z", "2026-02-28T12:00:00Z", "2027-02-28T12:00:00Z", "2028-02-29T12:00:00Z"},
+	},
+	{
+		spec: "R/2024-01-30T00:00:00Z/P1M1D",
+		want: []string{"2024-01-30T00:00:00Z", "2024-03-01T00:00:00Z", "2024-04-01T00:00:00Z", "2024-05-03T00:00:00Z"},
+	},
+	{
+		spec: "R3/2024-01-01T00:00:00Z/PT1H",
+		want: []string{"2024-01-01T00:00:00Z", "2024-01-01T01:00:00Z", "2024-01-01T02:00:00Z", "0001-01-01T00:00:00Z"},
+	},
+}
+
+func TestRepeat(t *testing.T) {
+	start := time.Date(2023, time.December, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range repeatTests {
+		sched, err := Parse(test.spec, false)
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %v", test.spec, err)
+			continue
+		}
+		next := start
+		for i, want := range test.want {
+			next = sched.Next(next)
+			if got := next.UTC().Format(time.RFC3339); got != want {
+				t.Errorf("unexpected activation %d for %q: got:%s want:%s", i, test.spec, got, want)
+				break
+			}
+		}
+	}
+}
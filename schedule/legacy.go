@@ -0,0 +1,293 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// isLegacy returns whether spec is written in the legacy App Engine cron
+// syntax.
+func isLegacy(spec string) bool {
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	return strings.HasPrefix(spec, "every ") || strings.Contains(spec, " of ")
+}
+
+// isLegacyInterval returns whether spec is a legacy App Engine interval
+// schedule such as "every 5 minutes".
+func isLegacyInterval(spec string) bool {
+	f := strings.Fields(strings.ToLower(spec))
+	if len(f) < 2 || f[0] != "every" {
+		return false
+	}
+	_, err := strconv.Atoi(f[1])
+	return err == nil
+}
+
+// parseLegacy parses a schedule written in the legacy App Engine cron
+// syntax. Schedules are interpreted in loc, or in the location of the
+// time passed to Next if loc is nil. The supported forms are
+//
+//	every N minutes|hours [synchronized | from HH:MM to HH:MM]
+//	every day|DAYS HH:MM
+//	ORDINALS day|DAYS of month|MONTHS HH:MM
+//	DATES of month|MONTHS HH:MM
+//
+// where DAYS and MONTHS are comma-separated lists of day and month
+// names, ORDINALS is a comma-separated list of ordinals such as 1st or
+// third and DATES is a comma-separated list of days of the month.
+func parseLegacy(spec string, loc *time.Location) (cron.Schedule, error) {
+	f := strings.Fields(strings.ToLower(spec))
+	if len(f) < 3 {
+		return nil, fmt.Errorf("invalid schedule: %q", spec)
+	}
+	if f[0] == "every" {
+		if n, err := strconv.Atoi(f[1]); err == nil {
+			return parseLegacyInterval(n, f[2:], loc)
+		}
+		if len(f) != 3 {
+			return nil, fmt.Errorf("invalid schedule: %q", spec)
+		}
+		s := &legacySchedule{loc: loc}
+		var err error
+		s.hour, s.min, err = parseClock(f[2])
+		if err != nil {
+			return nil, err
+		}
+		if f[1] != "day" {
+			s.weekdays, err = parseNames(f[1], weekdays)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	}
+
+	s := &legacySchedule{loc: loc}
+	var err error
+	s.hour, s.min, err = parseClock(f[len(f)-1])
+	if err != nil {
+		return nil, err
+	}
+	if f[len(f)-2] != "month" {
+		s.months, err = parseNames(f[len(f)-2], months)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if f[len(f)-3] != "of" {
+		return nil, fmt.Errorf("invalid schedule: %q", spec)
+	}
+	switch len(f) {
+	case 4:
+		s.dates = make(map[int]bool)
+		for _, d := range strings.Split(f[0], ",") {
+			n, err := strconv.Atoi(d)
+			if err != nil || n < 1 || n > 31 {
+				return nil, fmt.Errorf("invalid day of month: %q", d)
+			}
+			s.dates[n] = true
+		}
+	case 5:
+		s.ordinals, err = parseNames(f[0], ordinals)
+		if err != nil {
+			return nil, err
+		}
+		if f[1] != "day" {
+			s.weekdays, err = parseNames(f[1], weekdays)
+			if err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid schedule: %q", spec)
+	}
+	return s, nil
+}
+
+// parseLegacyInterval parses the unit and modifiers of an interval
+// schedule of n units.
+func parseLegacyInterval(n int, f []string, loc *time.Location) (cron.Schedule, error) {
+	if n <= 0 {
+		return nil, errors.New("interval must be positive")
+	}
+	var every time.Duration
+	switch f[0] {
+	case "minute", "minutes", "min", "mins":
+		every = time.Duration(n) * time.Minute
+	case "hour", "hours":
+		every = time.Duration(n) * time.Hour
+	default:
+		return nil, fmt.Errorf("invalid interval unit: %q", f[0])
+	}
+	switch {
+	case len(f) == 1:
+		return epochSchedule{every: every}, nil
+	case len(f) == 2 && f[1] == "synchronized":
+		return intervalSchedule{every: every, from: 0, to: 24*time.Hour - time.Minute, loc: loc}, nil
+	case len(f) == 5 && f[1] == "from" && f[3] == "to":
+		from, err := parseClockDuration(f[2])
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseClockDuration(f[4])
+		if err != nil {
+			return nil, err
+		}
+		if to < from {
+			to += 24 * time.Hour
+		}
+		return intervalSchedule{every: every, from: from, to: to, loc: loc}, nil
+	}
+	return nil, fmt.Errorf("invalid interval modifier: %q", strings.Join(f[1:], " "))
+}
+
+// legacySchedule is a cron.Schedule for legacy App Engine schedules that
+// fire at a time of day on matching days.
+type legacySchedule struct {
+	hour, min int
+	loc       *time.Location
+
+	// Nil sets match any value.
+	weekdays map[int]bool // weekdays holds time.Weekday values.
+	ordinals map[int]bool // ordinals holds the ordinal weekday of the month.
+	dates    map[int]bool // dates holds days of the month.
+	months   map[int]bool // months holds time.Month values.
+}
+
+// Next returns the next activation time after t.
+func (s *legacySchedule) Next(t time.Time) time.Time {
+	loc := s.loc
+	if loc == nil {
+		loc = t.Location()
+	}
+	lt := t.In(loc)
+	y, m, d := lt.Date()
+	// Bound the search to allow for a once
+	// yearly schedule not matching in a year.
+	for i := 0; i < 2*366; i++ {
+		day := time.Date(y, m, d+i, 0, 0, 0, 0, loc)
+		if !s.matches(day) {
+			continue
+		}
+		next := time.Date(day.Year(), day.Month(), day.Day(), s.hour, s.min, 0, 0, loc)
+		if next.After(t) {
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+func (s *legacySchedule) matches(day time.Time) bool {
+	return (s.months == nil || s.months[int(day.Month())]) &&
+		(s.dates == nil || s.dates[day.Day()]) &&
+		(s.weekdays == nil || s.weekdays[int(day.Weekday())]) &&
+		(s.ordinals == nil || s.ordinals[(day.Day()-1)/7+1])
+}
+
+// intervalSchedule is a cron.Schedule that fires at fixed intervals from
+// a time of day until a later time of day, every day.
+type intervalSchedule struct {
+	every    time.Duration
+	from, to time.Duration // from and to are offsets from midnight.
+	loc      *time.Location
+}
+
+// Next returns the next activation time after t.
+func (s intervalSchedule) Next(t time.Time) time.Time {
+	loc := s.loc
+	if loc == nil {
+		loc = t.Location()
+	}
+	lt := t.In(loc)
+	y, m, d := lt.Date()
+	// Start from the previous day to allow
+	// for windows that span midnight.
+	for i := -1; i < 2; i++ {
+		midnight := time.Date(y, m, d+i, 0, 0, 0, 0, loc)
+		start := midnight.Add(s.from)
+		end := midnight.Add(s.to)
+		next := start
+		if !t.Before(start) {
+			next = start.Add((t.Sub(start)/s.every + 1) * s.every)
+		}
+		if !next.After(end) {
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+// parseClock parses a 24 hour HH:MM time of day.
+func parseClock(s string) (hour, min int, err error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid time of day: %q", s)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// parseClockDuration parses a 24 hour HH:MM time of day as an offset
+// from midnight.
+func parseClockDuration(s string) (time.Duration, error) {
+	h, m, err := parseClock(s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// parseNames parses a comma-separated list of names into the set of
+// their values.
+func parseNames(s string, names map[string]int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, n := range strings.Split(s, ",") {
+		v, ok := names[n]
+		if !ok {
+			return nil, fmt.Errorf("invalid name: %q", n)
+		}
+		set[v] = true
+	}
+	return set, nil
+}
+
+var (
+	weekdays = map[string]int{
+		"sunday": 0, "sun": 0,
+		"monday": 1, "mon": 1,
+		"tuesday": 2, "tue": 2,
+		"wednesday": 3, "wed": 3,
+		"thursday": 4, "thu": 4,
+		"friday": 5, "fri": 5,
+		"saturday": 6, "sat": 6,
+	}
+	months = map[string]int{
+		"january": 1, "jan": 1,
+		"february": 2, "feb": 2,
+		"march": 3, "mar": 3,
+		"april": 4, "apr": 4,
+		"may":  5,
+		"june": 6, "jun": 6,
+		"july": 7, "jul": 7,
+		"august": 8, "aug": 8,
+		"september": 9, "sep": 9,
+		"october": 10, "oct": 10,
+		"november": 11, "nov": 11,
+		"december": 12, "dec": 12,
+	}
+	ordinals = map[string]int{
+		"1st": 1, "first": 1,
+		"2nd": 2, "second": 2,
+		"3rd": 3, "third": 3,
+		"4th": 4, "fourth": 4,
+		"5th": 5, "fifth": 5,
+	}
+)
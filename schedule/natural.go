@@ -0,0 +1,388 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// errUnrecognized is returned by lowerNatural when a spec is not in one of
+// the supported natural-language forms.
+var errUnrecognized = errors.New("invalid schedule")
+
+// unsupported returns an errUnrecognized error naming the phrase in spec
+// that is not supported.
+func unsupported(spec, phrase string) error {
+	return fmt.Errorf("%w: unsupported phrase %q in %q", errUnrecognized, phrase, spec)
+}
+
+// isNatural returns whether spec may be a natural-language schedule.
+// Cron specs start with a minute or seconds field, which never contains
+// a letter, and descriptors start with @.
+func isNatural(spec string) bool {
+	f := strings.Fields(spec)
+	return len(f) != 0 && !strings.HasPrefix(f[0], "@") && strings.IndexFunc(f[0], unicode.IsLetter) >= 0
+}
+
+// lowerNatural returns the equivalent of the natural-language schedule
+// spec as a cron spec, or as a legacy App Engine schedule if legacy is
+// true. If seconds is true, returned cron specs have a leading seconds
+// field. The supported forms are
+//
+//	every minute|hour
+//	hourly
+//	[every] day|weekday|weekend [at TIMES]
+//	daily|weekdays|weekends [at TIMES]
+//	[every|on] DAYS [at TIMES]
+//	every week|weekly on DAYS [at TIMES]
+//	every month|monthly on [the] DATES [at TIMES]
+//	[on] [the] DATES of every month|MONTHS [at TIMES]
+//	ORDINALS DAYS of [the|every] month|MONTHS [at TIME]
+//	ORDINALS day of [the|every] month|MONTHS [at TIMES]
+//
+// where DAYS is a list of day names, DATES is a list of days of the
+// month such as 1st or 15, ORDINALS is a list of ordinals such as first
+// or 2nd, MONTHS is a list of month names and TIMES is a list of times of
+// day such as 9am, 5:30 pm, 17:30, noon or midnight. Lists are separated
+// by commas or "and", and "each" may be used for "every". The time of
+// day is midnight if not given, and all the times in a list must have
+// the same minute. "at" may be omitted before times written with a colon,
+// am or pm.
+func lowerNatural(spec string, seconds bool) (lowered string, legacy bool, err error) {
+	var f []string
+	for _, t := range strings.Fields(strings.ReplaceAll(strings.ToLower(spec), ",", " ")) {
+		switch t {
+		case "the", "and":
+		case "each":
+			f = append(f, "every")
+		default:
+			f = append(f, t)
+		}
+	}
+
+	when, at := splitTimes(f)
+	times, err := parseTimes(at)
+	if err != nil {
+		return "", false, err
+	}
+	if len(times) == 0 {
+		times = []clock{{}}
+	}
+
+	switch strings.Join(when, " ") {
+	case "every minute":
+		if len(at) != 0 {
+			return "", false, unsupported(spec, strings.Join(at, " "))
+		}
+		return cronSpec(seconds, "*", "*", "*", "*", "*"), false, nil
+	case "every hour", "hourly":
+		if len(at) != 0 {
+			return "", false, unsupported(spec, strings.Join(at, " "))
+		}
+		return cronSpec(seconds, "0", "*", "*", "*", "*"), false, nil
+	}
+
+	for len(when) != 0 && (when[0] == "every" || when[0] == "on") {
+		when = when[1:]
+	}
+	minute, hours, err := cronTimes(times)
+	if err != nil {
+		return "", false, err
+	}
+	if len(when) == 0 {
+		return cronSpec(seconds, minute, hours, "*", "*", "*"), false, nil
+	}
+	switch strings.Join(when, " ") {
+	case "day", "daily", "night", "nightly":
+		return cronSpec(seconds, minute, hours, "*", "*", "*"), false, nil
+	case "weekday", "weekdays":
+		return cronSpec(seconds, minute, hours, "*", "*", "1-5"), false, nil
+	case "weekend", "weekends", "weekend day", "weekend days":
+		return cronSpec(seconds, minute, hours, "*", "*", "0,6"), false, nil
+	}
+
+	dates := false
+	if len(when) > 2 && when[1] == "on" {
+		switch when[0] {
+		case "week", "weekly":
+			when = when[2:]
+		case "month", "monthly":
+			when = when[2:]
+			dates = true
+		default:
+			return "", false, unsupported(spec, when[0]+" on")
+		}
+	}
+
+	if days, ok := parseList(when, weekday); ok && !dates {
+		return cronSpec(seconds, minute, hours, "*", "*", join(days)), false, nil
+	}
+	if dates {
+		dom, ok := parseList(when, dayOfMonth)
+		if !ok {
+			return "", false, unsupported(spec, firstUnparsed(when, dayOfMonth))
+		}
+		return cronSpec(seconds, minute, hours, join(dom), "*", "*"), false, nil
+	}
+
+	of := indexOf(when, "of")
+	switch of {
+	case -1:
+		return "", false, unsupported(spec, firstUnparsed(when, weekday))
+	case 0:
+		return "", false, unsupported(spec, strings.Join(when, " "))
+	}
+	months := []int(nil)
+	switch period := when[of+1:]; {
+	case len(period) == 0:
+		return "", false, unsupported(spec, "of")
+	case strings.Join(period, " ") == "month", strings.Join(period, " ") == "every month":
+	default:
+		var ok bool
+		months, ok = parseList(period, month)
+		if !ok {
+			return "", false, unsupported(spec, strings.Join(period, " "))
+		}
+	}
+	month := "*"
+	if months != nil {
+		month = join(months)
+	}
+
+	if dom, ok := parseList(when[:of], dayOfMonth); ok {
+		return cronSpec(seconds, minute, hours, join(dom), month, "*"), false, nil
+	}
+
+	// Ordinal weekdays cannot be expressed in cron,
+	// so lower them to the legacy syntax.
+	for i := 1; i < of; i++ {
+		ords, ok := parseList(when[:i], ordinal)
+		if !ok {
+			continue
+		}
+		if i == of-1 && when[i] == "day" {
+			return cronSpec(seconds, minute, hours, join(ords), month, "*"), false, nil
+		}
+		days, ok := parseList(when[i:of], weekday)
+		if !ok {
+			continue
+		}
+		if len(times) != 1 {
+			return "", false, errors.New("only one time of day may be given for ordinal weekdays")
+		}
+		period := "month"
+		if months != nil {
+			period = names(months, monthNames)
+		}
+		return fmt.Sprintf("%s %s of %s %02d:%02d", names(ords, ordinalNames), names(days, weekdayNames), period, times[0].hour, times[0].min), true, nil
+	}
+	phrase := strings.Join(when[:of], " ")
+	for _, t := range when[:of] {
+		_, isOrd := ordinal(t)
+		_, isDay := weekday(t)
+		_, isDate := dayOfMonth(t)
+		if !isOrd && !isDay && !isDate && t != "day" {
+			phrase = t
+			break
+		}
+	}
+	return "", false, unsupported(spec, phrase)
+}
+
+// clock is a time of day.
+type clock struct {
+	hour, min int
+}
+
+// splitTimes splits the times of day from the end of the tokens in f.
+// Times follow "at", or if there is no "at", are the trailing tokens that
+// are unambiguously times of day.
+func splitTimes(f []string) (when, at []string) {
+	if i := indexOf(f, "at"); i >= 0 {
+		return f[:i], f[i+1:]
+	}
+	i := len(f)
+	for i > 0 {
+		t := f[i-1]
+		switch {
+		case t == "am" || t == "pm" || t == "noon" || t == "midnight",
+			strings.Contains(t, ":"), strings.HasSuffix(t, "am"), strings.HasSuffix(t, "pm"):
+			i--
+			continue
+		case i < len(f) && (f[i] == "am" || f[i] == "pm"):
+			if _, err := strconv.Atoi(t); err == nil {
+				i--
+				continue
+			}
+		}
+		break
+	}
+	return f[:i], f[i:]
+}
+
+// parseTimes parses a list of times of day.
+func parseTimes(f []string) ([]clock, error) {
+	var times []clock
+	for i := 0; i < len(f); i++ {
+		t := f[i]
+		switch t {
+		case "noon":
+			times = append(times, clock{hour: 12})
+			continue
+		case "midnight":
+			times = append(times, clock{})
+			continue
+		}
+		if i+1 < len(f) && (f[i+1] == "am" || f[i+1] == "pm") {
+			t += f[i+1]
+			i++
+		}
+		c, err := parseTime(t)
+		if err != nil {
+			return nil, err
+		}
+		times = append(times, c)
+	}
+	return times, nil
+}
+
+// parseTime parses a 12 or 24 hour time of day.
+func parseTime(s string) (clock, error) {
+	for _, layout := range []string{"3pm", "3:04pm", "15:04", "15"} {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return clock{hour: t.Hour(), min: t.Minute()}, nil
+		}
+	}
+	return clock{}, fmt.Errorf("invalid time of day: %q", s)
+}
+
+// cronTimes returns the minute and hour fields of a cron spec for times.
+func cronTimes(times []clock) (minute, hours string, err error) {
+	h := make([]int, len(times))
+	for i, t := range times {
+		if t.min != times[0].min {
+			return "", "", errors.New("times of day must have the same minute")
+		}
+		h[i] = t.hour
+	}
+	return strconv.Itoa(times[0].min), join(h), nil
+}
+
+// cronSpec returns a cron spec with the given fields, and a zero seconds
+// field if seconds is true.
+func cronSpec(seconds bool, fields ...string) string {
+	if seconds {
+		fields = append([]string{"0"}, fields...)
+	}
+	return strings.Join(fields, " ")
+}
+
+// parseList parses each of the tokens in f with parse, returning the
+// sorted set of values and whether all the tokens were parsed.
+func parseList(f []string, parse func(string) (int, bool)) ([]int, bool) {
+	if len(f) == 0 {
+		return nil, false
+	}
+	seen := make(map[int]bool)
+	var vals []int
+	for _, t := range f {
+		v, ok := parse(t)
+		if !ok {
+			return nil, false
+		}
+		if !seen[v] {
+			seen[v] = true
+			vals = append(vals, v)
+		}
+	}
+	sort.Ints(vals)
+	return vals, true
+}
+
+// firstUnparsed returns the first token in f that parse does not accept,
+// or all of f if every token is accepted.
+func firstUnparsed(f []string, parse func(string) (int, bool)) string {
+	for _, t := range f {
+		if _, ok := parse(t); !ok {
+			return t
+		}
+	}
+	return strings.Join(f, " ")
+}
+
+// weekday parses a day name, allowing plurals.
+func weekday(s string) (int, bool) {
+	if d, ok := weekdays[s]; ok {
+		return d, true
+	}
+	d, ok := weekdays[strings.TrimSuffix(s, "s")]
+	return d, ok && strings.HasSuffix(s, "days")
+}
+
+// month parses a month name.
+func month(s string) (int, bool) {
+	m, ok := months[s]
+	return m, ok
+}
+
+// ordinal parses an ordinal weekday of the month.
+func ordinal(s string) (int, bool) {
+	n, ok := ordinals[s]
+	return n, ok
+}
+
+// dayOfMonth parses a day of the month written as a number, optionally
+// with an ordinal suffix, or as an ordinal word.
+func dayOfMonth(s string) (int, bool) {
+	if n, ok := ordinals[s]; ok {
+		return n, true
+	}
+	for _, suffix := range []string{"st", "nd", "rd", "th"} {
+		s = strings.TrimSuffix(s, suffix)
+	}
+	n, err := strconv.Atoi(s)
+	return n, err == nil && 1 <= n && n <= 31
+}
+
+// join returns the comma-separated list of vals.
+func join(vals []int) string {
+	s := make([]string, len(vals))
+	for i, v := range vals {
+		s[i] = strconv.Itoa(v)
+	}
+	return strings.Join(s, ",")
+}
+
+// names returns the comma-separated list of the names of vals.
+func names(vals []int, names []string) string {
+	s := make([]string, len(vals))
+	for i, v := range vals {
+		s[i] = names[v]
+	}
+	return strings.Join(s, ",")
+}
+
+// indexOf returns the index of the first s in f, or -1 if s is not in f.
+func indexOf(f []string, s string) int {
+	for i, t := range f {
+		if t == s {
+			return i
+		}
+	}
+	return -1
+}
+
+var (
+	weekdayNames = []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+	monthNames   = []string{"", "january", "february", "march", "april", "may", "june", "july", "august", "september", "october", "november", "december"}
+	ordinalNames = []string{"", "1st", "2nd", "3rd", "4th", "5th"}
+)
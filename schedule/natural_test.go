@@ -0,0 +1,156 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package schedule
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var naturalTests = []struct {
+	spec    string
+	seconds bool
+
+	wantLowered string
+	wantLegacy  bool
+	wantNext    []string
+}{
+	{
+		spec:        "every weekday at 9am",
+		wantLowered: "0 9 * * 1-5",
+		wantNext:    []string{"2024-01-01T09:00:00Z", "2024-01-02T09:00:00Z", "2024-01-03T09:00:00Z"},
+	},
+	{
+		spec:        "every weekday at 9am",
+		seconds:     true,
+		wantLowered: "0 0 9 * * 1-5",
+		wantNext:    []string{"2024-01-01T09:00:00Z", "2024-01-02T09:00:00Z", "2024-01-03T09:00:00Z"},
+	},
+	{
+		spec:        "every day at 9am and 5pm",
+		wantLowered: "0 9,17 * * *",
+		wantNext:    []string{"2024-01-01T09:00:00Z", "2024-01-01T17:00:00Z", "2024-01-02T09:00:00Z"},
+	},
+	{
+		spec:        "Mondays, Wednesdays and Fridays at 17:30",
+		wantLowered: "30 17 * * 1,3,5",
+		wantNext:    []string{"2024-01-01T17:30:00Z", "2024-01-03T17:30:00Z", "2024-01-05T17:30:00Z"},
+	},
+	{
+		spec:        "weekly on fri at 5 pm",
+		wantLowered: "0 17 * * 5",
+		wantNext:    []string{"2024-01-05T17:00:00Z", "2024-01-12T17:00:00Z", "2024-01-19T17:00:00Z"},
+	},
+	{
+		spec:        "weekends at noon",
+		wantLowered: "0 12 * * 0,6",
+		wantNext:    []string{"2024-01-06T12:00:00Z", "2024-01-07T12:00:00Z", "2024-01-13T12:00:00Z"},
+	},
+	{
+		spec:        "at midnight",
+		wantLowered: "0 0 * * *",
+		wantNext:    []string{"2024-01-02T00:00:00Z", "2024-01-03T00:00:00Z", "2024-01-04T00:00:00Z"},
+	},
+	{
+		spec:        "every minute",
+		wantLowered: "* * * * *",
+		wantNext:    []string{"2024-01-01T00:01:00Z", "2024-01-01T00:02:00Z", "2024-01-01T00:03:00Z"},
+	},
+	{
+		spec:        "every hour",
+		wantLowered: "0 * * * *",
+		wantNext:    []string{"2024-01-01T01:00:00Z", "2024-01-01T02:00:00Z", "2024-01-01T03:00:00Z"},
+	},
+	{
+		spec:        "every month on the 1st and 15th at 9:30pm",
+		wantLowered: "30 21 1,15 * *",
+		wantNext:    []string{"2024-01-01T21:30:00Z", "2024-01-15T21:30:00Z", "2024-02-01T21:30:00Z"},
+	},
+	{
+		spec:        "1st of every month",
+		wantLowered: "0 0 1 * *",
+		wantNext:    []string{"2024-02-01T00:00:00Z", "2024-03-01T00:00:00Z", "2024-04-01T00:00:00Z"},
+	},
+	{
+		spec:        "first day of the month at 6am",
+		wantLowered: "0 6 1 * *",
+		wantNext:    []string{"2024-01-01T06:00:00Z", "2024-02-01T06:00:00Z", "2024-03-01T06:00:00Z"},
+	},
+	{
+		spec:        "15th of march and september 10am",
+		wantLowered: "0 10 15 3,9 *",
+		wantNext:    []string{"2024-03-15T10:00:00Z", "2024-09-15T10:00:00Z", "2025-03-15T10:00:00Z"},
+	},
+	{
+		spec:        "first monday of the month 08:00",
+		wantLowered: "1st monday of month 08:00",
+		wantLegacy:  true,
+		wantNext:    []string{"2024-01-01T08:00:00Z", "2024-02-05T08:00:00Z", "2024-03-04T08:00:00Z"},
+	},
+	{
+		spec:        "2nd tuesday of january and july at noon",
+		wantLowered: "2nd tuesday of january,july 12:00",
+		wantLegacy:  true,
+		wantNext:    []string{"2024-01-09T12:00:00Z", "2024-07-09T12:00:00Z", "2025-01-14T12:00:00Z"},
+	},
+}
+
+func TestNatural(t *testing.T) {
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range naturalTests {
+		lowered, legacy, err := lowerNatural(test.spec, test.seconds)
+		if err != nil {
+			t.Errorf("unexpected error lowering %q: %v", test.spec, err)
+			continue
+		}
+		if lowered != test.wantLowered || legacy != test.wantLegacy {
+			t.Errorf("unexpected lowering of %q: got:%q legacy=%t want:%q legacy=%t",
+				test.spec, lowered, legacy, test.wantLowered, test.wantLegacy)
+		}
+
+		sched, err := Parse(test.spec, test.seconds)
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %v", test.spec, err)
+			continue
+		}
+		next := start
+		for i, want := range test.wantNext {
+			next = sched.Next(next)
+			if got := next.Format(time.RFC3339); got != want {
+				t.Errorf("unexpected fire time %d for %q: got:%s want:%s", i, test.spec, got, want)
+				break
+			}
+		}
+	}
+}
+
+var naturalErrorTests = []struct {
+	spec    string
+	wantErr string
+}{
+	{spec: "last friday of the month", wantErr: `unsupported phrase "last"`},
+	{spec: "fortnightly", wantErr: `unsupported phrase "fortnightly"`},
+	{spec: "every year on the 1st", wantErr: `unsupported phrase "year on"`},
+	{spec: "every month on the 32nd", wantErr: `unsupported phrase "32nd"`},
+	{spec: "first monday of every week", wantErr: `unsupported phrase "every week"`},
+	{spec: "every hour at 9am", wantErr: `unsupported phrase "9am"`},
+	{spec: "every weekday at 25pm", wantErr: `invalid time of day: "25pm"`},
+	{spec: "every day at 9am and 5:30pm", wantErr: "times of day must have the same minute"},
+	{spec: "first monday of the month at 9am and 5pm", wantErr: "only one time of day may be given for ordinal weekdays"},
+}
+
+func TestNaturalErrors(t *testing.T) {
+	for _, test := range naturalErrorTests {
+		_, err := Parse(test.spec, false)
+		if err == nil {
+			t.Errorf("expected error parsing %q", test.spec)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("unexpected error parsing %q: got:%q want to contain:%q", test.spec, err, test.wantErr)
+		}
+	}
+}
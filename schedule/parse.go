@@ -0,0 +1,145 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package schedule
+
+import (
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// secondsParser is a cron spec parser that requires a leading seconds
+// field.
+var secondsParser = cron.NewParser(cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// Parse returns the cron.Schedule for the provided cron spec. Spec
+// schedules apply wall clock semantics over daylight saving time
+// transitions and @every schedules are aligned to the Unix epoch. If
+// seconds is true, spec must have six fields, the first being seconds.
+// Specs in the legacy App Engine cron syntax, natural-language schedules
+// such as "every weekday at 9am" and ISO 8601 repeating intervals are
+// also accepted. A spec may be prefixed with CRON_TZ= or
+// TZ= and a time zone name to be interpreted in that time zone.
+func Parse(spec string, seconds bool) (cron.Schedule, error) {
+	body, tz := splitTZ(spec)
+	if isRepeating(body) {
+		return parseRepeating(body)
+	}
+	var loc *time.Location
+	if tz != "" {
+		var err error
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if isLegacy(body) {
+		sched, err := parseLegacy(body, loc)
+		if err == nil {
+			return sched, nil
+		}
+		// Interval schedules have no natural-language
+		// equivalent, so report their errors directly.
+		if isLegacyInterval(body) || !isNatural(body) {
+			return nil, err
+		}
+	}
+	if isNatural(body) {
+		lowered, legacy, err := lowerNatural(body, seconds)
+		if err != nil {
+			return nil, err
+		}
+		if legacy {
+			return parseLegacy(lowered, loc)
+		}
+		spec = lowered
+		if tz != "" {
+			spec = "CRON_TZ=" + tz + " " + lowered
+		}
+	}
+	parse := cron.ParseStandard
+	if seconds {
+		parse = secondsParser.Parse
+	}
+	sched, err := parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch s := sched.(type) {
+	case *cron.SpecSchedule:
+		return dstSchedule{s}, nil
+	case cron.ConstantDelaySchedule:
+		return epochSchedule{every: s.Delay, loc: loc}, nil
+	}
+	return sched, nil
+}
+
+// splitTZ splits a CRON_TZ or TZ time zone prefix from spec.
+func splitTZ(spec string) (body, tz string) {
+	for _, prefix := range []string{"CRON_TZ=", "TZ="} {
+		if strings.HasPrefix(spec, prefix) {
+			parts := strings.SplitN(strings.TrimPrefix(spec, prefix), " ", 2)
+			if len(parts) == 2 {
+				return parts[1], parts[0]
+			}
+		}
+	}
+	return spec, ""
+}
+
+// unixEpoch is the Unix epoch in UTC.
+var unixEpoch = time.Unix(0, 0).UTC()
+
+// epochSchedule is a cron.Schedule that activates at fixed intervals
+// of wall clock time measured from the Unix epoch rather than from the
+// previous activation. This prevents processing delays from accumulating
+// as drift, so that, for example, "@every 24h" always fires at midnight
+// in the schedule's location.
+type epochSchedule struct {
+	every time.Duration
+	loc   *time.Location // The location of the activation time if nil.
+}
+
+// Next returns the next activation time after t.
+func (s epochSchedule) Next(t time.Time) time.Time {
+	if s.loc != nil {
+		t = t.In(s.loc)
+	}
+	wall := wallSinceEpoch(t)
+	next := t.Add(s.every - wall%s.every)
+	if wallSinceEpoch(next)%s.every == 0 {
+		return next
+	}
+	// The UTC offset changes by a fraction of the interval
+	// before next, so align to the wall clock after the change.
+	w := unixEpoch.Add(wall - wall%s.every + s.every)
+	aligned := time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), w.Second(), w.Nanosecond(), t.Location())
+	if aligned.After(t) {
+		return aligned
+	}
+	return next
+}
+
+// wallSinceEpoch returns the wall clock time elapsed between the Unix
+// epoch and t in t's location.
+func wallSinceEpoch(t time.Time) time.Duration {
+	_, offset := t.Zone()
+	return t.Sub(unixEpoch) + time.Duration(offset)*time.Second
+}
+
+// Once is a cron.Schedule that activates once at a fixed time.
+type Once struct {
+	At time.Time
+}
+
+// Next returns the schedule's activation time if it is after t, and
+// the zero time otherwise.
+func (s Once) Next(t time.Time) time.Time {
+	if s.At.After(t) {
+		return s.At
+	}
+	return time.Time{}
+}
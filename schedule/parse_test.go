@@ -0,0 +1,36 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+var parseTimezoneTests = []struct {
+	spec string
+	want string
+}{
+	{spec: "CRON_TZ=America/New_York 0 9 15 * *", want: "2024-01-15T14:00:00Z"},
+	{spec: "CRON_TZ=America/New_York 15 of month 09:00", want: "2024-01-15T14:00:00Z"},
+	{spec: "CRON_TZ=America/New_York 3rd monday of month 09:00", want: "2024-01-15T14:00:00Z"},
+	{spec: "TZ=America/New_York 15th of every month at 9am", want: "2024-01-15T14:00:00Z"},
+	{spec: "TZ=America/New_York third monday of the month at 9am", want: "2024-01-15T14:00:00Z"},
+}
+
+func TestParseTimezone(t *testing.T) {
+	start := time.Date(2024, time.January, 10, 0, 0, 0, 0, time.UTC)
+	for _, test := range parseTimezoneTests {
+		sched, err := Parse(test.spec, false)
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %v", test.spec, err)
+			continue
+		}
+		got := sched.Next(start).UTC().Format(time.RFC3339)
+		if got != test.want {
+			t.Errorf("unexpected next fire time for %q: got:%s want:%s", test.spec, got, test.want)
+		}
+	}
+}
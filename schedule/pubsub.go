@@ -0,0 +1,79 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package schedule
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// PubSub is a Publisher that publishes to topics in the project of a
+// Pub/Sub client, creating topics that do not exist.
+type PubSub struct {
+	client *pubsub.Client
+
+	mu     sync.Mutex
+	topics map[string]*pubsub.Topic
+}
+
+// NewPubSub returns a new PubSub publishing with client.
+func NewPubSub(client *pubsub.Client) *PubSub {
+	return &PubSub{client: client, topics: make(map[string]*pubsub.Topic)}
+}
+
+// Publish publishes msg to the topic with the given ID, creating the
+// topic if it does not exist.
+func (p *PubSub) Publish(ctx context.Context, topic string, msg *pubsub.Message) (string, error) {
+	t, err := p.topic(ctx, topic)
+	if err != nil {
+		return "", err
+	}
+	id, err := t.Publish(ctx, msg).Get(ctx)
+	if err != nil && msg.OrderingKey != "" {
+		t.ResumePublish(msg.OrderingKey)
+	}
+	return id, err
+}
+
+// topic returns the handle for the topic with the given ID, creating
+// the topic if necessary.
+func (p *PubSub) topic(ctx context.Context, id string) (*pubsub.Topic, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if t, ok := p.topics[id]; ok {
+		return t, nil
+	}
+	t := p.client.Topic(id)
+	ok, err := t.Exists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		t, err = p.client.CreateTopic(ctx, id)
+		if status.Code(err) == codes.AlreadyExists {
+			t, err = p.client.Topic(id), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	t.EnableMessageOrdering = true
+	p.topics[id] = t
+	return t, nil
+}
+
+// Close flushes and stops the publisher's topic handles.
+func (p *PubSub) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, t := range p.topics {
+		t.Stop()
+		delete(p.topics, id)
+	}
+}
@@ -0,0 +1,477 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package schedule provides the scheduling core of the scheduler command
+// for embedding in Go programs and integration tests. It parses the
+// schedule syntaxes accepted by the command and runs jobs on their
+// schedules against the real or a virtual clock. Jobs may be arbitrary
+// cron.Jobs or publish messages through a pluggable Publisher.
+package schedule
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/robfig/cron/v3"
+)
+
+// Publisher publishes messages to topics.
+type Publisher interface {
+	// Publish publishes msg to the topic with the
+	// given ID, returning the message's server ID.
+	Publish(ctx context.Context, topic string, msg *pubsub.Message) (id string, err error)
+}
+
+// PublisherFunc is a function adapter for Publisher.
+type PublisherFunc func(ctx context.Context, topic string, msg *pubsub.Message) (id string, err error)
+
+// Publish returns f(ctx, topic, msg).
+func (f PublisherFunc) Publish(ctx context.Context, topic string, msg *pubsub.Message) (string, error) {
+	return f(ctx, topic, msg)
+}
+
+// Config is the configuration of a Scheduler.
+type Config struct {
+	// Publisher publishes the messages of
+	// jobs added with AddJob. It may be nil
+	// if only Schedule is used.
+	Publisher Publisher
+
+	// Seconds specifies that cron specs have
+	// a leading seconds field.
+	Seconds bool
+
+	// Location is the time zone that cron
+	// specs without a CRON_TZ prefix are
+	// interpreted in. If nil, time.Local
+	// is used.
+	Location *time.Location
+
+	// Clock is the clock jobs are scheduled
+	// against. If nil, jobs are scheduled in
+	// real time.
+	Clock *Clock
+
+	// Logger receives the publish outcomes
+	// of jobs. If nil, slog.Default() is
+	// used.
+	Logger *slog.Logger
+}
+
+// Job is a job that publishes a message to a topic each time its
+// schedule activates.
+type Job struct {
+	// Name is the unique name of the job.
+	Name string
+
+	// Schedule is the job's schedule in
+	// any syntax accepted by Parse.
+	Schedule string
+
+	// Topic is the ID of the topic that
+	// messages are published to.
+	Topic string
+
+	// Data, Attributes and OrderingKey are
+	// the contents of published messages.
+	Data        []byte
+	Attributes  map[string]string
+	OrderingKey string
+}
+
+// Message returns a new message holding the job's message contents.
+func (j Job) Message() *pubsub.Message {
+	msg := &pubsub.Message{
+		Data:        j.Data,
+		OrderingKey: j.OrderingKey,
+	}
+	if len(j.Attributes) != 0 {
+		msg.Attributes = make(map[string]string, len(j.Attributes))
+		for k, v := range j.Attributes {
+			msg.Attributes[k] = v
+		}
+	}
+	return msg
+}
+
+// TimedJob is a cron.Job that is given the activation time of each
+// run. Jobs scheduled with Schedule that implement TimedJob are run
+// with RunAt instead of Run.
+type TimedJob interface {
+	cron.Job
+
+	// RunAt runs the job for the
+	// activation at t.
+	RunAt(t time.Time)
+}
+
+// run runs job for the activation at t.
+func run(job cron.Job, t time.Time) {
+	if j, ok := job.(TimedJob); ok {
+		j.RunAt(t)
+		return
+	}
+	job.Run()
+}
+
+// Entry is a snapshot of the schedule of a job held by a Scheduler.
+type Entry struct {
+	// Next is the time the job will next be
+	// run. It is zero if the schedule has no
+	// further activations.
+	Next time.Time
+
+	// Prev is the time the job was last run
+	// by its schedule. It is zero if the job
+	// has not been run.
+	Prev time.Time
+}
+
+// Scheduler runs jobs on their schedules. Activation times are
+// evaluated on the scheduler's clock.
+type Scheduler struct {
+	pub     Publisher
+	seconds bool
+	loc     *time.Location
+	clock   *Clock
+	log     *slog.Logger
+
+	mu        sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+	jobs      map[string]*entry
+	seq       int           // seq is the sequence number of the last added job.
+	changed   chan struct{} // changed is closed when the jobs change.
+	started   bool
+	stopped   chan struct{} // stopped is closed when the run loop returns.
+	advancing bool          // advancing is set while Advance is running jobs.
+	running   sync.WaitGroup
+}
+
+// entry is a job held by a Scheduler.
+type entry struct {
+	name  string
+	seq   int
+	sched cron.Schedule
+	job   cron.Job
+	next  time.Time
+	prev  time.Time
+}
+
+// New returns a new Scheduler with the given configuration.
+func New(cfg Config) (*Scheduler, error) {
+	loc := cfg.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	log := cfg.Logger
+	if log == nil {
+		log = slog.Default()
+	}
+	return &Scheduler{
+		pub:     cfg.Publisher,
+		seconds: cfg.Seconds,
+		loc:     loc,
+		clock:   cfg.Clock,
+		log:     log,
+		ctx:     context.Background(),
+		jobs:    make(map[string]*entry),
+		changed: make(chan struct{}),
+	}, nil
+}
+
+// Location returns the time zone of the scheduler.
+func (s *Scheduler) Location() *time.Location {
+	return s.loc
+}
+
+// now returns the current time of the scheduler's clock in its
+// location.
+func (s *Scheduler) now() time.Time {
+	return s.clock.Now().In(s.loc)
+}
+
+// AddJob adds j to the scheduler. Jobs may be added before or after the
+// scheduler is started.
+func (s *Scheduler) AddJob(j Job) error {
+	if s.pub == nil {
+		return errors.New("schedule: missing publisher")
+	}
+	if j.Topic == "" {
+		return fmt.Errorf("schedule: %s: missing topic", j.Name)
+	}
+	sched, err := Parse(j.Schedule, s.seconds)
+	if err != nil {
+		return fmt.Errorf("schedule: %s: %w", j.Name, err)
+	}
+	return s.Schedule(j.Name, sched, cron.FuncJob(func() { s.publish(j) }))
+}
+
+// Schedule adds a job with the given name that runs job on sched. Jobs
+// may be added before or after the scheduler is started.
+func (s *Scheduler) Schedule(name string, sched cron.Schedule, job cron.Job) error {
+	if name == "" {
+		return errors.New("schedule: missing job name")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.jobs[name]; exists {
+		return fmt.Errorf("schedule: %s: job already exists", name)
+	}
+	s.seq++
+	e := &entry{name: name, seq: s.seq, sched: sched, job: job}
+	if s.started {
+		e.next = sched.Next(s.now())
+	}
+	s.jobs[name] = e
+	s.changedLocked()
+	return nil
+}
+
+// RemoveJob removes the named job from the scheduler. It returns false
+// if there is no job with the given name.
+func (s *Scheduler) RemoveJob(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[name]; !ok {
+		return false
+	}
+	delete(s.jobs, name)
+	s.changedLocked()
+	return true
+}
+
+// Entry returns the schedule of the named job and whether the job is
+// held by the scheduler. Before the scheduler is started, Next is the
+// next activation after the current time.
+func (s *Scheduler) Entry(name string) (Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.jobs[name]
+	if !ok {
+		return Entry{}, false
+	}
+	if !s.started {
+		return Entry{Next: e.sched.Next(s.now()), Prev: e.prev}, true
+	}
+	return Entry{Next: e.next, Prev: e.prev}, true
+}
+
+// changedLocked wakes the run loop to reconsider the jobs' activation
+// times. It must be called with s.mu held.
+func (s *Scheduler) changedLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Start starts running the scheduler's jobs. Publishes are made with
+// a context derived from ctx, and the scheduler is stopped when ctx is
+// cancelled.
+func (s *Scheduler) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return errors.New("schedule: scheduler already started")
+	}
+	s.started = true
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	now := s.now()
+	for _, e := range s.jobs {
+		e.next = e.sched.Next(now)
+	}
+	s.stopped = make(chan struct{})
+	go s.run(s.ctx)
+	return nil
+}
+
+// Stop stops the scheduler and waits for running jobs to complete. A
+// stopped scheduler cannot be restarted.
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	stopped := s.stopped
+	s.mu.Unlock()
+	if stopped != nil {
+		<-stopped
+	}
+	s.running.Wait()
+}
+
+// run runs the scheduler's jobs as they become due until ctx is
+// cancelled.
+func (s *Scheduler) run(ctx context.Context) {
+	defer close(s.stopped)
+	for {
+		s.mu.Lock()
+		var next time.Time
+		for _, e := range s.jobs {
+			if !e.next.IsZero() && (next.IsZero() || e.next.Before(next)) {
+				next = e.next
+			}
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		var timer *time.Timer
+		var fire <-chan time.Time
+		if !next.IsZero() {
+			if real := s.clock.Real(next); !real.IsZero() {
+				timer = time.NewTimer(time.Until(real))
+				fire = timer.C
+			}
+		}
+		select {
+		case <-ctx.Done():
+		case <-fire:
+		case <-changed:
+		case <-s.clock.changed():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		s.dispatch()
+	}
+}
+
+// dispatch starts the jobs that are due at the current time of the
+// scheduler's clock, in the order of their activation times.
+func (s *Scheduler) dispatch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.advancing {
+		return
+	}
+	now := s.now()
+	for _, e := range s.dueLocked(now) {
+		at := e.next
+		e.prev = at
+		e.next = e.sched.Next(now)
+		s.running.Add(1)
+		go func(job cron.Job) {
+			defer s.running.Done()
+			run(job, at)
+		}(e.job)
+	}
+}
+
+// dueLocked returns the jobs with activations at or before t, in order
+// of activation time and then of addition. It must be called with s.mu
+// held.
+func (s *Scheduler) dueLocked(t time.Time) []*entry {
+	var due []*entry
+	for _, e := range s.jobs {
+		if !e.next.IsZero() && !e.next.After(t) {
+			due = append(due, e)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].next.Equal(due[j].next) {
+			return due[i].next.Before(due[j].next)
+		}
+		return due[i].seq < due[j].seq
+	})
+	return due
+}
+
+// maxAdvanceRuns is the maximum number of runs of each job made by a
+// call to Advance.
+const maxAdvanceRuns = 10000
+
+// Advance sets the scheduler's virtual clock to each activation of its
+// jobs up to and including t in time order, and runs the job. Each run
+// completes before the next is started. Activations at the same time
+// are run in the order the jobs were added. The clock is left at t. It
+// returns the number of runs.
+func (s *Scheduler) Advance(t time.Time) (int, error) {
+	if s.clock == nil {
+		return 0, errors.New("schedule: virtual clock not enabled")
+	}
+	s.mu.Lock()
+	if s.advancing {
+		s.mu.Unlock()
+		return 0, errors.New("schedule: already advancing")
+	}
+	now := s.now()
+	if t.Before(now) {
+		s.mu.Unlock()
+		return 0, fmt.Errorf("schedule: cannot advance clock backwards from %v to %v", now, t)
+	}
+	s.advancing = true
+	if !s.started {
+		for _, e := range s.jobs {
+			e.next = e.sched.Next(now)
+		}
+	}
+	s.mu.Unlock()
+
+	runs := make(map[string]int)
+	var n int
+	for {
+		s.mu.Lock()
+		var e *entry
+		for _, d := range s.dueLocked(t) {
+			if runs[d.name] < maxAdvanceRuns {
+				e = d
+				break
+			}
+		}
+		if e == nil {
+			s.mu.Unlock()
+			break
+		}
+		at := e.next
+		e.prev = at
+		e.next = e.sched.Next(at)
+		job := e.job
+		s.mu.Unlock()
+
+		s.clock.Set(at)
+		run(job, at)
+		runs[e.name]++
+		n++
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clock.Set(t)
+	now = s.now()
+	for _, e := range s.jobs {
+		if !e.next.IsZero() && !e.next.After(now) {
+			// Skip activations beyond
+			// the run limit.
+			e.next = e.sched.Next(now)
+		}
+	}
+	s.advancing = false
+	if !s.started {
+		for _, e := range s.jobs {
+			e.next = time.Time{}
+		}
+	}
+	return n, nil
+}
+
+// publish publishes the message of job j.
+func (s *Scheduler) publish(j Job) {
+	s.mu.Lock()
+	ctx := s.ctx
+	s.mu.Unlock()
+	id, err := s.pub.Publish(ctx, j.Topic, j.Message())
+	if err != nil {
+		s.log.Error("failed to publish", "job", j.Name, "topic", j.Topic, "err", err)
+		return
+	}
+	s.log.Info("published", "job", j.Name, "topic", j.Topic, "id", id)
+}
@@ -0,0 +1,200 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package schedule
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// recorder records the names and virtual times of job runs.
+type recorder struct {
+	clock *Clock
+
+	mu   sync.Mutex
+	runs []string
+}
+
+func (r *recorder) job(name string) cron.Job {
+	return cron.FuncJob(func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.runs = append(r.runs, fmt.Sprintf("%s@%s", name, r.clock.Now().UTC().Format("15:04")))
+	})
+}
+
+func (r *recorder) got() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.runs...)
+}
+
+func TestAdvance(t *testing.T) {
+	start := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewClock(start, 0)
+	s, err := New(Config{Location: time.UTC, Clock: clock})
+	if err != nil {
+		t.Fatalf("unexpected error creating scheduler: %v", err)
+	}
+	r := &recorder{clock: clock}
+	for _, j := range []struct {
+		name, spec string
+	}{
+		{name: "half", spec: "*/30 * * * *"},
+		{name: "hourly", spec: "0 * * * *"},
+	} {
+		sched, err := Parse(j.spec, false)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %q: %v", j.spec, err)
+		}
+		err = s.Schedule(j.name, sched, r.job(j.name))
+		if err != nil {
+			t.Fatalf("unexpected error scheduling %s: %v", j.name, err)
+		}
+	}
+	err = s.Schedule("once", Once{At: start.Add(45 * time.Minute)}, r.job("once"))
+	if err != nil {
+		t.Fatalf("unexpected error scheduling once: %v", err)
+	}
+	err = s.Schedule("half", cron.Every(time.Minute), r.job("half"))
+	if err == nil {
+		t.Error("expected error for duplicate job")
+	}
+
+	n, err := s.Advance(start.Add(90 * time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected error advancing: %v", err)
+	}
+	want := []string{"half@00:30", "once@00:45", "half@01:00", "hourly@01:00", "half@01:30"}
+	if n != len(want) {
+		t.Errorf("unexpected number of runs: got:%d want:%d", n, len(want))
+	}
+	if got := r.got(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("unexpected runs:\ngot: %v\nwant:%v", got, want)
+	}
+	if got, want := clock.Now(), start.Add(90*time.Minute); !got.Equal(want) {
+		t.Errorf("unexpected clock time: got:%v want:%v", got, want)
+	}
+
+	e, ok := s.Entry("hourly")
+	if !ok {
+		t.Fatal("missing entry for hourly")
+	}
+	if want := start.Add(time.Hour); !e.Prev.Equal(want) {
+		t.Errorf("unexpected previous run: got:%v want:%v", e.Prev, want)
+	}
+	if want := start.Add(2 * time.Hour); !e.Next.Equal(want) {
+		t.Errorf("unexpected next run: got:%v want:%v", e.Next, want)
+	}
+	e, _ = s.Entry("once")
+	if !e.Next.IsZero() {
+		t.Errorf("unexpected next run of one-shot job: %v", e.Next)
+	}
+
+	if !s.RemoveJob("half") {
+		t.Error("failed to remove job")
+	}
+	if s.RemoveJob("half") {
+		t.Error("unexpectedly removed job twice")
+	}
+	_, err = s.Advance(start)
+	if err == nil {
+		t.Error("expected error advancing backwards")
+	}
+}
+
+// timedJob records the activation times it is run for.
+type timedJob struct {
+	at []time.Time
+}
+
+func (j *timedJob) Run()              { j.at = append(j.at, time.Time{}) }
+func (j *timedJob) RunAt(t time.Time) { j.at = append(j.at, t) }
+
+func TestTimedJob(t *testing.T) {
+	start := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	s, err := New(Config{Location: time.UTC, Clock: NewClock(start, 0)})
+	if err != nil {
+		t.Fatalf("unexpected error creating scheduler: %v", err)
+	}
+	var j timedJob
+	err = s.Schedule("timed", cron.Every(time.Hour), &j)
+	if err != nil {
+		t.Fatalf("unexpected error scheduling job: %v", err)
+	}
+	_, err = s.Advance(start.Add(2 * time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error advancing: %v", err)
+	}
+	want := []time.Time{start.Add(time.Hour), start.Add(2 * time.Hour)}
+	if fmt.Sprint(j.at) != fmt.Sprint(want) {
+		t.Errorf("unexpected activation times:\ngot: %v\nwant:%v", j.at, want)
+	}
+}
+
+func TestAdvanceRealClock(t *testing.T) {
+	s, err := New(Config{})
+	if err != nil {
+		t.Fatalf("unexpected error creating scheduler: %v", err)
+	}
+	_, err = s.Advance(time.Now().Add(time.Hour))
+	if err == nil {
+		t.Error("expected error advancing the real time clock")
+	}
+}
+
+func TestStart(t *testing.T) {
+	start := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	// One virtual minute passes every ten
+	// milliseconds of real time.
+	clock := NewClock(start, 6000)
+	s, err := New(Config{Location: time.UTC, Clock: clock})
+	if err != nil {
+		t.Fatalf("unexpected error creating scheduler: %v", err)
+	}
+	var (
+		mu   sync.Mutex
+		runs []time.Time
+		done = make(chan struct{})
+	)
+	err = s.Schedule("minutely", cron.Every(time.Minute), cron.FuncJob(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		runs = append(runs, clock.Now())
+		if len(runs) == 3 {
+			close(done)
+		}
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error scheduling job: %v", err)
+	}
+	err = s.Start(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error starting scheduler: %v", err)
+	}
+	err = s.Start(context.Background())
+	if err == nil {
+		t.Error("expected error restarting scheduler")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for runs")
+	}
+	s.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, r := range runs {
+		if r.Before(start.Add(time.Duration(i+1) * time.Minute)) {
+			t.Errorf("run %d before its activation: %v", i, r)
+		}
+	}
+}
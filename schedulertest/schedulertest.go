@@ -0,0 +1,298 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package schedulertest provides a test fixture that runs scheduled
+// jobs against an in-process Pub/Sub server under a virtual clock and
+// collects the published messages for assertions.
+package schedulertest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/kortschak/scheduler/listen"
+	"github.com/kortschak/scheduler/schedule"
+	"github.com/robfig/cron/v3"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Config is the configuration of a Fixture.
+type Config struct {
+	// Project is the Pub/Sub project of the
+	// fixture's server. If empty, "test" is
+	// used.
+	Project string
+
+	// Start is the initial time of the virtual
+	// clock. If zero, the current time is used.
+	// Cron specs are evaluated in the location
+	// of Start.
+	Start time.Time
+
+	// Seconds specifies that cron specs have
+	// a leading seconds field.
+	Seconds bool
+
+	// Jobs are the scheduled jobs. Their topics
+	// are created by New.
+	Jobs []schedule.Job
+}
+
+// Message is a message published by a job and received by the
+// fixture's collector.
+type Message struct {
+	// Job is the name of the job that published
+	// the message.
+	Job string
+
+	// Time is the virtual time the job fired.
+	Time time.Time
+
+	listen.Message
+}
+
+// Fixture is an in-process Pub/Sub server with a scheduler driven by
+// a virtual clock and a collector of the messages it publishes.
+type Fixture struct {
+	// Client is a client for the fixture's
+	// Pub/Sub server, for use by code under
+	// test.
+	Client *pubsub.Client
+
+	t      testing.TB
+	srv    *pstest.Server
+	pub    *schedule.PubSub
+	clock  *schedule.Clock
+	sched  *schedule.Scheduler
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// topics maps collector subscription
+	// IDs to their topic IDs.
+	topics map[string]string
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	fired    map[string]firing           // Keyed by server message ID.
+	received map[string][]listen.Message // Keyed by topic ID.
+	errs     []error                     // errs holds failed publishes.
+}
+
+// firing is the record of a job firing.
+type firing struct {
+	job  string
+	time time.Time
+}
+
+// New returns a new Fixture with the given configuration. The topics
+// of the configured jobs are created, and the collector is subscribed
+// to each of them before New returns. The fixture is closed when the
+// test completes.
+func New(t testing.TB, cfg Config) *Fixture {
+	t.Helper()
+	if cfg.Project == "" {
+		cfg.Project = "test"
+	}
+	if cfg.Start.IsZero() {
+		cfg.Start = time.Now()
+	}
+
+	f := &Fixture{
+		t:        t,
+		srv:      pstest.NewServer(),
+		clock:    schedule.NewClock(cfg.Start, 0),
+		done:     make(chan struct{}),
+		topics:   make(map[string]string),
+		fired:    make(map[string]firing),
+		received: make(map[string][]listen.Message),
+	}
+	f.cond = sync.NewCond(&f.mu)
+	t.Cleanup(f.close)
+
+	ctx := context.Background()
+	conn, err := grpc.Dial(f.srv.Addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("schedulertest: failed to dial server: %v", err)
+	}
+	f.Client, err = pubsub.NewClient(ctx, cfg.Project, option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatalf("schedulertest: failed to create client: %v", err)
+	}
+	f.pub = schedule.NewPubSub(f.Client)
+	f.sched, err = schedule.New(schedule.Config{Location: cfg.Start.Location(), Clock: f.clock})
+	if err != nil {
+		t.Fatalf("schedulertest: failed to create scheduler: %v", err)
+	}
+
+	var subs []listen.Subscription
+	for _, j := range cfg.Jobs {
+		sched, err := schedule.Parse(j.Schedule, cfg.Seconds)
+		if err != nil {
+			t.Fatalf("schedulertest: %s: %v", j.Name, err)
+		}
+		j := j
+		err = f.sched.Schedule(j.Name, sched, cron.FuncJob(func() { f.publish(j) }))
+		if err != nil {
+			t.Fatalf("schedulertest: %v", err)
+		}
+		id := j.Topic + "-schedulertest"
+		if _, ok := f.topics[id]; ok {
+			continue
+		}
+		f.topics[id] = j.Topic
+		_, err = f.Client.CreateTopic(ctx, j.Topic)
+		if err != nil {
+			t.Fatalf("schedulertest: failed to create topic %s: %v", j.Topic, err)
+		}
+		subs = append(subs, listen.Subscription{ID: id, Topic: j.Topic})
+	}
+	if len(subs) == 0 {
+		return f
+	}
+
+	ctx, f.cancel = context.WithCancel(ctx)
+	ready := make(chan struct{})
+	l := listen.New(f.Client,
+		listen.Subscribe(subs...),
+		listen.OnReady(func() { close(ready) }),
+		listen.Logger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+	)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(f.done)
+		errc <- l.Receive(ctx, f.collect)
+	}()
+	select {
+	case <-ready:
+	case err := <-errc:
+		t.Fatalf("schedulertest: failed to start collector: %v", err)
+	}
+	return f
+}
+
+// collect records a message received by the collector.
+func (f *Fixture) collect(_ context.Context, m listen.Message) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	topic := f.topics[m.Subscription]
+	f.received[topic] = append(f.received[topic], m)
+	f.cond.Broadcast()
+}
+
+// publish publishes the message of job j, recording its firing at the
+// current time of the virtual clock. Failed publishes are reported by
+// Advance.
+func (f *Fixture) publish(j schedule.Job) {
+	now := f.Now()
+	id, err := f.pub.Publish(context.Background(), j.Topic, j.Message())
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err != nil {
+		f.errs = append(f.errs, fmt.Errorf("%s: failed to publish at %v: %w", j.Name, now, err))
+		return
+	}
+	f.fired[id] = firing{job: j.Name, time: now}
+}
+
+// Now returns the current time of the fixture's virtual clock in the
+// location of the configured start time.
+func (f *Fixture) Now() time.Time {
+	return f.clock.Now().In(f.sched.Location())
+}
+
+// Advance advances the virtual clock by d, running the fixture's
+// scheduler to publish the message of each job activation within the
+// interval in time order. Activations at the same time are published in
+// job order. It returns the number of messages published, and fails the
+// test if any publish fails.
+func (f *Fixture) Advance(d time.Duration) int {
+	f.t.Helper()
+	n, err := f.sched.Advance(f.Now().Add(d))
+	if err != nil {
+		f.t.Fatalf("schedulertest: %v", err)
+	}
+	f.mu.Lock()
+	errs := f.errs
+	f.errs = nil
+	f.mu.Unlock()
+	for _, err := range errs {
+		f.t.Errorf("schedulertest: %v", err)
+	}
+	if errs != nil {
+		f.t.FailNow()
+	}
+	return n
+}
+
+// Messages returns the messages received on the given topic so far, in
+// the order they were received.
+func (f *Fixture) Messages(topic string) []Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.messagesLocked(topic)
+}
+
+// Wait waits up to timeout of real time for at least n messages to have
+// been received on the given topic, and returns the received messages.
+// It fails the test if the messages are not received in time.
+func (f *Fixture) Wait(topic string, n int, timeout time.Duration) []Message {
+	f.t.Helper()
+	timer := time.AfterFunc(timeout, func() {
+		f.mu.Lock()
+		f.cond.Broadcast()
+		f.mu.Unlock()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.received[topic]) < n {
+		if !time.Now().Before(deadline) {
+			f.t.Fatalf("schedulertest: received %d messages on %s, want at least %d", len(f.received[topic]), topic, n)
+		}
+		f.cond.Wait()
+	}
+	return f.messagesLocked(topic)
+}
+
+// messagesLocked returns the messages received on topic. It must be
+// called with f.mu held.
+func (f *Fixture) messagesLocked(topic string) []Message {
+	msgs := make([]Message, len(f.received[topic]))
+	for i, m := range f.received[topic] {
+		fired := f.fired[m.ID]
+		msgs[i] = Message{Job: fired.job, Time: fired.time, Message: m}
+	}
+	return msgs
+}
+
+// close stops the collector and the fixture's server.
+func (f *Fixture) close() {
+	if f.cancel != nil {
+		f.cancel()
+		<-f.done
+	}
+	if f.pub != nil {
+		f.pub.Close()
+	}
+	if f.Client != nil {
+		err := f.Client.Close()
+		if err != nil {
+			f.t.Errorf("schedulertest: failed to close client: %v", err)
+		}
+	}
+	err := f.srv.Close()
+	if err != nil {
+		f.t.Errorf("schedulertest: failed to close server: %v", err)
+	}
+}
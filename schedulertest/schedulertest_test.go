@@ -0,0 +1,99 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package schedulertest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kortschak/scheduler/schedule"
+)
+
+var start = time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestFixtureAdvance(t *testing.T) {
+	f := New(t, Config{
+		Start: start,
+		Jobs: []schedule.Job{
+			{Name: "hourly", Schedule: "0 * * * *", Topic: "ticks", Data: []byte("tick")},
+			{Name: "daily", Schedule: "0 0 * * *", Topic: "days", Data: []byte("day")},
+		},
+	})
+
+	n := f.Advance(3 * time.Hour)
+	if n != 3 {
+		t.Errorf("unexpected number of publishes: got:%d want:3", n)
+	}
+	if got, want := f.Now(), start.Add(3*time.Hour); !got.Equal(want) {
+		t.Errorf("unexpected clock time: got:%v want:%v", got, want)
+	}
+	msgs := f.Wait("ticks", 3, 5*time.Second)
+	if len(msgs) != 3 {
+		t.Fatalf("unexpected number of messages: got:%d want:3", len(msgs))
+	}
+	seen := make(map[int64]bool)
+	for _, m := range msgs {
+		if m.Job != "hourly" {
+			t.Errorf("unexpected job: got:%q want:%q", m.Job, "hourly")
+		}
+		if string(m.Data) != "tick" {
+			t.Errorf("unexpected data: got:%q want:%q", m.Data, "tick")
+		}
+		seen[m.Time.Unix()] = true
+	}
+	for i := 1; i <= 3; i++ {
+		want := start.Add(time.Duration(i) * time.Hour)
+		if !seen[want.Unix()] {
+			t.Errorf("missing message fired at %v", want)
+		}
+	}
+	if got := f.Messages("days"); len(got) != 0 {
+		t.Errorf("unexpected messages on days: got:%d want:0", len(got))
+	}
+
+	n = f.Advance(21 * time.Hour)
+	if n != 22 {
+		t.Errorf("unexpected number of publishes: got:%d want:22", n)
+	}
+	days := f.Wait("days", 1, 5*time.Second)
+	if want := start.Add(24 * time.Hour); !days[0].Time.Equal(want) {
+		t.Errorf("unexpected fire time: got:%v want:%v", days[0].Time, want)
+	}
+}
+
+func TestFixtureSeconds(t *testing.T) {
+	f := New(t, Config{
+		Start:   start,
+		Seconds: true,
+		Jobs: []schedule.Job{
+			{Name: "fast", Schedule: "*/10 * * * * *", Topic: "fast"},
+		},
+	})
+	n := f.Advance(time.Minute)
+	if n != 6 {
+		t.Errorf("unexpected number of publishes: got:%d want:6", n)
+	}
+	f.Wait("fast", 6, 5*time.Second)
+}
+
+func TestFixtureNoAdvance(t *testing.T) {
+	f := New(t, Config{
+		Start: start,
+		Jobs: []schedule.Job{
+			{Name: "hourly", Schedule: "0 * * * *", Topic: "ticks"},
+		},
+	})
+	// The virtual clock only moves when advanced.
+	time.Sleep(100 * time.Millisecond)
+	if got := f.Now(); !got.Equal(start) {
+		t.Errorf("unexpected clock time: got:%v want:%v", got, start)
+	}
+	if n := f.Advance(59 * time.Minute); n != 0 {
+		t.Errorf("unexpected number of publishes: got:%d want:0", n)
+	}
+	if got := f.Messages("ticks"); len(got) != 0 {
+		t.Errorf("unexpected messages: got:%d want:0", len(got))
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// loadSchema returns the JSON Schema in the file at path, or nil if path
+// is empty.
+func loadSchema(path string) (*jsonschema.Schema, error) {
+	if path == "" {
+		return nil, nil
+	}
+	s, err := jsonschema.Compile(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload schema: %w", err)
+	}
+	return s, nil
+}
+
+// validateJSON returns an error if data is not JSON valid against s. A
+// nil s accepts any data.
+func validateJSON(s *jsonschema.Schema, data []byte) error {
+	if s == nil {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	err := dec.Decode(&v)
+	if err != nil {
+		return fmt.Errorf("payload is not JSON: %w", err)
+	}
+	err = s.Validate(v)
+	if err != nil {
+		return fmt.Errorf("payload does not match schema: %w", err)
+	}
+	return nil
+}
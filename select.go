@@ -0,0 +1,109 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+)
+
+// selectors is a flag.Value holding job selectors. Each selector is given
+// as key=pattern, where key is name to match job names or is the key of
+// a job label, and pattern is a glob pattern matched against the name or
+// label value. The flag may be given more than once.
+type selectors []selector
+
+// selector is a job selector.
+type selector struct {
+	key, pattern string
+}
+
+func (s *selectors) String() string {
+	parts := make([]string, len(*s))
+	for i, sel := range *s {
+		parts[i] = sel.key + "=" + sel.pattern
+	}
+	return strings.Join(parts, ",")
+}
+
+func (s *selectors) Set(v string) error {
+	key, pattern, ok := strings.Cut(v, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("invalid selector %q: want key=pattern", v)
+	}
+	_, err := path.Match(pattern, "")
+	if err != nil {
+		return fmt.Errorf("invalid selector %q: %w", v, err)
+	}
+	*s = append(*s, selector{key: key, pattern: pattern})
+	return nil
+}
+
+// match returns whether j matches any of the selectors.
+func (s selectors) match(j job) bool {
+	for _, sel := range s {
+		val, ok := j.Name, true
+		if sel.key != "name" {
+			val, ok = j.Labels[sel.key]
+		}
+		if !ok {
+			continue
+		}
+		// The pattern was checked by Set.
+		if m, _ := path.Match(sel.pattern, val); m {
+			return true
+		}
+	}
+	return false
+}
+
+// selectJobs returns the enabled jobs that match any of the only
+// selectors, or all the enabled jobs if there are none, and do not match
+// any of the skip selectors. Jobs that depend on a job that is not
+// selected are also not selected, since they would never run.
+func selectJobs(jobs []job, only, skip selectors) []job {
+	selected := make(map[string]bool)
+	all := true
+	for _, j := range jobs {
+		selected[j.Name] = j.enabled() && (len(only) == 0 || only.match(j)) && !skip.match(j)
+		all = all && selected[j.Name]
+	}
+	if all {
+		return jobs
+	}
+	deps := make(map[string]string)
+	for _, j := range jobs {
+		deps[j.Name] = j.DependsOn
+	}
+	var sel []job
+	for _, j := range jobs {
+		if !selected[j.Name] {
+			continue
+		}
+		if parent := unselectedAncestor(j.Name, deps, selected); parent != "" {
+			slog.Warn("not running job depending on unselected job", "job", j.Name, "depends_on", parent)
+			continue
+		}
+		sel = append(sel, j)
+	}
+	return sel
+}
+
+// unselectedAncestor returns the name of the first job in the dependency
+// chain of the named job that is not selected, or the empty string if all
+// are selected. Dependency cycles and unknown jobs are left for
+// checkDependencies to report.
+func unselectedAncestor(name string, deps map[string]string, selected map[string]bool) string {
+	seen := map[string]bool{name: true}
+	for dep := deps[name]; dep != "" && !seen[dep]; dep = deps[dep] {
+		seen[dep] = true
+		if sel, ok := selected[dep]; ok && !sel {
+			return dep
+		}
+	}
+	return ""
+}
@@ -0,0 +1,114 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var selectableJobs = []job{
+	{Name: "ingest-orders", Labels: map[string]string{"team": "data"}},
+	{Name: "ingest-users", Labels: map[string]string{"team": "data"}},
+	{Name: "report", Labels: map[string]string{"team": "bi"}, DependsOn: "ingest-orders"},
+	{Name: "summary", DependsOn: "report"},
+	{Name: "cleanup", Enabled: new(bool)},
+	{Name: "ping"},
+}
+
+var selectJobsTests = []struct {
+	name       string
+	only, skip []string
+	want       []string
+}{
+	{
+		name: "all_enabled",
+		want: []string{"ingest-orders", "ingest-users", "report", "summary", "ping"},
+	},
+	{
+		name: "only_name",
+		only: []string{"name=ingest-*"},
+		want: []string{"ingest-orders", "ingest-users"},
+	},
+	{
+		name: "only_label",
+		only: []string{"team=data", "name=ping"},
+		want: []string{"ingest-orders", "ingest-users", "ping"},
+	},
+	{
+		name: "only_disabled",
+		only: []string{"name=cleanup"},
+		want: nil,
+	},
+	{
+		name: "skip",
+		skip: []string{"team=bi"},
+		want: []string{"ingest-orders", "ingest-users", "ping"},
+	},
+	{
+		name: "skip_dependency",
+		skip: []string{"name=ingest-orders"},
+		want: []string{"ingest-users", "ping"},
+	},
+	{
+		name: "only_dependent",
+		only: []string{"name=summary"},
+		want: nil,
+	},
+	{
+		name: "only_chain",
+		only: []string{"name=ingest-orders", "name=report", "name=summary"},
+		want: []string{"ingest-orders", "report", "summary"},
+	},
+	{
+		name: "missing_label",
+		only: []string{"owner=*"},
+		want: nil,
+	},
+}
+
+func TestSelectJobs(t *testing.T) {
+	for _, test := range selectJobsTests {
+		t.Run(test.name, func(t *testing.T) {
+			var only, skip selectors
+			for _, s := range test.only {
+				err := only.Set(s)
+				if err != nil {
+					t.Fatalf("unexpected error setting selector: %v", err)
+				}
+			}
+			for _, s := range test.skip {
+				err := skip.Set(s)
+				if err != nil {
+					t.Fatalf("unexpected error setting selector: %v", err)
+				}
+			}
+			var got []string
+			for _, j := range selectJobs(selectableJobs, only, skip) {
+				got = append(got, j.Name)
+			}
+			if strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("unexpected selected jobs: got:%v want:%v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSelectorSet(t *testing.T) {
+	var s selectors
+	for _, v := range []string{"name", "=x", "name=[", ""} {
+		if err := s.Set(v); err == nil {
+			t.Errorf("expected error for selector %q", v)
+		}
+	}
+	for _, v := range []string{"name=a*", "team=data"} {
+		if err := s.Set(v); err != nil {
+			t.Errorf("unexpected error for selector %q: %v", v, err)
+		}
+	}
+	if got, want := s.String(), "name=a*,team=data"; got != want {
+		t.Errorf("unexpected selectors: got:%q want:%q", got, want)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/kortschak/scheduler/schedule"
+	"github.com/robfig/cron/v3"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// selftest runs the selftest subcommand.
+func selftest(args []string) {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	duration := flags.Duration("timeout", 5*time.Second, "specify run duration")
+	flags.Parse(args)
+
+	err := runSelftest(*duration)
+	if err != nil {
+		slog.Error("selftest failed", "err", err)
+		os.Exit(1)
+	}
+	fmt.Println("selftest passed")
+}
+
+// runSelftest publishes a message every second to an in-memory Pub/Sub
+// server for the given duration while receiving from a subscription to
+// the topic. It returns an error if messages do not flow end to end.
+func runSelftest(duration time.Duration) error {
+	const (
+		project = "selftest"
+		topic   = "selftest"
+	)
+
+	srv := pstest.NewServer()
+	defer srv.Close()
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+
+	pub, err := newPublisher(ctx, project, 0, 0, option.WithGRPCConn(conn))
+	if err != nil {
+		return err
+	}
+	defer pub.close()
+	err = pub.createTopic(ctx, topic, topicSettings{})
+	if err != nil {
+		return err
+	}
+	defer pub.stop()
+
+	client, err := pubsub.NewClient(ctx, project, option.WithGRPCConn(conn))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	sub, err := client.CreateSubscription(ctx, "selftest", pubsub.SubscriptionConfig{Topic: client.Topic(topic)})
+	if err != nil {
+		return err
+	}
+
+	var published, failed, received int64
+	sched, err := schedule.Parse("@every 1s", false)
+	if err != nil {
+		return err
+	}
+	s, err := schedule.New(schedule.Config{})
+	if err != nil {
+		return err
+	}
+	err = s.Schedule("selftest", sched, cron.FuncJob(func() {
+		id, err := pub.publish(ctx, topic, &pubsub.Message{Data: []byte("selftest")})
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("failed to publish", "err", err)
+				atomic.AddInt64(&failed, 1)
+			}
+			return
+		}
+		slog.Info("published", "topic", topic, "id", id)
+		atomic.AddInt64(&published, 1)
+	}))
+	if err != nil {
+		return err
+	}
+	err = s.Start(ctx)
+	if err != nil {
+		return err
+	}
+	err = sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+		slog.Info("received", "id", m.ID)
+		atomic.AddInt64(&received, 1)
+		m.Ack()
+	})
+	s.Stop()
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+
+	slog.Info("selftest complete", "published", published, "failed", failed, "received", received)
+	switch {
+	case failed != 0:
+		return fmt.Errorf("%d publishes failed", failed)
+	case published == 0:
+		return errors.New("no messages published")
+	case received == 0:
+		return errors.New("no messages received")
+	}
+	return nil
+}
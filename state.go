@@ -0,0 +1,82 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// stateFile persists the time each job was last fired by its schedule
+// so that missed runs can be caught up after a restart. The state is
+// held as a JSON object mapping job names to times.
+type stateFile struct {
+	path string
+
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// loadState returns the state held in the file at path. A missing file
+// is treated as empty state.
+func loadState(path string) (*stateFile, error) {
+	s := &stateFile{path: path, last: make(map[string]time.Time)}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(b, &s.last)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// lastFired returns the time the named job was last fired, and whether
+// it has been fired.
+func (s *stateFile) lastFired(name string) (time.Time, bool) {
+	if s == nil {
+		return time.Time{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.last[name]
+	return t, ok
+}
+
+// record records that the named job was fired at t and writes the state
+// to the file. Failures to write are logged.
+func (s *stateFile) record(name string, t time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last[name] = t
+	b, err := json.MarshalIndent(s.last, "", "\t")
+	if err != nil {
+		slog.Error("failed to encode state", "err", err)
+		return
+	}
+	// Write via a rename so that a crash does
+	// not leave a truncated state file.
+	tmp := filepath.Join(filepath.Dir(s.path), "."+filepath.Base(s.path)+".tmp")
+	err = os.WriteFile(tmp, b, 0o644)
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		slog.Error("failed to write state", "err", err)
+	}
+}
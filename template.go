@@ -0,0 +1,51 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateData is the data available to job templates when they are
+// rendered at fire time.
+type templateData struct {
+	JobName string
+
+	// Now is the time the job was fired
+	// and ScheduledTime is the activation
+	// time it was fired for, before any
+	// splay or jitter.
+	Now           time.Time
+	ScheduledTime time.Time
+
+	// RunCount is the number of times the job
+	// has been fired, including this firing.
+	RunCount int64
+}
+
+// templateFuncs are the functions available to job templates.
+var templateFuncs = template.FuncMap{
+	"env": os.Getenv,
+}
+
+// parseTemplate parses s as a job template with the given name.
+func parseTemplate(name, s string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Parse(s)
+}
+
+// isTemplate returns whether s contains template actions.
+func isTemplate(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+// render executes tmpl with data and returns the result.
+func render(tmpl *template.Template, data templateData) (string, error) {
+	var buf strings.Builder
+	err := tmpl.Execute(&buf, data)
+	return buf.String(), err
+}
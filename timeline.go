@@ -0,0 +1,177 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kortschak/scheduler/internal/cli"
+)
+
+// timeline runs the timeline subcommand.
+func timeline(args []string) {
+	flags := flag.NewFlagSet("timeline", flag.ExitOnError)
+	statePath := flags.String("state-file", "", "specify state file written by scheduler -state")
+	path := flags.String("history", "", "specify history database written by scheduler -history")
+	asCSV := flags.Bool("csv", false, "write the timeline as CSV")
+	flags.Parse(args)
+	if (*path == "") == (*statePath == "") || flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "timeline requires exactly one of -state-file or -history")
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if *statePath != "" {
+		b, err := os.ReadFile(*statePath)
+		if err != nil {
+			cli.Fatal("failed to read state", "err", err)
+		}
+		var last map[string]time.Time
+		err = json.Unmarshal(b, &last)
+		if err != nil {
+			cli.Fatal("failed to read state", "err", fmt.Errorf("%s: %w", *statePath, err))
+		}
+		execs := stateExecutions(last)
+		if *asCSV {
+			err = writeFiringsCSV(os.Stdout, execs)
+		} else {
+			err = writeFirings(os.Stdout, execs)
+		}
+		if err != nil {
+			cli.Fatal("failed to write timeline", "err", err)
+		}
+		return
+	}
+
+	h, err := openHistory(*path, true)
+	if err != nil {
+		cli.Fatal("failed to read history", "err", err)
+	}
+	execs, err := h.all()
+	h.close()
+	if err != nil {
+		cli.Fatal("failed to read history", "err", err)
+	}
+	if *asCSV {
+		err = writeExecutionsCSV(os.Stdout, execs)
+	} else {
+		err = writeExecutions(os.Stdout, execs)
+	}
+	if err != nil {
+		cli.Fatal("failed to write timeline", "err", err)
+	}
+}
+
+// stateExecutions returns the last firings of jobs recorded in a state
+// file as executions in the order they were fired. Only the job and
+// time of the executions are known.
+func stateExecutions(last map[string]time.Time) []execution {
+	execs := make([]execution, 0, len(last))
+	for name, t := range last {
+		execs = append(execs, execution{Job: name, Time: t})
+	}
+	sortExecutions(execs)
+	return execs
+}
+
+// writeFirings writes the times and jobs of execs to w as a table.
+func writeFirings(w io.Writer, execs []execution) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tJOB")
+	for _, e := range execs {
+		fmt.Fprintf(tw, "%s\t%s\n", e.Time.Format("2006-01-02T15:04:05.000Z07:00"), e.Job)
+	}
+	return tw.Flush()
+}
+
+// writeFiringsCSV writes the times and jobs of execs to w as CSV with a
+// header row.
+func writeFiringsCSV(w io.Writer, execs []execution) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "job"})
+	for _, e := range execs {
+		cw.Write([]string{e.Time.Format(time.RFC3339Nano), e.Job})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeExecutions writes execs to w as a table.
+func writeExecutions(w io.Writer, execs []execution) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tJOB\tATTEMPTS\tOUTCOME\tDESTINATION\tRESULT\tLATENCY")
+	for _, e := range execs {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%v\n",
+			e.Time.Format("2006-01-02T15:04:05.000Z07:00"), e.Job, e.Attempts, e.Outcome,
+			e.Destination, executionResults(e), e.Latency)
+	}
+	return tw.Flush()
+}
+
+// writeExecutionsCSV writes execs to w as CSV with a header row.
+func writeExecutionsCSV(w io.Writer, execs []execution) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{
+		"time", "job", "execution_id", "scheduled_time", "attempts", "outcome",
+		"destination", "message_ids", "http_statuses", "latency_seconds", "error",
+	})
+	for _, e := range execs {
+		statuses := make([]string, len(e.HTTPStatuses))
+		for i, s := range e.HTTPStatuses {
+			statuses[i] = strconv.Itoa(s)
+		}
+		cw.Write([]string{
+			e.Time.Format(time.RFC3339Nano),
+			e.Job,
+			e.ExecutionID,
+			e.ScheduledTime.Format(time.RFC3339Nano),
+			strconv.Itoa(e.Attempts),
+			e.Outcome,
+			e.Destination,
+			strings.Join(e.MessageIDs, " "),
+			strings.Join(statuses, " "),
+			strconv.FormatFloat(e.Latency.Seconds(), 'f', -1, 64),
+			e.Error,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// executionResults returns a summary of the message IDs or HTTP
+// statuses of e, or its error if it failed.
+func executionResults(e execution) string {
+	if e.Error != "" {
+		return e.Error
+	}
+	if len(e.HTTPStatuses) != 0 {
+		s := make([]string, len(e.HTTPStatuses))
+		for i, code := range e.HTTPStatuses {
+			s[i] = strconv.Itoa(code)
+		}
+		return strings.Join(s, ",")
+	}
+	return strings.Join(e.MessageIDs, ",")
+}
+
+// sortExecutions sorts execs by the start of their first attempt.
+func sortExecutions(execs []execution) {
+	sort.SliceStable(execs, func(i, j int) bool {
+		if !execs[i].Time.Equal(execs[j].Time) {
+			return execs[i].Time.Before(execs[j].Time)
+		}
+		return execs[i].Job < execs[j].Job
+	})
+}
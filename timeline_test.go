@@ -0,0 +1,115 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+var timelineExecutions = []execution{
+	{
+		Job:           "cron-job",
+		ExecutionID:   "a1",
+		ScheduledTime: time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC),
+		Time:          time.Date(2021, 6, 1, 10, 0, 0, 100000, time.UTC),
+		Attempts:      1,
+		Destination:   "topic",
+		MessageIDs:    []string{"1", "2"},
+		Outcome:       "success",
+		Latency:       10 * time.Millisecond,
+	},
+	{
+		Job:           "cleanup",
+		ExecutionID:   "b2",
+		ScheduledTime: time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC),
+		Time:          time.Date(2021, 6, 1, 10, 0, 0, 1000000, time.UTC),
+		Attempts:      3,
+		Destination:   "http://localhost:8080/tasks/cleanup",
+		HTTPStatuses:  []int{500, 500, 503},
+		Outcome:       "failure",
+		Latency:       1500 * time.Millisecond,
+		Error:         "unexpected status: 503",
+	},
+}
+
+func TestWriteExecutions(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeExecutions(&buf, timelineExecutions)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{
+		"TIME                      JOB       ATTEMPTS  OUTCOME  DESTINATION                          RESULT                  LATENCY",
+		"2021-06-01T10:00:00.000Z  cron-job  1         success  topic                                1,2                     10ms",
+		"2021-06-01T10:00:00.001Z  cleanup   3         failure  http://localhost:8080/tasks/cleanup  unexpected status: 503  1.5s",
+	}
+	got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(got) != len(want) {
+		t.Fatalf("unexpected number of lines: got:%d want:%d\n%s", len(got), len(want), buf.String())
+	}
+	for i := range want {
+		if strings.TrimRight(got[i], " ") != want[i] {
+			t.Errorf("unexpected line %d:\ngot: %q\nwant:%q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestWriteExecutionsCSV(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeExecutionsCSV(&buf, timelineExecutions)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `time,job,execution_id,scheduled_time,attempts,outcome,destination,message_ids,http_statuses,latency_seconds,error
+2021-06-01T10:00:00.0001Z,cron-job,a1,2021-06-01T10:00:00Z,1,success,topic,1 2,,0.01,
+2021-06-01T10:00:00.001Z,cleanup,b2,2021-06-01T10:00:00Z,3,failure,http://localhost:8080/tasks/cleanup,,500 500 503,1.5,unexpected status: 503
+`
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected CSV:\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestStateTimeline(t *testing.T) {
+	last := map[string]time.Time{
+		"weekly": time.Date(2021, 6, 1, 9, 0, 0, 0, time.UTC),
+		"hourly": time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC),
+		"daily":  time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC),
+		"also":   time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC),
+	}
+	execs := stateExecutions(last)
+
+	var buf bytes.Buffer
+	err := writeFirings(&buf, execs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `TIME                      JOB
+2021-06-01T00:00:00.000Z  daily
+2021-06-01T09:00:00.000Z  weekly
+2021-06-01T10:00:00.000Z  also
+2021-06-01T10:00:00.000Z  hourly
+`
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected table:\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	buf.Reset()
+	err = writeFiringsCSV(&buf, execs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want = `time,job
+2021-06-01T00:00:00Z,daily
+2021-06-01T09:00:00Z,weekly
+2021-06-01T10:00:00Z,also
+2021-06-01T10:00:00Z,hourly
+`
+	if got := buf.String(); got != want {
+		t.Errorf("unexpected CSV:\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
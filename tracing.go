@@ -0,0 +1,26 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// tracer is the tracer for job executions. Spans are not recorded
+// unless tracing has been started.
+var tracer = otel.Tracer("github.com/kortschak/scheduler")
+
+// injectTrace adds the trace context of ctx to the message attributes,
+// allocating attrs if necessary.
+func injectTrace(ctx context.Context, attrs map[string]string) map[string]string {
+	if attrs == nil {
+		attrs = make(map[string]string)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(attrs))
+	return attrs
+}
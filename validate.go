@@ -0,0 +1,385 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kortschak/scheduler/internal/cli"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// validateConfig runs the validate subcommand.
+func validateConfig(args []string) {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s validate [-format yaml|json|toml] config|dir...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	format := flags.String("format", "", "specify config format (yaml, json or toml; determined from file extensions if empty)")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	_, err := cli.ConfigFormat("", *format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	var paths []string
+	for _, p := range flags.Args() {
+		fi, err := os.Stat(p)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if !fi.IsDir() {
+			paths = append(paths, p)
+			continue
+		}
+		matches, err := cli.ConfigFiles(p)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		paths = append(paths, matches...)
+	}
+
+	v := validator{w: os.Stderr, format: *format, ok: true}
+	for _, p := range paths {
+		cfg, ok := v.file(p, nil)
+		if ok {
+			v.checkJobs(cfg)
+		}
+	}
+	if !v.ok {
+		os.Exit(1)
+	}
+}
+
+// problem is a problem found in a config file. Line and column are
+// one-based and are zero when the position is not known.
+type problem struct {
+	line, col int
+	msg       string
+}
+
+// writeProblems writes the problems found in the file at path to w.
+func writeProblems(w io.Writer, path string, problems []problem) {
+	for _, p := range problems {
+		switch {
+		case p.line == 0:
+			fmt.Fprintf(w, "%s: %s\n", path, p.msg)
+		case p.col == 0:
+			fmt.Fprintf(w, "%s:%d: %s\n", path, p.line, p.msg)
+		default:
+			fmt.Fprintf(w, "%s:%d:%d: %s\n", path, p.line, p.col, p.msg)
+		}
+	}
+}
+
+// linePrefix matches the line number prefix of yaml errors.
+var linePrefix = regexp.MustCompile(`^(?:yaml: )?line (\d+): `)
+
+// validator checks config files, writing the problems it finds to w.
+type validator struct {
+	w      io.Writer
+	format string
+
+	// ok is cleared when a
+	// problem is found.
+	ok bool
+}
+
+// checkedConfig is a config loaded for validation.
+type checkedConfig struct {
+	config
+
+	// jobs holds the jobs of the config and
+	// its includes, with their defaults applied.
+	jobs []checkedJob
+
+	// path is the path of the config file
+	// and node is its jobs node, or nil if
+	// its position is not known.
+	path string
+	node *yamlv3.Node
+}
+
+// checkedJob is a job loaded for validation with the file and node it
+// was defined in.
+type checkedJob struct {
+	job
+
+	// path is the path of the config file
+	// and node is the job's node, or nil if
+	// its position is not known.
+	path string
+	node *yamlv3.Node
+}
+
+// report writes the problems found in the file at path.
+func (v *validator) report(path string, problems ...problem) {
+	if len(problems) == 0 {
+		return
+	}
+	writeProblems(v.w, path, problems)
+	v.ok = false
+}
+
+// at reports a problem found in the file at path at the position of the
+// node n. If n is nil, the position is not reported.
+func (v *validator) at(path string, n *yamlv3.Node, format string, args ...interface{}) {
+	p := problem{msg: fmt.Sprintf(format, args...)}
+	if n != nil {
+		p.line, p.col = n.Line, n.Column
+	}
+	v.report(path, p)
+}
+
+// fail reports an error that is not associated with a position.
+func (v *validator) fail(err error) {
+	fmt.Fprintln(v.w, err)
+	v.ok = false
+}
+
+// file returns the config in the file at path merged with the configs
+// it includes, as loadConfigFile does, reporting the problems found in
+// decoding the files. It returns false if the config could not be
+// decoded. The including parameter holds the absolute paths of the files
+// that include path, and is used to detect include cycles.
+func (v *validator) file(path string, including []string) (checkedConfig, bool) {
+	abs := path
+	if path != "-" && !cli.IsRemote(path) {
+		var err error
+		abs, err = filepath.Abs(path)
+		if err != nil {
+			v.fail(err)
+			return checkedConfig{}, false
+		}
+	}
+	for _, p := range including {
+		if p == abs {
+			v.report(path, problem{msg: "include cycle"})
+			return checkedConfig{}, false
+		}
+	}
+	format, err := cli.ConfigFormat(path, v.format)
+	if err != nil {
+		v.fail(err)
+		return checkedConfig{}, false
+	}
+	b, err := cli.ReadConfig(path)
+	if err != nil {
+		v.fail(err)
+		return checkedConfig{}, false
+	}
+	b, err = cli.ConvertConfig(path, format, b)
+	if err != nil {
+		v.fail(err)
+		return checkedConfig{}, false
+	}
+	cfg, doc, problems := decodeYAML(path, format, b)
+	if format != "yaml" {
+		// Positions refer to the converted config.
+		for i := range problems {
+			problems[i].line, problems[i].col = 0, 0
+		}
+		doc = nil
+	}
+	v.report(path, problems...)
+	if cfg == nil {
+		return checkedConfig{}, false
+	}
+
+	_, err = cfg.location()
+	if err != nil {
+		v.at(path, mapValue(doc, "timezone"), "invalid timezone: %v", err)
+	}
+
+	c := checkedConfig{config: *cfg, path: path, node: mapValue(doc, "jobs")}
+	names := make(map[string]string)
+	for i, j := range cfg.Jobs {
+		var n *yamlv3.Node
+		if c.node != nil && i < len(c.node.Content) {
+			n = c.node.Content[i]
+		}
+		if j.Name == "" {
+			v.at(path, n, "missing job name")
+		} else if _, ok := names[j.Name]; ok {
+			v.at(path, mapValue(n, "name"), "duplicate job name %q", j.Name)
+		}
+		names[j.Name] = path
+		if cfg.Seconds {
+			j.Seconds = true
+		}
+		c.jobs = append(c.jobs, checkedJob{job: j, path: path, node: n})
+	}
+
+	for _, pattern := range cfg.Include {
+		paths, err := includePaths(path, pattern)
+		if err != nil {
+			v.fail(err)
+			continue
+		}
+		for _, p := range paths {
+			inc, ok := v.file(p, append(including, abs))
+			if !ok {
+				continue
+			}
+			err = mergeConfig(&c.config, inc.config, p, names)
+			if err != nil {
+				v.fail(err)
+				continue
+			}
+			c.jobs = append(c.jobs, inc.jobs...)
+		}
+	}
+	for i := range c.jobs {
+		c.Defaults.apply(&c.jobs[i].job)
+	}
+	return c, true
+}
+
+// decodeYAML returns the config in the yaml in b converted from the
+// config at path in the given format, its document node and the problems
+// found in decoding it. References to environment variables are expanded
+// by cli.ExpandEnv before decoding, and unknown fields and undefined
+// variables are reported as problems. The returned config is nil if b
+// could not be decoded, and the node is nil if the config is empty.
+func decodeYAML(path, format string, b []byte) (*config, *yamlv3.Node, []problem) {
+	var root yamlv3.Node
+	err := yamlv3.Unmarshal(b, &root)
+	if err != nil {
+		return nil, nil, []problem{yamlProblem(err.Error())}
+	}
+	if len(root.Content) == 0 {
+		return nil, nil, []problem{{msg: "empty config"}}
+	}
+
+	var problems []problem
+	err = cli.ExpandEnv(path, format, &root)
+	if err != nil {
+		for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+			var eerr *cli.EnvError
+			if errors.As(err, &eerr) {
+				problems = append(problems, problem{line: eerr.Line, msg: fmt.Sprintf("undefined environment variable %q", eerr.Name)})
+			}
+		}
+	}
+
+	// Values may not have the types of their fields
+	// until they are expanded, so only unknown fields
+	// are taken from decoding the unexpanded config.
+	dec := yamlv3.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	err = dec.Decode(new(config))
+	var terr *yamlv3.TypeError
+	if errors.As(err, &terr) {
+		for _, e := range terr.Errors {
+			if strings.Contains(e, "not found in type") {
+				problems = append(problems, yamlProblem(e))
+			}
+		}
+	}
+	var cfg config
+	err = root.Decode(&cfg)
+	if err != nil {
+		if !errors.As(err, &terr) {
+			return nil, nil, append(problems, yamlProblem(err.Error()))
+		}
+		for _, e := range terr.Errors {
+			problems = append(problems, yamlProblem(e))
+		}
+	}
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].line < problems[j].line })
+	return &cfg, root.Content[0], problems
+}
+
+// checkJobs reports invalid schedules, timezones, durations, targets and
+// job dependencies in the jobs of cfg.
+func (v *validator) checkJobs(cfg checkedConfig) {
+	jobs := make([]job, len(cfg.jobs))
+	for i, j := range cfg.jobs {
+		jobs[i] = j.job
+		n := j.node
+		target := mapValue(n, "target")
+		_, err := j.location(nil)
+		if err != nil {
+			v.at(j.path, mapValue(n, "timezone"), "%s: invalid timezone: %v", j.Name, err)
+		}
+		if j.DependsOn == "" {
+			_, err = j.schedule()
+			if err != nil {
+				field := mapValue(n, "frequency")
+				if field == nil {
+					field = mapValue(n, "at")
+				}
+				if field == nil {
+					field = n
+				}
+				v.at(j.path, field, "%s: invalid schedule: %v", j.Name, err)
+			}
+		}
+		policy, err := concurrencyPolicy(j.Name, j.ConcurrencyPolicy)
+		if err != nil {
+			v.at(j.path, mapValue(n, "concurrencypolicy"), "%s: %v", j.Name, err)
+		} else if policy != nil && j.MaxConcurrent > 0 {
+			v.at(j.path, mapValue(n, "concurrencypolicy"), "%s: concurrency policy and max concurrent are mutually exclusive", j.Name)
+		}
+		if j.Target.destination() == unknownDestination {
+			v.at(j.path, mapValue(target, "destination"), "%s: unsupported destination %q", j.Name, j.Target.Destination)
+			continue
+		}
+		_, err = newScheduledJob(j.job, &jobEnv{appEngine: cfg.AppEngine})
+		if err != nil {
+			if target == nil {
+				target = n
+			}
+			v.at(j.path, target, "%s: %v", j.Name, err)
+		}
+	}
+	err := checkDependencies(jobs)
+	if err != nil {
+		v.at(cfg.path, cfg.node, "invalid job dependencies: %v", err)
+	}
+}
+
+// yamlProblem returns a problem for a yaml error message, extracting the
+// line number if it is present.
+func yamlProblem(msg string) problem {
+	m := linePrefix.FindStringSubmatch(msg)
+	if m == nil {
+		return problem{msg: msg}
+	}
+	line, _ := strconv.Atoi(m[1])
+	return problem{line: line, msg: msg[len(m[0]):]}
+}
+
+// mapValue returns the value node for key in the yaml mapping node n, or
+// nil if n is not a mapping or does not hold key.
+func mapValue(n *yamlv3.Node, key string) *yamlv3.Node {
+	if n == nil || n.Kind != yamlv3.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
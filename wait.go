@@ -0,0 +1,73 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// waitForFile waits until a file exists at path, returning an error if
+// it does not exist within timeout.
+func waitForFile(path string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := os.Stat(path)
+		if err == nil {
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v waiting for %s", timeout, path)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// waitForAddr waits until addr accepts TCP connections, returning an
+// error if it does not within timeout. Connection attempts are retried
+// with exponential backoff.
+func waitForAddr(addr string, timeout time.Duration) error {
+	const maxDelay = 5 * time.Second
+	deadline := time.Now().Add(timeout)
+	delay := 100 * time.Millisecond
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			return conn.Close()
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("timed out after %v waiting for %s: %w", timeout, addr, err)
+		}
+		if delay > remaining {
+			delay = remaining
+		}
+		time.Sleep(delay)
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// waitForSubscribers waits until all the publisher's topics have a
+// subscription, returning the IDs of the topics that still have none
+// after timeout.
+func waitForSubscribers(ctx context.Context, pub *publisher, timeout time.Duration) ([]string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		ids, err := pub.unsubscribed(ctx)
+		if err != nil || len(ids) == 0 || time.Now().After(deadline) {
+			return ids, err
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
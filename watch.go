@@ -0,0 +1,66 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"time"
+
+	"github.com/kortschak/scheduler/internal/cli"
+)
+
+// watchConfig returns a channel that receives a value each time the
+// contents of the config files named by path, or of the config files in
+// dir, or of the files they include, change. The config is polled every
+// interval.
+func watchConfig(path, dir, format string, interval time.Duration) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+	go func() {
+		last, _ := configDigest(path, dir, format)
+		// Dirty, but the ticker lives as long as the program.
+		for range time.Tick(interval) {
+			sum, err := configDigest(path, dir, format)
+			if err != nil || bytes.Equal(sum, last) {
+				// Files that cannot be read may be
+				// part way through being replaced.
+				continue
+			}
+			last = sum
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changed
+}
+
+// configDigest returns a digest of the names and contents of the config
+// files named by path, or of the config files in dir if path is empty,
+// and of the files they include.
+func configDigest(path, dir, format string) ([]byte, error) {
+	if path == "" {
+		path = dir
+	}
+	paths, err := configPaths(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := load(path, "", format)
+	if err == nil {
+		paths = cfg.files
+	}
+	h := sha256.New()
+	for _, p := range paths {
+		b, err := cli.ReadConfig(p)
+		if err != nil {
+			return nil, err
+		}
+		h.Write([]byte(p))
+		h.Write(b)
+	}
+	return h.Sum(nil), nil
+}
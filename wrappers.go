@@ -0,0 +1,154 @@
+// Copyright ©2021 Dan Kortschak. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// jobFunc is a job run for an activation scheduled at a given time. It
+// is a schedule.TimedJob, so the scheduler runs it with the time of each
+// activation. When it is run by Run, the current time of the clock is
+// used.
+type jobFunc func(scheduled time.Time)
+
+// Run runs the job for an activation at the current time.
+func (f jobFunc) Run() { f(clock.Now()) }
+
+// RunAt runs the job for an activation scheduled at t.
+func (f jobFunc) RunAt(t time.Time) { f(t) }
+
+// wrapper decorates a jobFunc with additional behaviour. It is the
+// analogue of cron.JobWrapper for jobs given their scheduled time.
+type wrapper func(jobFunc) jobFunc
+
+// chain returns j decorated with wrappers. The first wrapper is the
+// outermost, as for cron.NewChain.
+func chain(j jobFunc, wrappers ...wrapper) jobFunc {
+	for i := len(wrappers) - 1; i >= 0; i-- {
+		j = wrappers[i](j)
+	}
+	return j
+}
+
+// recoverPanics returns a wrapper that recovers panics in the named job
+// and logs them. If errTopic is not empty, a diagnostic message
+// describing the panic is also published to errTopic.
+func recoverPanics(name string, pub *publisher, errTopic string) wrapper {
+	return func(j jobFunc) jobFunc {
+		return func(scheduled time.Time) {
+			defer func() {
+				r := recover()
+				if r == nil {
+					return
+				}
+				buf := make([]byte, 64<<10)
+				buf = buf[:runtime.Stack(buf, false)]
+				slog.Error("panic in job", "job", name, "panic", r, "stack", string(buf))
+				if errTopic != "" {
+					publishPanic(pub, errTopic, name, r, buf)
+				}
+			}()
+			j(scheduled)
+		}
+	}
+}
+
+// panicDiagnostic is the message published to the error topic when a job
+// panics.
+type panicDiagnostic struct {
+	Job   string `json:"job"`
+	Panic string `json:"panic"`
+	Stack string `json:"stack"`
+}
+
+// publishPanic publishes a diagnostic for a panic in the named job to
+// errTopic. Failures, including panics, are logged.
+func publishPanic(pub *publisher, errTopic, name string, r interface{}, stack []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("panic publishing diagnostic", "job", name, "panic", r)
+		}
+	}()
+	data, err := json.Marshal(panicDiagnostic{Job: name, Panic: fmt.Sprint(r), Stack: string(stack)})
+	if err != nil {
+		slog.Error("failed to encode diagnostic", "job", name, "err", err)
+		return
+	}
+	id, err := pub.publish(context.Background(), errTopic, &pubsub.Message{
+		Data:       data,
+		Attributes: map[string]string{"job": name},
+	})
+	if err != nil {
+		slog.Error("failed to publish diagnostic", "job", name, "topic", errTopic, "err", err)
+		return
+	}
+	slog.Info("published diagnostic", "job", name, "topic", errTopic, "id", id)
+}
+
+// limitConcurrent returns a wrapper that skips invocations of the named
+// job when n invocations are already running. It is analogous to
+// cron.SkipIfStillRunning, but allows up to n overlapping invocations.
+func limitConcurrent(name string, n int) wrapper {
+	return func(j jobFunc) jobFunc {
+		sem := make(chan struct{}, n)
+		return func(scheduled time.Time) {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+				j(scheduled)
+			default:
+				slog.Info("skipping job: invocations still running", "job", name, "running", n)
+			}
+		}
+	}
+}
+
+// delayIfStillRunning returns a wrapper that serializes invocations of
+// the named job, delaying each until the previous invocation completes.
+// It is analogous to cron.DelayIfStillRunning, and logs delays of more
+// than a minute.
+func delayIfStillRunning(name string) wrapper {
+	return func(j jobFunc) jobFunc {
+		var mu sync.Mutex
+		return func(scheduled time.Time) {
+			start := time.Now()
+			mu.Lock()
+			defer mu.Unlock()
+			if d := time.Since(start); d > time.Minute {
+				slog.Info("delayed job: previous invocation still running", "job", name, "delay", d)
+			}
+			j(scheduled)
+		}
+	}
+}
+
+// concurrencyPolicy returns the wrapper implementing the named
+// concurrency policy for the named job. Policies are skip, where
+// invocations are skipped while a previous invocation is running, delay,
+// where invocations wait for the previous invocation to complete, and
+// allow, where invocations may overlap. The returned wrapper is nil for
+// allow and an empty policy.
+func concurrencyPolicy(name, policy string) (wrapper, error) {
+	switch strings.ToLower(policy) {
+	case "", "allow":
+		return nil, nil
+	case "skip":
+		return limitConcurrent(name, 1), nil
+	case "delay":
+		return delayIfStillRunning(name), nil
+	default:
+		return nil, fmt.Errorf("invalid concurrency policy: %q", policy)
+	}
+}